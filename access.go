@@ -0,0 +1,58 @@
+package reverseproxy
+
+import (
+	"net"
+	"time"
+)
+
+// Access describes a connection routed, or rejected, by a Sniffer.
+type Access struct {
+	Time        time.Time
+	Port        uint16
+	Remote      net.Addr
+	ServiceName string
+	Path        string
+
+	// Fingerprint holds the fingerprint of the ClientHello of a TLS
+	// connection, and is nil for other connections.
+	Fingerprint *Fingerprint
+
+	// Err holds the reason the connection was rejected, and is nil for
+	// connections passed to a service.
+	Err error
+}
+
+// AccessLog is called for each connection routed by a Sniffer.
+type AccessLog func(Access)
+
+var accessLog AccessLog
+
+// SetAccessLog sets the function called for each connection routed, on all
+// ports. A nil AccessLog disables logging.
+//
+// The AccessLog is called synchronously, so it should not block.
+func SetAccessLog(a AccessLog) {
+	lMu.Lock()
+	accessLog = a
+	lMu.Unlock()
+}
+
+func (l *listener) logAccess(c net.Conn, name, path string, fp *Fingerprint, err error) {
+	lMu.RLock()
+	a := accessLog
+	lMu.RUnlock()
+
+	if a == nil {
+		return
+	}
+
+	a(Access{
+		Time:        time.Now(),
+		Port:        l.port,
+		Remote:      c.RemoteAddr(),
+		ServiceName: name,
+		Path:        path,
+		Fingerprint: fp,
+		Err:         err,
+	})
+}
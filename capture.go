@@ -0,0 +1,282 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CaptureRecordType identifies the contents of a record in a capture file.
+type CaptureRecordType uint8
+
+// Capture record types.
+const (
+	// CaptureConnection is the first record of a capture, and holds the
+	// remote address of the client.
+	CaptureConnection CaptureRecordType = iota
+
+	// CaptureClient holds data sent from the client to the server.
+	CaptureClient
+
+	// CaptureServer holds data sent from the server to the client.
+	CaptureServer
+
+	// CaptureTruncated marks that the byte limit of the capture was reached
+	// and no further data was recorded.
+	CaptureTruncated
+)
+
+const (
+	captureMagic        = "RPCAP\x00\x00\x01"
+	captureHeaderLength = 13
+	captureExtension    = ".rpcap"
+)
+
+// Capture records the connections passed to a redirect, as set with
+// Port.SetCapture, writing each connection to its own file in a directory.
+//
+// Each capture file begins with the eight byte magic string "RPCAP\0\0\1",
+// followed by a series of records, each of which is made up of a one byte
+// CaptureRecordType, an eight byte big endian timestamp, in nanoseconds since
+// the Unix epoch, a four byte big endian payload length, and the payload.
+//
+// The first record is always a CaptureConnection record, and the data records
+// follow in the order they were read. TLS connections that are not terminated
+// by the proxy are recorded as ciphertext.
+type Capture struct {
+	dir      string
+	maxConns uint
+	maxBytes uint64
+
+	mu    sync.Mutex
+	conns uint
+}
+
+// NewCapture creates a Capture that writes up to maxConns connections to the
+// given directory, recording at most maxBytes of data from each, or all of it
+// when maxBytes is zero.
+func NewCapture(dir string, maxConns uint, maxBytes uint64) *Capture {
+	return &Capture{
+		dir:      dir,
+		maxConns: maxConns,
+		maxBytes: maxBytes,
+	}
+}
+
+// Captured returns the number of connections that have been captured.
+func (c *Capture) Captured() uint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conns
+}
+
+// Done returns whether the connection limit has been reached.
+func (c *Capture) Done() bool {
+	return c.Captured() >= c.maxConns
+}
+
+// captureService is implemented by services whose connections can be captured.
+type captureService interface {
+	setCapture(*Capture)
+}
+
+// SetCapture starts capturing the connections to the Port, replacing any
+// existing Capture. A nil Capture stops capturing.
+//
+// Only redirects can be captured, and requests forwarded individually with
+// SetHTTPRouting are not.
+func (p *Port) SetCapture(c *Capture) error {
+	cs, ok := p.service.(captureService)
+	if !ok {
+		return ErrCaptureUnsupported
+	}
+
+	cs.setCapture(c)
+
+	return nil
+}
+
+func (a *addrService) setCapture(c *Capture) {
+	a.capture.Store(c)
+}
+
+// wrap returns connections that record the data read from the client and
+// server, or the originals if the capture is complete or cannot be written.
+func (c *Capture) wrap(buf []byte, client, server net.Conn) (net.Conn, net.Conn) {
+	c.mu.Lock()
+
+	if c.conns >= c.maxConns {
+		c.mu.Unlock()
+
+		return client, server
+	}
+
+	c.conns++
+	n := c.conns
+
+	c.mu.Unlock()
+
+	now := time.Now()
+
+	f, err := os.Create(filepath.Join(c.dir, fmt.Sprintf("%d-%d%s", now.Unix(), n, captureExtension)))
+	if err != nil {
+		return client, server
+	}
+
+	cf := &captureFile{
+		f:        f,
+		w:        bufio.NewWriter(f),
+		maxBytes: c.maxBytes,
+	}
+
+	cf.refs.Store(2)
+	cf.w.WriteString(captureMagic)
+	cf.record(CaptureConnection, []byte(client.RemoteAddr().String()))
+	cf.record(CaptureClient, buf)
+
+	return &captureConn{Conn: client, file: cf, typ: CaptureClient}, &captureConn{Conn: server, file: cf, typ: CaptureServer}
+}
+
+type captureFile struct {
+	refs atomic.Int32
+
+	mu        sync.Mutex
+	f         *os.File
+	w         *bufio.Writer
+	written   uint64
+	maxBytes  uint64
+	truncated bool
+}
+
+func (c *captureFile) record(typ CaptureRecordType, data []byte) {
+	if len(data) == 0 && typ != CaptureConnection {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.truncated {
+		return
+	}
+
+	if typ != CaptureConnection {
+		if c.maxBytes > 0 && c.written+uint64(len(data)) > c.maxBytes {
+			c.truncated = true
+			typ = CaptureTruncated
+			data = nil
+		} else {
+			c.written += uint64(len(data))
+		}
+	}
+
+	var header [captureHeaderLength]byte
+
+	header[0] = byte(typ)
+
+	binary.BigEndian.PutUint64(header[1:9], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(header[9:], uint32(len(data)))
+
+	c.w.Write(header[:])
+	c.w.Write(data)
+	c.w.Flush()
+}
+
+func (c *captureFile) done() {
+	if c.refs.Add(-1) == 0 {
+		c.mu.Lock()
+		c.w.Flush()
+		c.f.Close()
+		c.mu.Unlock()
+	}
+}
+
+type captureConn struct {
+	net.Conn
+	file *captureFile
+	typ  CaptureRecordType
+	once sync.Once
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+
+	c.file.record(c.typ, p[:n])
+
+	return n, err
+}
+
+func (c *captureConn) Close() error {
+	c.once.Do(c.file.done)
+
+	return c.Conn.Close()
+}
+
+// CaptureRecord is a single record read from a capture file.
+type CaptureRecord struct {
+	Type CaptureRecordType
+	Time time.Time
+	Data []byte
+}
+
+// CaptureReader reads the records of a capture file.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader checks the magic string of a capture file and returns a
+// CaptureReader for its records.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+
+	var magic [len(captureMagic)]byte
+
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, err
+	} else if string(magic[:]) != captureMagic {
+		return nil, ErrInvalidCapture
+	}
+
+	return &CaptureReader{r: br}, nil
+}
+
+// Next reads the next record, returning io.EOF when there are no more.
+func (c *CaptureReader) Next() (CaptureRecord, error) {
+	var header [captureHeaderLength]byte
+
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return CaptureRecord{}, err
+	}
+
+	typ := CaptureRecordType(header[0])
+	if typ > CaptureTruncated {
+		return CaptureRecord{}, ErrInvalidCapture
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header[9:]))
+
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return CaptureRecord{}, io.ErrUnexpectedEOF
+	}
+
+	return CaptureRecord{
+		Type: typ,
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9]))),
+		Data: data,
+	}, nil
+}
+
+// Errors.
+var (
+	ErrCaptureUnsupported = errors.New("service cannot be captured")
+	ErrInvalidCapture     = errors.New("invalid capture")
+)
@@ -0,0 +1,193 @@
+package reverseproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	echo, err := net.ResolveTCPAddr("tcp", listenTest(t, echoConn).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, echo)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	const (
+		req  = "GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"
+		more = "0123456789"
+	)
+
+	dir := t.TempDir()
+	c := NewCapture(dir, 1, uint64(2*len(req)+len(more)-1))
+
+	if err := p.SetCapture(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for n := range 2 {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		conn.Write([]byte(req))
+
+		buf := make([]byte, len(req))
+
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		conn.Write([]byte(more))
+
+		buf = make([]byte, len(more))
+
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		conn.Close()
+	}
+
+	if n := c.Captured(); n != 1 {
+		t.Errorf("test 3: expecting 1 captured connection, got %d", n)
+	} else if !c.Done() {
+		t.Errorf("test 3: expecting capture to be done")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+captureExtension))
+	if len(files) != 1 {
+		t.Fatalf("test 4: expecting 1 capture file, got %d", len(files))
+	}
+
+	var records []CaptureRecord
+
+	for range 50 {
+		if records = readCapture(t, files[0]); len(records) > 0 && records[len(records)-1].Type == CaptureTruncated {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(records) != 4 {
+		t.Fatalf("test 5: expecting 4 records, got %d", len(records))
+	}
+
+	for n, expected := range [...]CaptureRecord{
+		{Type: CaptureConnection},
+		{Type: CaptureClient, Data: []byte(req)},
+		{Type: CaptureServer, Data: []byte(req)},
+		{Type: CaptureTruncated},
+	} {
+		if r := records[n]; r.Type != expected.Type {
+			t.Errorf("test %d: expecting type %d, got %d", n+6, expected.Type, r.Type)
+		} else if n > 0 && string(r.Data) != string(expected.Data) {
+			t.Errorf("test %d: expecting data %q, got %q", n+6, expected.Data, r.Data)
+		}
+	}
+}
+
+func TestCaptureUnlimited(t *testing.T) {
+	echo, err := net.ResolveTCPAddr("tcp", listenTest(t, echoConn).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, echo)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	const req = "GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"
+
+	dir := t.TempDir()
+
+	if err := p.SetCapture(NewCapture(dir, 1, 0)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	conn.Write([]byte(req))
+
+	if _, err := io.ReadFull(conn, make([]byte, len(req))); err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	conn.Close()
+
+	var records []CaptureRecord
+
+	for range 50 {
+		if files, _ := filepath.Glob(filepath.Join(dir, "*"+captureExtension)); len(files) == 1 {
+			if records = readCapture(t, files[0]); len(records) >= 3 {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(records) != 3 {
+		t.Fatalf("test 2: expecting 3 records, got %d", len(records))
+	}
+
+	for n, typ := range [...]CaptureRecordType{CaptureConnection, CaptureClient, CaptureServer} {
+		if r := records[n]; r.Type != typ {
+			t.Errorf("test %d: expecting type %d, got %d", n+3, typ, r.Type)
+		} else if n > 0 && string(r.Data) != req {
+			t.Errorf("test %d: expecting data %q, got %q", n+3, req, r.Data)
+		}
+	}
+}
+
+func readCapture(t *testing.T, file string) []CaptureRecord {
+	t.Helper()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer f.Close()
+
+	cr, err := NewCaptureReader(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var records []CaptureRecord
+
+	for {
+		r, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			return records
+		} else if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		records = append(records, r)
+	}
+}
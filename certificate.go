@@ -0,0 +1,101 @@
+package reverseproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+)
+
+// ProvideCertificates sets the function used to answer certificate requests
+// from a command started with RegisterCmd, allowing the command to use
+// certificates obtained or loaded by the proxy.
+//
+// Requests are only answered for server names the command would be sent TLS
+// connections for.
+func ProvideCertificates(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) Option {
+	return func(o *options) {
+		o.getCertificate = getCertificate
+	}
+}
+
+// PushCertificate sends a certificate for the given server name to the
+// command, replacing any it currently holds; this allows renewed certificates
+// to be delivered without waiting for the command to request them.
+func (u *UnixCmd) PushCertificate(serverName string, cert *tls.Certificate) error {
+	u.mu.Lock()
+	closed := u.closed
+	u.mu.Unlock()
+
+	if closed {
+		return ErrClosed
+	}
+
+	return u.writeCertificate(serverName, cert, nil)
+}
+
+func (u *UnixCmd) certificateRequest(msn MatchServiceName, o *options, serverName string) {
+	var (
+		cert *tls.Certificate
+		err  error
+	)
+
+	if o.getCertificate == nil {
+		err = ErrNoCertificates
+	} else if serverName == "" || !msn.MatchService(serverName) {
+		err = ErrUnmatchedServerName
+	} else {
+		cert, err = o.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	}
+
+	u.writeCertificate(serverName, cert, err)
+}
+
+func (u *UnixCmd) writeCertificate(serverName string, cert *tls.Certificate, err error) error {
+	if len(serverName) > 255 {
+		return ErrUnmatchedServerName
+	}
+
+	msg := append(make([]byte, 0, 4+len(serverName)), 0, 0, controlCertificate, byte(len(serverName)))
+	msg = append(msg, serverName...)
+
+	if err == nil {
+		var data []byte
+
+		if data, err = appendCertificate(msg, cert); err == nil {
+			msg = data
+		}
+	}
+
+	if err != nil {
+		msg[2] = controlCertificateError
+		msg = append(msg, err.Error()...)
+	}
+
+	_, _, err = u.conn.WriteMsgUnix(msg, nil, nil)
+
+	return err
+}
+
+func appendCertificate(buf []byte, cert *tls.Certificate) ([]byte, error) {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil, ErrNoCertificates
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cert.Certificate {
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+
+	return append(buf, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...), nil
+}
+
+// Errors.
+var (
+	ErrNoCertificates      = errors.New("no certificates available")
+	ErrUnmatchedServerName = errors.New("server name not matched by command")
+)
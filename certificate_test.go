@@ -0,0 +1,98 @@
+package reverseproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestCertificateRequest(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var conns [2]*net.UnixConn
+
+	for n, fd := range fds {
+		f := os.NewFile(uintptr(fd), "")
+		c, err := net.FileConn(f)
+
+		f.Close()
+
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		conns[n] = c.(*net.UnixConn)
+
+		defer c.Close()
+	}
+
+	cert := testCertificate(t, aDomain)
+	u := &UnixCmd{conn: conns[0]}
+	o := makeOptions([]Option{ProvideCertificates(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &cert, nil
+	})})
+	buf := make([]byte, 4096)
+
+	u.certificateRequest(HostName(aDomain), &o, aDomain)
+
+	n, _, _, _, err := conns[1].ReadMsgUnix(buf, nil)
+	if err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	header := append([]byte{0, 0, controlCertificate, byte(len(aDomain))}, aDomain...)
+
+	if n < len(header) || string(buf[:len(header)]) != string(header) {
+		t.Fatalf("test 1: expecting header %q, got %q", header, buf[:n])
+	}
+
+	if pair, err := tls.X509KeyPair(buf[len(header):n], buf[len(header):n]); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(pair.Certificate[0]) != string(cert.Certificate[0]) {
+		t.Errorf("test 1: received certificate does not match")
+	}
+
+	u.certificateRequest(HostName(aDomain), &o, bDomain)
+
+	n, _, _, _, err = conns[1].ReadMsgUnix(buf, nil)
+	if err != nil {
+		t.Fatalf("test 2: unexpected error: %s", err)
+	}
+
+	if expected := "\x00\x00\x02" + string(rune(len(bDomain))) + bDomain + ErrUnmatchedServerName.Error(); string(buf[:n]) != expected {
+		t.Errorf("test 2: expecting message %q, got %q", expected, buf[:n])
+	}
+
+	if err := u.PushCertificate(aDomain, &cert); err != nil {
+		t.Fatalf("test 3: unexpected error: %s", err)
+	}
+
+	n, _, _, _, err = conns[1].ReadMsgUnix(buf, nil)
+	if err != nil {
+		t.Fatalf("test 3: unexpected error: %s", err)
+	} else if n < len(header) || string(buf[:len(header)]) != string(header) {
+		t.Errorf("test 3: expecting header %q, got %q", header, buf[:n])
+	}
+
+	if err := u.PushCertificate(aDomain, &cert); err != nil {
+		t.Fatalf("test 4: unexpected error: %s", err)
+	} else if err := u.PushCertificate(aDomain, &cert); err != nil {
+		t.Fatalf("test 4: unexpected error: %s", err)
+	}
+
+	for n := range 2 {
+		m, _, _, _, err := conns[1].ReadMsgUnix(buf, nil)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+4, err)
+		} else if m < len(header) || string(buf[:len(header)]) != string(header) {
+			t.Errorf("test %d: expecting header %q, got %q", n+4, header, buf[:m])
+		} else if _, err := tls.X509KeyPair(buf[len(header):m], buf[len(header):m]); err != nil {
+			t.Errorf("test %d: expecting a single whole certificate, got error: %s", n+4, err)
+		}
+	}
+}
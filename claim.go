@@ -0,0 +1,50 @@
+package reverseproxy
+
+import (
+	"net"
+	"slices"
+)
+
+// ClaimPorts sets the given ports, or every port when none are given, to be
+// claimed whole by the service, which is passed each connection as soon as it
+// is accepted, without anything being read from the client.
+//
+// This allows protocols where the server speaks first, such as SMTP and SSH,
+// and any others that are neither TLS nor HTTP, to be forwarded. A claimed
+// port cannot be shared, so the service cannot be added to a port that already
+// has services, and no others can be added while it is claimed.
+func ClaimPorts(ports ...uint16) Option {
+	return func(o *options) {
+		if len(ports) == 0 {
+			o.claimAll = true
+		} else {
+			o.claimPorts = append(o.claimPorts, ports...)
+		}
+	}
+}
+
+func (o *options) claims(port uint16) bool {
+	return o.claimAll || slices.Contains(o.claimPorts, port)
+}
+
+// AddForward sets a port to be forwarded whole to an external service, with no
+// server name being read from connections.
+func AddForward(port uint16, to net.Addr, opts ...Option) (*Port, error) {
+	o := makeOptions(opts)
+
+	return addPort(port, &addrService{
+		MatchServiceName: Hosts{},
+		Addr:             to,
+		tlsConfig:        upstreamConfig(o.upstreamTLS, to),
+		dialer:           o.dialer,
+		mirror:           o.newMirror(),
+	}, append(opts, ClaimPorts())...)
+}
+
+// claimedPort returns the Port that has claimed the listener, if any.
+func (l *listener) claimedPort() *Port {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.claimed
+}
@@ -0,0 +1,73 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestClaimPorts(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			c.Write([]byte("220 ready\r\n"))
+			c.Close()
+		}
+	}()
+
+	pa := getUnusedPort()
+
+	p, err := AddForward(pa, l.Addr())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	if banner, err := io.ReadAll(c); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(banner) != "220 ready\r\n" {
+		t.Errorf("test 1: expecting banner %q, got %q", "220 ready\r\n", banner)
+	}
+
+	c.Close()
+
+	if _, err := AddRedirect(HostName(aDomain), pa, l.Addr()); err != ErrPortClaimed {
+		t.Errorf("test 2: expecting error %v, got %v", ErrPortClaimed, err)
+	}
+
+	p.Close()
+
+	q, err := addPort(pa, testServiceA{make(testService)})
+	if err != nil {
+		t.Fatalf("test 3: unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	if _, err := AddForward(pa, l.Addr()); err != ErrPortClaimed {
+		t.Errorf("test 4: expecting error %v, got %v", ErrPortClaimed, err)
+	}
+
+	r, err := addPort(pa, testServiceB{make(testService)}, ClaimPorts(pa+1))
+	if err != nil {
+		t.Fatalf("test 5: unexpected error: %s", err)
+	}
+
+	r.Close()
+}
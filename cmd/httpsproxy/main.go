@@ -12,9 +12,9 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"sync"
 
-	"golang.org/x/crypto/acme/autocert"
 	"vimagination.zapto.org/reverseproxy/unixconn"
 )
 
@@ -45,6 +45,18 @@ func (s *serverNames) Set(serverName string) error {
 	return nil
 }
 
+// GetCertificate retrieves the certificate for a whitelisted server name from
+// the reverse proxy.
+func (s serverNames) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !slices.Contains(s, hello.ServerName) {
+		return nil, errUnknownServerName
+	}
+
+	return unixconn.GetCertificate(hello)
+}
+
+var errUnknownServerName = errors.New("unknown server name")
+
 func copyConn(a io.Writer, b io.Reader) {
 	io.Copy(a, b)
 	wg.Done()
@@ -114,6 +126,10 @@ func proxySSL(l net.Listener) {
 	}
 }
 
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusFound)
+}
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %s", err)
@@ -139,12 +155,6 @@ func run() error {
 		return errors.New("need proxy address")
 	}
 
-	leManager := &autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		Cache:      autocert.DirCache("./certcache/"),
-		HostPolicy: autocert.HostWhitelist(sNames...),
-	}
-
 	l, err := unixconn.Listen("tcp", ":80")
 	if err != nil {
 		return errors.New("unable to open port 80")
@@ -155,10 +165,10 @@ func run() error {
 		return errors.New("unable to open port 443")
 	}
 
-	server.Handler = leManager.HTTPHandler(nil)
+	server.Handler = http.HandlerFunc(redirectHTTPS)
 
 	go proxySSL(tls.NewListener(sl, &tls.Config{
-		GetCertificate: leManager.GetCertificate,
+		GetCertificate: sNames.GetCertificate,
 		NextProtos:     []string{"http/1.1"},
 	}))
 
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"vimagination.zapto.org/reverseproxy"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var (
+		addr    string
+		timing  bool
+		verbose bool
+		wait    time.Duration
+	)
+
+	flag.StringVar(&addr, "a", "", "backend address")
+	flag.BoolVar(&timing, "t", false, "preserve the timing between client records")
+	flag.BoolVar(&verbose, "v", false, "write backend responses to stdout")
+	flag.DurationVar(&wait, "w", 5*time.Second, "time to wait for the backend to finish responding")
+	flag.Parse()
+
+	if addr == "" {
+		return errors.New("no backend address specified")
+	} else if flag.NArg() == 0 {
+		return errors.New("no capture files specified")
+	}
+
+	var out io.Writer = io.Discard
+
+	if verbose {
+		out = os.Stdout
+	}
+
+	for _, file := range flag.Args() {
+		if err := replay(file, addr, timing, wait, out); err != nil {
+			return fmt.Errorf("error replaying %s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+func replay(file, addr string, timing bool, wait time.Duration, out io.Writer) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	cr, err := reverseproxy.NewCaptureReader(f)
+	if err != nil {
+		return err
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := io.Copy(out, c)
+		done <- err
+	}()
+
+	var last time.Time
+
+	for {
+		r, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if r.Type != reverseproxy.CaptureClient {
+			continue
+		}
+
+		if timing && !last.IsZero() {
+			time.Sleep(r.Time.Sub(last))
+		}
+
+		last = r.Time
+
+		if _, err := c.Write(r.Data); err != nil {
+			return err
+		}
+	}
+
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(wait):
+		return nil
+	}
+}
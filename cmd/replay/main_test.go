@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/reverseproxy"
+)
+
+const (
+	testDomain = "example.com"
+	testDelay  = 200 * time.Millisecond
+)
+
+func listen(t *testing.T, handler func(net.Conn)) *net.TCPListener {
+	t.Helper()
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go handler(c)
+		}
+	}()
+
+	return l
+}
+
+func echo(c net.Conn) {
+	io.Copy(c, c)
+	c.Close()
+}
+
+// capture records a connection, writing the data testDelay apart, to a
+// redirect with an unlimited Capture, returning the capture file.
+func capture(t *testing.T, data ...string) string {
+	t.Helper()
+
+	backend := listen(t, echo)
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+
+	l.Close()
+
+	p, err := reverseproxy.AddRedirect(reverseproxy.HostName(testDomain), port, backend.Addr())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	dir := t.TempDir()
+
+	if err := p.SetCapture(reverseproxy.NewCapture(dir, 1, 0)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var total int
+
+	for n, d := range data {
+		total += len(d)
+
+		if n > 0 {
+			time.Sleep(testDelay)
+		}
+
+		c.Write([]byte(d))
+
+		if _, err := io.ReadFull(c, make([]byte, len(d))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	c.Close()
+
+	for range 200 {
+		if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) == 1 && clientBytes(t, files[0]) == total {
+			return files[0]
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("capture not written")
+
+	return ""
+}
+
+func clientBytes(t *testing.T, file string) int {
+	t.Helper()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer f.Close()
+
+	cr, err := reverseproxy.NewCaptureReader(f)
+	if err != nil {
+		return 0
+	}
+
+	var n int
+
+	for {
+		r, err := cr.Next()
+		if err != nil {
+			return n
+		} else if r.Type == reverseproxy.CaptureClient {
+			n += len(r.Data)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nHost: " + testDomain + "\r\n\r\n"
+	body := string(bytes.Repeat([]byte("0123456789"), 10000))
+	file := capture(t, req, body)
+	received := make(chan string, 1)
+	backend := listen(t, func(c net.Conn) {
+		data, _ := io.ReadAll(c)
+
+		received <- string(data)
+
+		c.Write(data)
+		c.Close()
+	})
+
+	for n, timing := range [...]bool{false, true} {
+		var out bytes.Buffer
+
+		start := time.Now()
+
+		if err := replay(file, backend.Addr().String(), timing, time.Second, &out); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		elapsed := time.Since(start)
+
+		if data := <-received; data != req+body {
+			t.Errorf("test %d: expecting backend to receive %d bytes, got %d", n+1, len(req+body), len(data))
+		} else if out.String() != data {
+			t.Errorf("test %d: expecting response of %d bytes, got %d", n+1, len(data), out.Len())
+		}
+
+		if timing && elapsed < testDelay {
+			t.Errorf("test %d: expecting replay to take at least %s, took %s", n+1, testDelay, elapsed)
+		} else if !timing && elapsed >= testDelay {
+			t.Errorf("test %d: expecting replay to take less than %s, took %s", n+1, testDelay, elapsed)
+		}
+	}
+}
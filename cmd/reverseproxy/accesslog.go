@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"vimagination.zapto.org/reverseproxy"
+)
+
+const accessLogQueue = 1024
+
+// startAccessLog appends a line for each connection to the file, each holding
+// the tab separated time, port, client address, service name, path, JA3 and
+// JA4 fingerprints, and error, with a '-' for any empty field and any tabs or
+// other special characters quoted.
+//
+// Entries are written in the background, and are dropped should the writer
+// fall behind.
+func startAccessLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening access log: %w", err)
+	}
+
+	entries := make(chan reverseproxy.Access, accessLogQueue)
+
+	go writeAccessLog(f, entries)
+
+	reverseproxy.SetAccessLog(func(a reverseproxy.Access) {
+		select {
+		case entries <- a:
+		default:
+		}
+	})
+
+	return nil
+}
+
+func writeAccessLog(f io.Writer, entries chan reverseproxy.Access) {
+	w := bufio.NewWriter(f)
+
+	for a := range entries {
+		var ja3, ja4, errStr string
+
+		if a.Fingerprint != nil {
+			ja3 = a.Fingerprint.JA3
+			ja4 = a.Fingerprint.JA4
+		}
+
+		if a.Err != nil {
+			errStr = a.Err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", a.Time.Format(time.RFC3339), a.Port, logField(a.Remote.String()), logField(a.ServiceName), logField(a.Path), logField(ja3), logField(ja4), logField(errStr))
+
+		if len(entries) == 0 {
+			w.Flush()
+		}
+	}
+}
+
+func logField(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	q := strconv.Quote(s)
+
+	return q[1 : len(q)-1]
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"vimagination.zapto.org/reverseproxy"
+)
+
+const (
+	certCheckInterval = 12 * time.Hour
+	acmeChallengePath = "/.well-known/acme-challenge/"
+)
+
+type acmeConfig struct {
+	Directory string `json:"directory"`
+	Email     string `json:"email"`
+	CacheDir  string `json:"cacheDir"`
+	CACert    string `json:"caCert"`
+	HTTPPort  uint16 `json:"httpPort"`
+}
+
+type certStatus struct {
+	Server string `json:"server"`
+	Expiry int64  `json:"expiry"`
+	Err    string `json:"err,omitempty"`
+}
+
+type certManager struct {
+	manager   *autocert.Manager
+	listener  net.Listener
+	challenge *reverseproxy.Port
+	check     chan struct{}
+	done      chan struct{}
+
+	mu     sync.RWMutex
+	hosts  map[string]string
+	status map[string]certStatus
+}
+
+var certs certManager
+
+// Init starts the certificate manager, which obtains and renews certificates
+// for the hostnames of all servers, and answers HTTP-01 challenges on the
+// configured HTTP port.
+//
+// TLS-ALPN-01 challenges are answered by any service terminating TLS using
+// the managed certificates.
+func (c *certManager) Init(ac *acmeConfig, s servers) error {
+	c.hosts = make(map[string]string)
+	c.status = make(map[string]certStatus)
+
+	c.setHosts(s)
+
+	if ac == nil {
+		return nil
+	}
+
+	client := &acme.Client{DirectoryURL: ac.Directory}
+
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	if ac.CACert != "" {
+		pem, err := os.ReadFile(ac.CACert)
+		if err != nil {
+			return fmt.Errorf("error reading ACME CA certificate: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return ErrInvalidCACert
+		}
+
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+
+	cacheDir := ac.CacheDir
+	if cacheDir == "" {
+		cacheDir = "certcache"
+	}
+
+	httpPort := ac.HTTPPort
+	if httpPort == 0 {
+		httpPort = 80
+	}
+
+	c.manager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: c.hostPolicy,
+		Client:     client,
+		Email:      ac.Email,
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return fmt.Errorf("error opening ACME challenge listener: %w", err)
+	}
+
+	c.challenge, err = reverseproxy.AddRedirect(reverseproxy.PathPrefix{Host: c, Prefix: acmeChallengePath}, httpPort, l.Addr())
+	if err != nil {
+		l.Close()
+
+		return fmt.Errorf("error registering ACME challenge port: %w", err)
+	}
+
+	c.listener = l
+	c.check = make(chan struct{}, 1)
+	c.done = make(chan struct{})
+
+	go http.Serve(l, c.manager.HTTPHandler(http.NotFoundHandler()))
+	go c.run()
+
+	return nil
+}
+
+// setHosts updates the list of managed hostnames; config.mu must be held.
+//
+// A hostname listed by more than one server, which can only come from an
+// edited config file, is assigned to the first of those servers by name.
+func (c *certManager) setHosts(s servers) {
+	hosts := make(map[string]string)
+
+	for _, name := range slices.Sorted(maps.Keys(s)) {
+		for _, host := range s[name].Hostnames {
+			if _, ok := hosts[host]; !ok {
+				hosts[host] = name
+			}
+		}
+	}
+
+	c.mu.Lock()
+
+	c.hosts = hosts
+
+	for host, status := range c.status {
+		if server, ok := hosts[host]; !ok {
+			delete(c.status, host)
+		} else {
+			status.Server = server
+			c.status[host] = status
+		}
+	}
+
+	for host, server := range hosts {
+		if _, ok := c.status[host]; !ok {
+			c.status[host] = certStatus{Server: server}
+		}
+	}
+
+	c.mu.Unlock()
+
+	c.checkNow()
+}
+
+// checkHostnames ensures that none of the hostnames are repeated or already
+// managed for a server other than the named one; config.mu must be held.
+func checkHostnames(s servers, server string, hostnames []string) error {
+	seen := make(map[string]struct{}, len(hostnames))
+
+	for _, host := range hostnames {
+		if _, ok := seen[host]; ok {
+			return fmt.Errorf("%w: %s", ErrDuplicateHostname, host)
+		}
+
+		seen[host] = struct{}{}
+	}
+
+	for name, serv := range s {
+		if name == server {
+			continue
+		}
+
+		for _, host := range serv.Hostnames {
+			if _, ok := seen[host]; ok {
+				return fmt.Errorf("%w: %s (%s)", ErrDuplicateHostname, host, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// MatchService implements the reverseproxy.MatchServiceName interface,
+// matching all managed hostnames.
+func (c *certManager) MatchService(serviceName string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.hosts[serviceName]
+
+	return ok
+}
+
+func (c *certManager) hostPolicy(_ context.Context, host string) error {
+	if !c.MatchService(host) {
+		return ErrUnmanagedHost
+	}
+
+	return nil
+}
+
+func (c *certManager) checkNow() {
+	if c.check != nil {
+		select {
+		case c.check <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *certManager) run() {
+	t := time.NewTicker(certCheckInterval)
+
+	defer t.Stop()
+
+	for {
+		c.obtainAll()
+
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		case <-c.check:
+		}
+	}
+}
+
+// obtainAll retrieves the certificate for each managed hostname, obtaining it
+// from the ACME server if needed, which also schedules its renewal.
+func (c *certManager) obtainAll() {
+	c.mu.RLock()
+
+	hosts := make([]string, 0, len(c.hosts))
+
+	for host := range c.hosts {
+		hosts = append(hosts, host)
+	}
+
+	c.mu.RUnlock()
+
+	for _, host := range hosts {
+		var status certStatus
+
+		cert, err := c.getCertificate(host)
+		if err != nil {
+			status.Err = err.Error()
+		} else if cert.Leaf != nil {
+			status.Expiry = cert.Leaf.NotAfter.Unix()
+		}
+
+		c.mu.Lock()
+
+		server, ok := c.hosts[host]
+		if ok {
+			status.Server = server
+
+			if c.status[host] == status {
+				ok = false
+			} else {
+				c.status[host] = status
+			}
+		}
+
+		c.mu.Unlock()
+
+		if ok {
+			data, _ := json.Marshal(struct {
+				Host string `json:"host"`
+				certStatus
+			}{host, status})
+
+			broadcast(broadcastCertificate, data, 0)
+
+			if err == nil {
+				pushCertificate(server, host, cert)
+			}
+		}
+	}
+}
+
+// pushCertificate sends a new or renewed certificate to the running commands
+// of the server.
+func pushCertificate(server, host string, cert *tls.Certificate) {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	if s, ok := config.Servers[server]; ok {
+		for _, c := range s.Commands {
+			if c.unixCmd != nil && c.matchServiceName.MatchService(host) {
+				c.unixCmd.PushCertificate(host, cert)
+			}
+		}
+	}
+}
+
+func (c *certManager) getCertificate(host string) (*tls.Certificate, error) {
+	return c.manager.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:       host,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	})
+}
+
+// GetCertificate answers the certificate requests of commands with the managed
+// certificates.
+func (c *certManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c.manager == nil {
+		return nil, ErrNoACME
+	}
+
+	if !c.MatchService(hello.ServerName) {
+		return nil, ErrUnmanagedHost
+	}
+
+	return c.getCertificate(hello.ServerName)
+}
+
+// tlsConfig returns a config for terminating TLS with the managed
+// certificates, which also answers TLS-ALPN-01 challenges.
+func (c *certManager) tlsConfig() (*tls.Config, error) {
+	if c.manager == nil {
+		return nil, ErrNoACME
+	}
+
+	return c.manager.TLSConfig(), nil
+}
+
+func (c *certManager) getStatus() map[string]certStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	status := make(map[string]certStatus, len(c.status))
+
+	for host, s := range c.status {
+		status[host] = s
+	}
+
+	return status
+}
+
+func (c *certManager) Shutdown() {
+	if c.manager != nil {
+		close(c.done)
+		c.challenge.Close()
+		c.listener.Close()
+	}
+}
+
+var (
+	ErrInvalidCACert     = errors.New("invalid ACME CA certificate")
+	ErrUnmanagedHost     = errors.New("hostname not managed")
+	ErrNoACME            = errors.New("ACME not configured")
+	ErrDuplicateHostname = errors.New("hostname already managed")
+)
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCA is a minimal ACME server, which validates HTTP-01 challenges by
+// requesting them through the reverse proxy.
+//
+// The first certificate it issues is already due for renewal.
+type testCA struct {
+	*httptest.Server
+	httpPort uint16
+	key      *ecdsa.PrivateKey
+	cert     *x509.Certificate
+
+	mu     sync.Mutex
+	nonce  int
+	orders []*testOrder
+	issued int
+}
+
+type testOrder struct {
+	host, token   string
+	valid, failed bool
+	cert          []byte
+}
+
+func newTestCA(t *testing.T, httpPort uint16) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ca := &testCA{httpPort: httpPort, key: key}
+
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /dir", ca.directory)
+	mux.HandleFunc("/nonce", func(http.ResponseWriter, *http.Request) {})
+	mux.HandleFunc("POST /account", ca.account)
+	mux.HandleFunc("POST /order", ca.newOrder)
+	mux.HandleFunc("POST /order/{id}", ca.order)
+	mux.HandleFunc("POST /authz/{id}", ca.authz)
+	mux.HandleFunc("POST /chal/{id}", ca.challenge)
+	mux.HandleFunc("POST /finalize/{id}", ca.finalize)
+	mux.HandleFunc("POST /cert/{id}", ca.certificate)
+
+	ca.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ca.mu.Lock()
+		ca.nonce++
+		w.Header().Set("Replay-Nonce", strconv.Itoa(ca.nonce))
+		ca.mu.Unlock()
+
+		mux.ServeHTTP(w, r)
+	}))
+
+	t.Cleanup(ca.Close)
+
+	return ca
+}
+
+func (ca *testCA) reply(w http.ResponseWriter, code int, location string, v any) {
+	if location != "" {
+		w.Header().Set("Location", ca.URL+location)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ca *testCA) getOrder(r *http.Request) *testOrder {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 0 || id >= len(ca.orders) {
+		return nil
+	}
+
+	return ca.orders[id]
+}
+
+func (ca *testCA) orderJSON(id string, o *testOrder) any {
+	status := "pending"
+
+	if o.cert != nil {
+		status = "valid"
+	} else if o.valid {
+		status = "ready"
+	} else if o.failed {
+		status = "invalid"
+	}
+
+	v := map[string]any{
+		"status":         status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.host}},
+		"authorizations": []string{ca.URL + "/authz/" + id},
+		"finalize":       ca.URL + "/finalize/" + id,
+	}
+
+	if o.cert != nil {
+		v["certificate"] = ca.URL + "/cert/" + id
+	}
+
+	return v
+}
+
+func jwsPayload(r *http.Request) []byte {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+
+	json.NewDecoder(r.Body).Decode(&jws)
+
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	return payload
+}
+
+func (ca *testCA) directory(w http.ResponseWriter, _ *http.Request) {
+	ca.reply(w, http.StatusOK, "", map[string]string{
+		"newNonce":   ca.URL + "/nonce",
+		"newAccount": ca.URL + "/account",
+		"newOrder":   ca.URL + "/order",
+		"revokeCert": ca.URL + "/revoke",
+		"keyChange":  ca.URL + "/key",
+	})
+}
+
+func (ca *testCA) account(w http.ResponseWriter, _ *http.Request) {
+	ca.reply(w, http.StatusCreated, "/account/1", map[string]string{"status": "valid"})
+}
+
+func (ca *testCA) newOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifiers []struct {
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+
+	if err := json.Unmarshal(jwsPayload(r), &req); err != nil || len(req.Identifiers) != 1 {
+		http.Error(w, "bad order", http.StatusBadRequest)
+
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	id := strconv.Itoa(len(ca.orders))
+	o := &testOrder{host: req.Identifiers[0].Value, token: "token" + id}
+	ca.orders = append(ca.orders, o)
+
+	ca.reply(w, http.StatusCreated, "/order/"+id, ca.orderJSON(id, o))
+}
+
+func (ca *testCA) order(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if o := ca.getOrder(r); o != nil {
+		ca.reply(w, http.StatusOK, "", ca.orderJSON(r.PathValue("id"), o))
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *testCA) challengeJSON(id string, o *testOrder) any {
+	status := "pending"
+
+	if o.valid {
+		status = "valid"
+	} else if o.failed {
+		status = "invalid"
+	}
+
+	return map[string]string{
+		"type":   "http-01",
+		"url":    ca.URL + "/chal/" + id,
+		"token":  o.token,
+		"status": status,
+	}
+}
+
+func (ca *testCA) authz(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	o := ca.getOrder(r)
+	if o == nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	chal := ca.challengeJSON(r.PathValue("id"), o)
+
+	ca.reply(w, http.StatusOK, "", map[string]any{
+		"status":     chal.(map[string]string)["status"],
+		"identifier": map[string]string{"type": "dns", "value": o.host},
+		"challenges": []any{chal},
+	})
+}
+
+// challenge validates the HTTP-01 challenge by requesting the token from the
+// HTTP port of the reverse proxy.
+func (ca *testCA) challenge(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	o := ca.getOrder(r)
+	ca.mu.Unlock()
+
+	if o == nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	valid := false
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d%s%s", ca.httpPort, acmeChallengePath, o.token), nil)
+	req.Host = o.host
+
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		body, _ := io.ReadAll(resp.Body)
+
+		resp.Body.Close()
+
+		valid = resp.StatusCode == http.StatusOK && strings.HasPrefix(string(body), o.token+".")
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	o.valid = valid
+	o.failed = !valid
+
+	ca.reply(w, http.StatusOK, "", ca.challengeJSON(r.PathValue("id"), o))
+}
+
+func (ca *testCA) finalize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+
+	json.Unmarshal(jwsPayload(r), &req)
+
+	der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		http.Error(w, "bad csr", http.StatusBadRequest)
+
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	o := ca.getOrder(r)
+	if o == nil || !o.valid {
+		http.Error(w, "order not ready", http.StatusForbidden)
+
+		return
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(ca.issued + 2)),
+		Subject:      pkix.Name{CommonName: o.host},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ca.issued == 0 {
+		tmpl.NotBefore = now.Add(-2 * time.Hour)
+		tmpl.NotAfter = now.Add(30 * time.Minute)
+	}
+
+	leaf, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	ca.issued++
+	o.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+
+	ca.reply(w, http.StatusOK, "/order/"+r.PathValue("id"), ca.orderJSON(r.PathValue("id"), o))
+}
+
+func (ca *testCA) certificate(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	o := ca.getOrder(r)
+	if o == nil || o.cert == nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(o.cert)
+}
+
+func (ca *testCA) issuedCount() int {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	return ca.issued
+}
+
+func waitFor(t *testing.T, test string, fn func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(10 * time.Second); !fn(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: timed out", test)
+		}
+	}
+}
+
+func TestCertManager(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	httpPort := uint16(l.Addr().(*net.TCPAddr).Port)
+
+	l.Close()
+
+	ca := newTestCA(t, httpPort)
+	serv := testConfig(t)
+	serv.Hostnames = []string{"acme.example"}
+
+	var c certManager
+
+	if err := c.Init(&acmeConfig{Directory: ca.URL + "/dir", CacheDir: t.TempDir(), HTTPPort: httpPort}, config.Servers); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer c.Shutdown()
+
+	waitFor(t, "test 1", func() bool { return ca.issuedCount() >= 2 })
+
+	renewed := time.Now().Add(30 * 24 * time.Hour).Unix()
+
+	waitFor(t, "test 2", func() bool {
+		c.checkNow()
+
+		status := c.getStatus()["acme.example"]
+
+		return status.Err == "" && status.Expiry > renewed
+	})
+
+	if status := c.getStatus()["acme.example"]; status.Server != "test" {
+		t.Errorf("test 3: expecting server %q, got %q", "test", status.Server)
+	}
+
+	if cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: "acme.example"}); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if cert.Leaf == nil || cert.Leaf.NotAfter.Unix() <= renewed {
+		t.Errorf("test 4: expecting renewed certificate")
+	}
+
+	if _, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example"}); !errors.Is(err, ErrUnmanagedHost) {
+		t.Errorf("test 5: expecting error %v, got %v", ErrUnmanagedHost, err)
+	}
+}
+
+func TestSetHosts(t *testing.T) {
+	var c certManager
+
+	c.Init(nil, servers{
+		"b": &server{Hostnames: []string{"shared.example", "b.example"}},
+		"a": &server{Hostnames: []string{"shared.example"}},
+		"c": &server{Hostnames: []string{"shared.example"}},
+	})
+
+	status := c.getStatus()
+
+	for n, test := range [...]struct {
+		Host, Server string
+	}{
+		{"shared.example", "a"},
+		{"b.example", "b"},
+	} {
+		if s := status[test.Host].Server; s != test.Server {
+			t.Errorf("test %d: expecting host %q to belong to server %q, got %q", n+1, test.Host, test.Server, s)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"vimagination.zapto.org/reverseproxy"
+)
+
+// echKey holds a marshalled ECHConfig and its HPKE private key, both of which
+// are base64 encoded in the config file.
+type echKey struct {
+	Config     []byte `json:"config"`
+	PrivateKey []byte `json:"privateKey"`
+}
+
+func setECHKeys(port uint16, keys []echKey) error {
+	tlsKeys := make([]tls.EncryptedClientHelloKey, len(keys))
+
+	for n, k := range keys {
+		tlsKeys[n] = tls.EncryptedClientHelloKey{
+			Config:     k.Config,
+			PrivateKey: k.PrivateKey,
+		}
+	}
+
+	return reverseproxy.SetECHKeys(port, tlsKeys...)
+}
+
+// echConfigs returns the ECHConfigs of the keys, without the private keys.
+func echConfigs(keys []echKey) [][]byte {
+	configs := make([][]byte, len(keys))
+
+	for n, k := range keys {
+		configs[n] = k.Config
+	}
+
+	return configs
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"vimagination.zapto.org/reverseproxy"
+)
+
+type errorPages map[uint16]string
+
+func (e errorPages) Init() error {
+	for port, tmpl := range e {
+		if err := setErrorPage(port, tmpl); err != nil {
+			return fmt.Errorf("error setting error page for port %d: %w", port, err)
+		}
+	}
+
+	return nil
+}
+
+type errorPageData struct {
+	Code        int
+	Status      string
+	ServiceName string
+}
+
+func setErrorPage(port uint16, tmpl string) error {
+	if tmpl == "" {
+		reverseproxy.SetErrorPage(port, nil)
+
+		return nil
+	}
+
+	t, err := template.New("").Parse(tmpl)
+	if err != nil {
+		return err
+	}
+
+	reverseproxy.SetErrorPage(port, func(code int, serviceName string) []byte {
+		var buf bytes.Buffer
+
+		if err := t.Execute(&buf, errorPageData{
+			Code:        code,
+			Status:      http.StatusText(code),
+			ServiceName: serviceName,
+		}); err != nil {
+			return reverseproxy.DefaultErrorPage(code, serviceName)
+		}
+
+		return buf.Bytes()
+	})
+
+	return nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestErrorPagesInit(t *testing.T) {
+	defer setErrorPage(1, "")
+
+	if err := (errorPages{1: "{{.Code}}"}).Init(); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	}
+
+	if err := (errorPages{1: "{{.Code"}).Init(); err == nil {
+		t.Error("test 2: expecting error for invalid template")
+	}
+}
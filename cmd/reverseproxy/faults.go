@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"vimagination.zapto.org/reverseproxy"
+)
+
+const defaultFaultDuration = 5 * time.Minute
+
+type faults struct {
+	Latency          uint    `json:"latency"`
+	Bandwidth        uint64  `json:"bandwidth"`
+	ResetRate        float64 `json:"resetRate"`
+	ResetAfter       uint64  `json:"resetAfter"`
+	RefuseRate       float64 `json:"refuseRate"`
+	CorruptFirstByte bool    `json:"corruptFirstByte"`
+	Duration         uint    `json:"duration,omitempty"`
+	Expires          int64   `json:"expires,omitempty"`
+}
+
+// faults converts the settings, with latency in milliseconds and duration in
+// seconds, to the Faults to apply, returning nil when no faults are set.
+func (f *faults) faults() (*reverseproxy.Faults, error) {
+	if f.ResetRate < 0 || f.ResetRate > 1 || f.RefuseRate < 0 || f.RefuseRate > 1 {
+		return nil, ErrInvalidFaults
+	} else if f.Latency == 0 && f.Bandwidth == 0 && f.ResetRate == 0 && f.RefuseRate == 0 && !f.CorruptFirstByte {
+		return nil, nil
+	}
+
+	duration := time.Duration(f.Duration) * time.Second
+
+	if duration == 0 {
+		duration = defaultFaultDuration
+	}
+
+	return &reverseproxy.Faults{
+		Latency:          time.Duration(f.Latency) * time.Millisecond,
+		Bandwidth:        f.Bandwidth,
+		ResetRate:        f.ResetRate,
+		ResetAfter:       f.ResetAfter,
+		RefuseRate:       f.RefuseRate,
+		CorruptFirstByte: f.CorruptFirstByte,
+		Expires:          time.Now().Add(duration),
+	}, nil
+}
+
+func faultsData(f *reverseproxy.Faults) *faults {
+	if f == nil || time.Now().After(f.Expires) {
+		return nil
+	}
+
+	return &faults{
+		Latency:          uint(f.Latency / time.Millisecond),
+		Bandwidth:        f.Bandwidth,
+		ResetRate:        f.ResetRate,
+		ResetAfter:       f.ResetAfter,
+		RefuseRate:       f.RefuseRate,
+		CorruptFirstByte: f.CorruptFirstByte,
+		Expires:          f.Expires.Unix(),
+	}
+}
+
+// setFaults sets the faults of the redirect or command, which are kept to be
+// applied again should it be restarted before they expire.
+func (t *serviceTarget) setFaults(f *reverseproxy.Faults) error {
+	serv, ok := config.Servers[t.Server]
+	if !ok {
+		return ErrNoServer
+	}
+
+	if t.Redirect != 0 && t.Command != 0 {
+		return ErrInvalidTarget
+	} else if t.Redirect != 0 {
+		r, ok := serv.Redirects[t.Redirect]
+		if !ok {
+			return ErrUnknownRedirect
+		}
+
+		r.faults = f
+
+		if r.port != nil {
+			r.port.SetFaults(f)
+		}
+	} else {
+		c, ok := serv.Commands[t.Command]
+		if !ok {
+			return ErrUnknownCommand
+		}
+
+		c.faults = f
+
+		if c.unixCmd != nil {
+			c.unixCmd.SetFaults(f)
+		}
+	}
+
+	return nil
+}
+
+func (t *serviceTarget) getFaults() (*reverseproxy.Faults, error) {
+	serv, ok := config.Servers[t.Server]
+	if !ok {
+		return nil, ErrNoServer
+	}
+
+	if t.Redirect != 0 && t.Command != 0 {
+		return nil, ErrInvalidTarget
+	} else if t.Redirect != 0 {
+		r, ok := serv.Redirects[t.Redirect]
+		if !ok {
+			return nil, ErrUnknownRedirect
+		}
+
+		return r.faults, nil
+	}
+
+	c, ok := serv.Commands[t.Command]
+	if !ok {
+		return nil, ErrUnknownCommand
+	}
+
+	return c.faults, nil
+}
+
+var ErrInvalidFaults = errors.New("invalid faults")
@@ -2,7 +2,7 @@ import type {RPC as RPCType} from './types.js';
 import {WS} from './lib/conn.js';
 import {RPC} from './lib/rpc.js';
 
-const broadcastList = -1, broadcastAdd = -2, broadcastRename = -3, broadcastRemove = -4, broadcastAddRedirect = -5, broadcastAddCommand = -6, broadcastModifyRedirect = -7, broadcastModifyCommand = -8, broadcastRemoveRedirect = -9, broadcastRemoveCommand = -10, broadcastStartRedirect = -11, broadcastStartCommand = -12, broadcastStopRedirect = -13, broadcastStopCommand = -14, broadcastCommandStopped = -15, broadcastCommandError = -16;
+const broadcastList = -1, broadcastAdd = -2, broadcastRename = -3, broadcastRemove = -4, broadcastAddRedirect = -5, broadcastAddCommand = -6, broadcastModifyRedirect = -7, broadcastModifyCommand = -8, broadcastRemoveRedirect = -9, broadcastRemoveCommand = -10, broadcastStartRedirect = -11, broadcastStartCommand = -12, broadcastStopRedirect = -13, broadcastStopCommand = -14, broadcastCommandStopped = -15, broadcastCommandError = -16, broadcastSetErrorPage = -17, broadcastSetHTTPRouting = -18, broadcastCertificate = -19, broadcastSetHostnames = -20, broadcastSetSplit = -21, broadcastSetDenylist = -22, broadcastSetECHKeys = -23, broadcastSetConnectTunnel = -24;
 
 export const rpc = {} as Readonly<RPCType>;
 
@@ -10,22 +10,30 @@ export default (url: string) => WS(url).then(ws => {
 	const arpc = new RPC(ws);
 	Object.freeze(Object.assign(rpc, Object.fromEntries([
 		([
-			["waitList",           broadcastList],
-			["waitAdd",            broadcastAdd],
-			["waitRename",         broadcastRename],
-			["waitRemove",         broadcastRemove],
-			["waitAddRedirect",    broadcastAddRedirect],
-			["waitAddCommand",     broadcastAddCommand],
-			["waitModifyRedirect", broadcastModifyRedirect],
-			["waitModifyCommand",  broadcastModifyCommand],
-			["waitRemoveRedirect", broadcastRemoveRedirect],
-			["waitRemoveCommand",  broadcastRemoveCommand],
-			["waitStartRedirect",  broadcastStartRedirect],
-			["waitStartCommand",   broadcastStartCommand],
-			["waitStopRedirect",   broadcastStopRedirect],
-			["waitStopCommand",    broadcastStopCommand],
-			["waitCommandStopped", broadcastCommandStopped],
-			["waitCommandError",   broadcastCommandError]
+			["waitList",             broadcastList],
+			["waitAdd",              broadcastAdd],
+			["waitRename",           broadcastRename],
+			["waitRemove",           broadcastRemove],
+			["waitAddRedirect",      broadcastAddRedirect],
+			["waitAddCommand",       broadcastAddCommand],
+			["waitModifyRedirect",   broadcastModifyRedirect],
+			["waitModifyCommand",    broadcastModifyCommand],
+			["waitRemoveRedirect",   broadcastRemoveRedirect],
+			["waitRemoveCommand",    broadcastRemoveCommand],
+			["waitStartRedirect",    broadcastStartRedirect],
+			["waitStartCommand",     broadcastStartCommand],
+			["waitStopRedirect",     broadcastStopRedirect],
+			["waitStopCommand",      broadcastStopCommand],
+			["waitCommandStopped",   broadcastCommandStopped],
+			["waitCommandError",     broadcastCommandError],
+			["waitSetErrorPage",     broadcastSetErrorPage],
+			["waitSetHTTPRouting",   broadcastSetHTTPRouting],
+			["waitCertificate",      broadcastCertificate],
+			["waitSetHostnames",     broadcastSetHostnames],
+			["waitSetSplit",         broadcastSetSplit],
+			["waitSetDenylist",      broadcastSetDenylist],
+			["waitSetECHKeys",       broadcastSetECHKeys],
+			["waitSetConnectTunnel", broadcastSetConnectTunnel]
 		] as [string, number][]).map(([wait, id]) => [wait, () => arpc.subscribe(id)]),
 		[
 			"add",
@@ -41,7 +49,29 @@ export default (url: string) => WS(url).then(ws => {
 			"startCommand",
 			"stopRedirect",
 			"stopCommand",
-			"getCommandPorts"
+			"getCommandPorts",
+			"getRedirectError",
+			"getBackends",
+			"getCapture",
+			"setCapture",
+			"getRejections",
+			"getFaults",
+			"setFaults",
+			"getErrorPages",
+			"setErrorPage",
+			"getHTTPRouting",
+			"setHTTPRouting",
+			"getConnectTunnels",
+			"setConnectTunnel",
+			"getDenylists",
+			"setDenylist",
+			"getECHKeys",
+			"setECHKeys",
+			"getCertificates",
+			"getHostnames",
+			"setHostnames",
+			"getSplits",
+			"setSplit"
 		].map(ep => [ep, arpc.request.bind(arpc, ep)])
 	].flat()) as RPCType))
 });
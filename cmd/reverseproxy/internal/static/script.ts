@@ -1,8 +1,8 @@
 import type {PropsObject} from './lib/dom.js';
 import type {WindowElement} from './lib/windows.js';
-import type {ListItem, Match, MatchData, Uint, UserID} from './types.js';
+import type {CertificateStatus, ListItem, Match, MatchData, Uint, UserID} from './types.js';
 import {amendNode, clearNode} from './lib/dom.js';
-import {br, button, div, h1, img, input, label, li, span, table, tbody, td, th, thead, tr, ul} from './lib/html.js';
+import {br, button, div, h1, h2, img, input, label, li, span, table, tbody, td, th, thead, tr, ul} from './lib/html.js';
 import pageLoad from './lib/load.js';
 import {NodeArray, NodeMap, node, stringSort} from './lib/nodes.js';
 import {circle, g, line, path, polyline, rect, svg, svgData, symbol, title, use} from './lib/svg.js';
@@ -12,7 +12,12 @@ import RPC, {rpc} from './rpc.js';
 let nextID = 0;
 
 const rcSort = (a: Redirect | Command, b: Redirect | Command) => a.id - b.id,
-      matchData2Match = (md: MatchData[]) => md.map(([isSuffix, name]) => ({isSuffix, name})),
+      matchData2Match = (md: MatchData[]) => md.map(([isSuffix, name, path, ja3, ja4]) => ({isSuffix, name, "path": path || undefined, "ja3": ja3 ?? undefined, "ja4": ja4 ?? undefined})),
+      splitList = (list: string) => {
+	const l = list.split(",").map(s => s.trim()).filter(s => s);
+	return l.length ? l : undefined;
+      },
+      invalidMatch = (matches: Match[]) => matches.some(({path, ja3, ja4}) => path && (ja3?.length || ja4?.length)),
       shell = shellElement(),
       addLabel = (name: string, input: HTMLInputElement): [HTMLLabelElement, HTMLInputElement] => {
 	const id = "ID_" + nextID++;
@@ -69,6 +74,38 @@ const rcSort = (a: Redirect | Command, b: Redirect | Command) => a.id - b.id,
 	      rect({"x": 42, "y": 45, "width": 16, "height": 40, "rx": 8, "fill": "#fff"}),
 	      circle({"cx": 50, "cy": 30, "r": 8, "fill": "#fff"})
       ])),
+      [hostnames, hostnamesIcon] = addSymbol(symbol({"viewBox": "0 0 100 100"}, [
+	path({"d": "M30,45 v-15 a20,20 0,0,1 40,0 v15", "stroke": "#000", "stroke-width": 10, "fill": "none"}),
+	rect({"x": 15, "y": 45, "width": 70, "height": 50, "rx": 5, "fill": "#000"})
+      ])),
+      editHostnames = (server: Server) => rpc.getHostnames().then(all => {
+	const names = new NodeArray(div(), (all[server.name] ?? []).map(h => ({[node]: input({"value": h})}))),
+	      w = windows({"window-title": "Certificate Hostnames", "window-icon": hostnamesIcon}, [
+		label("Hostnames:"),
+		names,
+		button({"onclick": () => {
+			if (names.length > 0) {
+				names.pop();
+			}
+		}}, "-"),
+		button({"onclick": () => names.push({[node]: input()})}, "+"),
+		br(),
+		button({"onclick": function(this: HTMLButtonElement) {
+			amendNode(this, {"disabled": true});
+			rpc.setHostnames({
+				"server": server.name,
+				"hostnames": names.map(n => n[node].value).filter(h => h)
+			})
+			.then(() => {
+				w.remove();
+				loadCertificates();
+			})
+			.catch(err => w.alert("Error", err.message, hostnamesIcon))
+			.finally(() => amendNode(this, {"disabled": false}));
+		}}, "Set Hostnames")
+	      ]);
+	shell.addWindow(w);
+      }).catch(err => shell.alert("Error getting hostnames", err.message, hostnamesIcon)),
       editRedirect = (server: Server, data?: Redirect) => {
 	const icon = data ? editIcon : addRedirectIcon,
 	      from = input({"type": "number", "min": 1, "max": 65535, "value": data?.from ?? 80}),
@@ -89,6 +126,8 @@ const rcSort = (a: Redirect | Command, b: Redirect | Command) => a.id - b.id,
 				w.alert("Invalid address", `Invalid to address: ${to.value}`, icon);
 			} else if (matches.list.some(({name}) => name === "")) {
 				w.alert("Invalid Match", "Cannot have empty match", icon);
+			} else if (invalidMatch(matches.list)) {
+				w.alert("Invalid Match", "Cannot match both a path and fingerprints", icon);
 			} else {
 				amendNode(this, {"disabled": true});
 				(data ?
@@ -160,6 +199,8 @@ const rcSort = (a: Redirect | Command, b: Redirect | Command) => a.id - b.id,
 				w.alert("Invalid executable", "Executable cannot be empty", icon);
 			} else if (matches.list.some(({name}) => name === "")) {
 				w.alert("Invalid Match", "Cannot have empty match", icon);
+			} else if (invalidMatch(matches.list)) {
+				w.alert("Invalid Match", "Cannot match both a path and fingerprints", icon);
 			} else if (u < 0 || u > maxID) {
 				w.alert("Invalid UID", `UID must be in range 0 < uid < ${maxID}`, icon);
 			} else if (g < 0 || g > maxID) {
@@ -202,6 +243,13 @@ const rcSort = (a: Redirect | Command, b: Redirect | Command) => a.id - b.id,
 	]));
       },
       servers = new NodeMap<string, Server, HTMLUListElement>(ul(), (a: Server, b: Server) => stringSort(a.name, b.name)),
+      certificates = new NodeMap<string, Certificate, HTMLUListElement>(ul(), (a: Certificate, b: Certificate) => stringSort(a.host, b.host)),
+      loadCertificates = () => rpc.getCertificates().then(certs => {
+	certificates.clear();
+	for (const [host, status] of Object.entries(certs)) {
+		certificates.set(host, new Certificate(host, status));
+	}
+      }),
       statusColours = ["#f00", "#0f0", "#f80"];
 
 class MatchMaker {
@@ -222,6 +270,9 @@ class MatchMaker {
 				thead(tr([
 					th("Matches"),
 					th("Is Suffix?"),
+					th("Path Prefix"),
+					th("JA3 Fingerprints"),
+					th("JA4 Fingerprints"),
 					th(img({"src": removeIcon, "style": {"width": "1em", "height": "1em"}}))
 				])),
 				this.#u
@@ -235,6 +286,9 @@ class MatchMaker {
 		const l = tr([
 			td(input({"onchange": function(this: HTMLInputElement){m.name = this.value}, "value": m.name})),
 			td(input({"type": "checkbox", "onchange": function(this: HTMLInputElement){m.isSuffix = this.checked}, "checked": m.isSuffix})),
+			td(input({"onchange": function(this: HTMLInputElement){m.path = this.value || undefined}, "value": m.path ?? ""})),
+			td(input({"onchange": function(this: HTMLInputElement){m.ja3 = splitList(this.value)}, "value": m.ja3?.join(", ") ?? ""})),
+			td(input({"onchange": function(this: HTMLInputElement){m.ja4 = splitList(this.value)}, "value": m.ja4?.join(", ") ?? ""})),
 			td(remove({"title": "Remove Match", "onclick": () => {
 				if (this.list.length === 1) {
 					this.#w.alert("Cannot remove Match", "Must have at least 1 Match", removeIcon);
@@ -338,6 +392,13 @@ class Redirect {
 			" ➔ ",
 			this.#toSpan,
 			this.#startStop,
+			info({"title": "Redirect Information", "onclick": () => Promise.all([rpc.getRedirectError({"server": server.name, id}), rpc.getBackends({"server": server.name, id})]).then(([err, backends]) => shell.addWindow(windows({"window-title": "Redirect Information", "window-icon": infoIcon}, [
+				div(`Error: ${err}`),
+				backends.length ? [
+					div("Backends:"),
+					ul(backends.map(b => li(b)))
+				] : []
+			]))).catch(e => shell.alert("Error getting information", e.message, infoIcon))}),
 			edit({"title": "Edit Redirect", "onclick": () => editRedirect(server, this)}),
 			remove({"title": "Remove Redirect", "onclick": () => shell.confirm("Are you sure?", "Are you sure you wish to remove this redirect?", removeIcon).then(c => {
 				if (c) {
@@ -453,6 +514,7 @@ class Server {
 				this.#nameSpan,
 				addRedirect({"title": "Add Redirect", "onclick": () => editRedirect(this)}),
 				addCommand({"title": "Add Command", "onclick": () => editCommand(this)}),
+				hostnames({"title": "Certificate Hostnames", "onclick": () => editHostnames(this)}),
 				rename({"title": "Rename Server", "onclick": () => shell.prompt("New Name", "Plese enter a new name for this server", this.name, renameIcon).then(name => {
 					if (name && name !== this.name) {
 						rpc.rename([this.name, name]).catch(err => shell.alert("Error", err.message, renameIcon));
@@ -476,6 +538,23 @@ class Server {
 	}
 }
 
+class Certificate {
+	host: string;
+	[node]: HTMLLIElement;
+	constructor(host: string, status: CertificateStatus) {
+		this.host = host;
+		this[node] = li();
+		this.update(status);
+	}
+	update({server, expiry, err}: CertificateStatus) {
+		clearNode(this[node], [
+			span(this.host),
+			span(` (${server}): `),
+			span(err ? `Error: ${err}` : expiry ? `Expires ${new Date(expiry * 1000).toLocaleString()}` : "Pending")
+		]);
+	}
+}
+
 pageLoad.then(() => RPC("/socket").then(() => rpc.waitList().when(list => {
 	for (const s of list) {
 		servers.set(s[0], new Server(s));
@@ -488,8 +567,22 @@ pageLoad.then(() => RPC("/socket").then(() => rpc.waitList().when(list => {
 				rpc.add(name).catch(err => shell.alert("Error", err, addServerIcon)).then(() => servers.set(name, new Server([name, [], []])));
 			}
 		})}),
-		servers
+		servers,
+		h2("Certificates"),
+		certificates
 	])));
+	loadCertificates();
+	rpc.waitCertificate().when(c => {
+		const cert = certificates.get(c.host);
+		if (cert) {
+			cert.update(c);
+		} else {
+			certificates.set(c.host, new Certificate(c.host, c));
+		}
+	});
+	rpc.waitSetHostnames().when(loadCertificates);
+	rpc.waitRename().when(loadCertificates);
+	rpc.waitRemove().when(loadCertificates);
 	rpc.waitAdd().when(name => servers.set(name, new Server([name, [], []])));
 	rpc.waitRename().when(([oldName, newName]) => servers.get(oldName)?.setName(newName));
 	rpc.waitRemove().when(name => servers.delete(name));
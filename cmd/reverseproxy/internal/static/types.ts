@@ -2,7 +2,7 @@ import type {Subscription} from './lib/inter.js';
 
 export type Uint = number;
 
-export type MatchData = [boolean, string];
+export type MatchData = [boolean, string] | [boolean, string, string] | [boolean, string, string, string[] | null, string[] | null];
 
 export type ListItem = [string, [Uint, Uint, string, boolean, string, ...MatchData[]][], [Uint, string, string[], string, Record<string, string>, Uint, string, UserID | null, ...MatchData[]][]];
 
@@ -11,12 +11,26 @@ type List = ListItem[];
 export type Match = {
 	isSuffix: boolean;
 	name:     string;
+	path?:    string;
+	ja3?:     string[];
+	ja4?:     string[];
 }
 
 type Redirect = NameID & {
-	from:   Uint;
-	to:     string;
-	match:  Match[];
+	from:        Uint;
+	to:          string;
+	match:       Match[];
+	forward?:    Forward;
+	rewrite?:    Rewrite;
+	tls?:        TLSKeys;
+	upstream?:   Upstream;
+	dialer?:     Dialer;
+	discovery?:  Discovery;
+	mirror?:     string;
+	tlsPolicy?:  TLSPolicy;
+	echBackend?: boolean;
+	quic?:       boolean;
+	claim?:      boolean;
 }
 
 export type UserID = {
@@ -25,12 +39,184 @@ export type UserID = {
 }
 
 type Command = NameID & {
-	exe:     string;
-	params:  string[];
-	workDir: string;
-	env:     Record<string, string>;
-	match:   Match[];
-	user?:   UserID;
+	exe:         string;
+	params:      string[];
+	workDir:     string;
+	env:         Record<string, string>;
+	match:       Match[];
+	user?:       UserID;
+	forward?:    Forward;
+	tls?:        TLSKeys;
+	tlsPolicy?:  TLSPolicy;
+	echBackend?: boolean;
+	claimPorts?: Uint[];
+}
+
+type TLSKeys = {
+	acme: boolean;
+	cert: string;
+	key:  string;
+}
+
+type Upstream = {
+	serverName:         string;
+	caCert:             string;
+	cert:               string;
+	key:                string;
+	minVersion:         "" | "1.0" | "1.1" | "1.2" | "1.3";
+	insecureSkipVerify: boolean;
+}
+
+type Discovery = {
+	type:    "srv" | "file";
+	service: string;
+	proto:   string;
+	name:    string;
+	path:    string;
+	refresh: Uint;
+}
+
+type Dialer = {
+	type:     "" | "socks5" | "http";
+	proxy:    string;
+	username: string;
+	password: string;
+	timeout:  Uint;
+	bind:     string;
+}
+
+type Forward = {
+	headers: Uint;
+	trusted: string[];
+}
+
+type Rewrite = {
+	host:          string;
+	stripPrefix:   string;
+	addPrefix:     string;
+	setHeaders:    Header[];
+	removeHeaders: string[];
+}
+
+type Header = {
+	name:  string;
+	value: string;
+}
+
+type ErrorPage = {
+	port:     Uint;
+	template: string;
+}
+
+type HTTPRouting = {
+	port:    Uint;
+	enabled: boolean;
+}
+
+type ConnectTunnel = {
+	port:    Uint;
+	enabled: boolean;
+	users:   Record<string, string>;
+}
+
+type ConnectTunnelUsers = {
+	port:    Uint;
+	enabled: boolean;
+	users:   string[];
+}
+
+type Denylist = {
+	port:         Uint;
+	fingerprints: string[];
+}
+
+type ECHKey = {
+	config:     string;
+	privateKey: string;
+}
+
+type SetECHKeys = {
+	port: Uint;
+	keys: ECHKey[];
+}
+
+type ECHConfigs = {
+	port:    Uint;
+	configs: string[];
+}
+
+export type CertificateStatus = {
+	server:  string;
+	expiry:  Uint;
+	err?:    string;
+}
+
+type Certificate = CertificateStatus & {
+	host: string;
+}
+
+type SplitMember = {
+	redirect?: Uint;
+	command?:  Uint;
+}
+
+type Split = {
+	members: SplitMember[];
+	weights: Uint[];
+	pin:     boolean;
+}
+
+type SetSplit = Split & {
+	server: string;
+	name:   string;
+}
+
+type Capture = {
+	connections: Uint;
+	bytes:       Uint;
+	captured:    Uint;
+}
+
+type SetCapture = NameID & {
+	connections: Uint;
+	bytes:       Uint;
+}
+
+type TLSPolicy = {
+	minVersion: string;
+	requireSNI: boolean;
+	alpn:       string[];
+}
+
+type TLSRejections = {
+	version: Uint;
+	sni:     Uint;
+	alpn:    Uint;
+}
+
+type ServiceTarget = {
+	server:    string;
+	redirect?: Uint;
+	command?:  Uint;
+}
+
+type Faults = {
+	latency:          Uint;
+	bandwidth:        Uint;
+	resetRate:        number;
+	resetAfter:       Uint;
+	refuseRate:       number;
+	corruptFirstByte: boolean;
+	expires?:         Uint;
+}
+
+type SetFaults = ServiceTarget & Faults & {
+	duration?: Uint;
+}
+
+type Hostnames = {
+	server:    string;
+	hostnames: string[];
 }
 
 type NameID = {
@@ -39,35 +225,65 @@ type NameID = {
 }
 
 export type RPC = {
-	waitList:           () => Subscription<List>;
-	waitAdd:            () => Subscription<string>;
-	waitRename:         () => Subscription<[string, string]>;
-	waitRemove:         () => Subscription<string>;
-	waitAddRedirect:    () => Subscription<Redirect>;
-	waitAddCommand:     () => Subscription<Command>;
-	waitModifyRedirect: () => Subscription<Redirect>;
-	waitModifyCommand:  () => Subscription<Command>;
-	waitRemoveRedirect: () => Subscription<NameID>;
-	waitRemoveCommand:  () => Subscription<NameID>;
-	waitStartRedirect:  () => Subscription<NameID>;
-	waitStartCommand:   () => Subscription<NameID>;
-	waitStopRedirect:   () => Subscription<NameID>;
-	waitStopCommand:    () => Subscription<NameID>;
-	waitCommandStopped: () => Subscription<[string, Uint]>;
-	waitCommandError:   () => Subscription<NameID & {err: string}>;
-
-	add:             (name: string)                          => Promise<void>;
-	rename:          (data: [string, string])                => Promise<void>;
-	remove:          (name: string)                          => Promise<void>;
-	addRedirect:     (data: Omit<Redirect, "id">)            => Promise<Uint>;
-	addCommand:      (data: Omit<Command, "id">)             => Promise<Uint>;
-	modifyRedirect:  (data: Redirect)                        => Promise<void>;
-	modifyCommand:   (data: Command)                         => Promise<void>;
-	removeRedirect:  (redirect: NameID)                      => Promise<void>;
-	removeCommand:   (command: NameID)                       => Promise<void>;
-	startRedirect:   (redirect: NameID)                      => Promise<void>;
-	startCommand:    (command: NameID)                       => Promise<void>;
-	stopRedirect:    (redirect: NameID)                      => Promise<void>;
-	stopCommand:     (command: NameID)                       => Promise<void>;
-	getCommandPorts: (command: NameID)                       => Promise<Uint[]>;
+	waitList:             () => Subscription<List>;
+	waitAdd:              () => Subscription<string>;
+	waitRename:           () => Subscription<[string, string]>;
+	waitRemove:           () => Subscription<string>;
+	waitAddRedirect:      () => Subscription<Redirect>;
+	waitAddCommand:       () => Subscription<Command>;
+	waitModifyRedirect:   () => Subscription<Redirect>;
+	waitModifyCommand:    () => Subscription<Command>;
+	waitRemoveRedirect:   () => Subscription<NameID>;
+	waitRemoveCommand:    () => Subscription<NameID>;
+	waitStartRedirect:    () => Subscription<NameID>;
+	waitStartCommand:     () => Subscription<NameID>;
+	waitStopRedirect:     () => Subscription<NameID>;
+	waitStopCommand:      () => Subscription<NameID>;
+	waitCommandStopped:   () => Subscription<[string, Uint]>;
+	waitCommandError:     () => Subscription<NameID & {err: string}>;
+	waitSetErrorPage:     () => Subscription<ErrorPage>;
+	waitSetHTTPRouting:   () => Subscription<HTTPRouting>;
+	waitCertificate:      () => Subscription<Certificate>;
+	waitSetHostnames:     () => Subscription<Hostnames>;
+	waitSetSplit:         () => Subscription<SetSplit>;
+	waitSetDenylist:      () => Subscription<Denylist>;
+	waitSetECHKeys:       () => Subscription<ECHConfigs>;
+	waitSetConnectTunnel: () => Subscription<ConnectTunnelUsers>;
+
+	add:               (name: string)                          => Promise<void>;
+	rename:            (data: [string, string])                => Promise<void>;
+	remove:            (name: string)                          => Promise<void>;
+	addRedirect:       (data: Omit<Redirect, "id">)            => Promise<Uint>;
+	addCommand:        (data: Omit<Command, "id">)             => Promise<Uint>;
+	modifyRedirect:    (data: Redirect)                        => Promise<void>;
+	modifyCommand:     (data: Command)                         => Promise<void>;
+	removeRedirect:    (redirect: NameID)                      => Promise<void>;
+	removeCommand:     (command: NameID)                       => Promise<void>;
+	startRedirect:     (redirect: NameID)                      => Promise<void>;
+	startCommand:      (command: NameID)                       => Promise<void>;
+	stopRedirect:      (redirect: NameID)                      => Promise<void>;
+	stopCommand:       (command: NameID)                       => Promise<void>;
+	getCommandPorts:   (command: NameID)                       => Promise<Uint[]>;
+	getRedirectError:  (redirect: NameID)                      => Promise<string>;
+	getBackends:       (redirect: NameID)                      => Promise<string[]>;
+	getCapture:        (redirect: NameID)                      => Promise<Capture>;
+	setCapture:        (redirect: SetCapture)                  => Promise<Capture>;
+	getRejections:     (target: ServiceTarget)                 => Promise<TLSRejections>;
+	getFaults:         (target: ServiceTarget)                 => Promise<Faults | null>;
+	setFaults:         (faults: SetFaults)                     => Promise<Faults | null>;
+	getErrorPages:     ()                                      => Promise<Record<Uint, string>>;
+	setErrorPage:      (errorPage: ErrorPage)                  => Promise<void>;
+	getHTTPRouting:    ()                                      => Promise<Uint[]>;
+	setHTTPRouting:    (httpRouting: HTTPRouting)              => Promise<void>;
+	getConnectTunnels: ()                                      => Promise<Record<Uint, string[]>>;
+	setConnectTunnel:  (tunnel: ConnectTunnel)                 => Promise<void>;
+	getDenylists:      ()                                      => Promise<Record<Uint, string[]>>;
+	setDenylist:       (denylist: Denylist)                    => Promise<void>;
+	getECHKeys:        ()                                      => Promise<Record<Uint, string[]>>;
+	setECHKeys:        (keys: SetECHKeys)                      => Promise<void>;
+	getCertificates:   ()                                      => Promise<Record<string, CertificateStatus>>;
+	getHostnames:      ()                                      => Promise<Record<string, string[]>>;
+	setHostnames:      (hostnames: Hostnames)                  => Promise<void>;
+	getSplits:         (server: string)                        => Promise<Record<string, Split>>;
+	setSplit:          (split: SetSplit)                       => Promise<void>;
 }
@@ -15,6 +15,7 @@ import (
 	"sync"
 
 	"golang.org/x/net/websocket"
+	"vimagination.zapto.org/reverseproxy"
 )
 
 type hash [sha256.Size]byte
@@ -73,6 +74,7 @@ func (h *hash) UnmarshalJSON(data []byte) error {
 
 var (
 	configFile string
+	captureDir string
 	config     Config
 )
 
@@ -81,12 +83,21 @@ type Config struct {
 	Username string
 	Password hash
 
-	mu      sync.RWMutex
-	Servers servers
+	mu             sync.RWMutex
+	Servers        servers
+	ErrorPages     errorPages
+	HTTPRouting    map[uint16]bool
+	ConnectTunnels map[uint16]map[string]string
+	Denylists      map[uint16][]string
+	ECHKeys        map[uint16][]echKey
+	ACME           *acmeConfig
 }
 
+// saveConfig writes the config file, which is only readable by its owner as it
+// holds secrets, such as the ECH keys and the proxy and CONNECT tunnel
+// passwords, which are stored in plaintext as they must be given as is.
 func saveConfig() error {
-	f, err := os.Create(configFile)
+	f, err := os.OpenFile(configFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
 		return fmt.Errorf("error creating new config file: %w", err)
 	}
@@ -139,10 +150,15 @@ func main() {
 }
 
 func run() error {
-	var define bool
+	var (
+		define    bool
+		accessLog string
+	)
 
 	flag.StringVar(&configFile, "c", "", "config file")
 	flag.BoolVar(&define, "d", false, "define settings for config file")
+	flag.StringVar(&captureDir, "p", "", "directory for captures of redirect connections")
+	flag.StringVar(&accessLog, "l", "", "access log file")
 	flag.Parse()
 
 	if configFile == "" {
@@ -173,8 +189,66 @@ func run() error {
 		config.Servers = make(servers)
 	}
 
+	if config.ErrorPages == nil {
+		config.ErrorPages = make(errorPages)
+	}
+
+	if config.HTTPRouting == nil {
+		config.HTTPRouting = make(map[uint16]bool)
+	}
+
+	if config.ConnectTunnels == nil {
+		config.ConnectTunnels = make(map[uint16]map[string]string)
+	}
+
+	if config.Denylists == nil {
+		config.Denylists = make(map[uint16][]string)
+	}
+
+	if config.ECHKeys == nil {
+		config.ECHKeys = make(map[uint16][]echKey)
+	}
+
+	if accessLog != "" {
+		if err := startAccessLog(accessLog); err != nil {
+			return err
+		}
+	}
+
+	if err := certs.Init(config.ACME, config.Servers); err != nil {
+		return err
+	}
+
 	config.Servers.Init()
 
+	if err := config.ErrorPages.Init(); err != nil {
+		return err
+	}
+
+	for port := range config.HTTPRouting {
+		reverseproxy.SetHTTPRouting(port, true)
+	}
+
+	for port, users := range config.ConnectTunnels {
+		var auth reverseproxy.ConnectAuth
+
+		if len(users) > 0 {
+			auth = reverseproxy.BasicAuth(users)
+		}
+
+		reverseproxy.SetConnectTunnel(port, true, auth)
+	}
+
+	for port, fingerprints := range config.Denylists {
+		reverseproxy.SetFingerprintDenylist(port, fingerprints...)
+	}
+
+	for port, keys := range config.ECHKeys {
+		if err := setECHKeys(port, keys); err != nil {
+			return fmt.Errorf("error setting ECH keys for port %d: %w", port, err)
+		}
+	}
+
 	s := http.Server{
 		Handler: &config,
 	}
@@ -196,6 +270,7 @@ func run() error {
 	s.Close()
 	ShutdownRPC()
 	config.Servers.Shutdown()
+	certs.Shutdown()
 
 	return nil
 }
@@ -4,11 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"strconv"
 	"sync"
 
 	"golang.org/x/net/websocket"
 	"vimagination.zapto.org/jsonrpc"
+	"vimagination.zapto.org/reverseproxy"
 )
 
 const (
@@ -28,6 +31,14 @@ const (
 	broadcastStopCommand
 	broadcastCommandStopped
 	broadcastCommandError
+	broadcastSetErrorPage
+	broadcastSetHTTPRouting
+	broadcastCertificate
+	broadcastSetHostnames
+	broadcastSetSplit
+	broadcastSetDenylist
+	broadcastSetECHKeys
+	broadcastSetConnectTunnel
 )
 
 type socket struct {
@@ -106,6 +117,50 @@ func (s *socket) HandleRPC(method string, data json.RawMessage) (interface{}, er
 		return s.stopCommand(data)
 	case "getCommandPorts":
 		return s.getCommandPorts(data)
+	case "getRedirectError":
+		return s.getRedirectError(data)
+	case "getBackends":
+		return s.getBackends(data)
+	case "getCapture":
+		return s.getCapture(data)
+	case "setCapture":
+		return s.setCapture(data)
+	case "getRejections":
+		return s.getRejections(data)
+	case "getFaults":
+		return s.getFaults(data)
+	case "setFaults":
+		return s.setFaults(data)
+	case "getErrorPages":
+		return s.getErrorPages()
+	case "setErrorPage":
+		return s.setErrorPage(data)
+	case "getHTTPRouting":
+		return s.getHTTPRouting()
+	case "setHTTPRouting":
+		return s.setHTTPRouting(data)
+	case "getConnectTunnels":
+		return s.getConnectTunnels()
+	case "setConnectTunnel":
+		return s.setConnectTunnel(data)
+	case "getDenylists":
+		return s.getDenylists()
+	case "setDenylist":
+		return s.setDenylist(data)
+	case "getECHKeys":
+		return s.getECHKeys()
+	case "setECHKeys":
+		return s.setECHKeys(data)
+	case "getCertificates":
+		return certs.getStatus(), nil
+	case "getHostnames":
+		return s.getHostnames()
+	case "setHostnames":
+		return s.setHostnames(data)
+	case "getSplits":
+		return s.getSplits(data)
+	case "setSplit":
+		return s.setSplit(data)
 	}
 
 	return nil, nil
@@ -141,7 +196,7 @@ func buildInitialMessage() json.RawMessage {
 					buf = append(buf, ',')
 				}
 
-				buf = fmt.Appendf(buf, "[%t,%q]", m.IsSuffix, m.Name)
+				buf = m.appendTo(buf)
 			}
 
 			buf = append(buf, ']')
@@ -189,7 +244,7 @@ func buildInitialMessage() json.RawMessage {
 			}
 
 			for _, m := range cmd.Match {
-				buf = fmt.Appendf(buf, ",[%t,%q]", m.IsSuffix, m.Name)
+				buf = m.appendTo(append(buf, ','))
 			}
 
 			buf = append(buf, ']')
@@ -358,6 +413,8 @@ func (s *socket) rename(data json.RawMessage) (interface{}, error) {
 
 	config.Servers[name[1]] = serv
 
+	certs.setHosts(config.Servers)
+
 	if err := saveConfig(); err != nil {
 		return nil, fmt.Errorf("error saving config: %w", err)
 	}
@@ -396,6 +453,8 @@ func (s *socket) remove(data json.RawMessage) (interface{}, error) {
 
 	delete(config.Servers, name)
 
+	certs.setHosts(config.Servers)
+
 	if err := saveConfig(); err != nil {
 		return nil, fmt.Errorf("error saving config: %w", err)
 	}
@@ -413,6 +472,8 @@ func (s *socket) addRedirect(data json.RawMessage) (interface{}, error) {
 
 	if err := json.Unmarshal(data, &ar); err != nil {
 		return nil, err
+	} else if err := checkMatches(ar.Match); err != nil {
+		return nil, err
 	}
 
 	config.mu.Lock()
@@ -442,6 +503,8 @@ func (s *socket) addCommand(data json.RawMessage) (interface{}, error) {
 
 	if err := json.Unmarshal(data, &ac); err != nil {
 		return nil, err
+	} else if err := checkMatches(ac.Match); err != nil {
+		return nil, err
 	}
 
 	config.mu.Lock()
@@ -464,17 +527,23 @@ func (s *socket) addCommand(data json.RawMessage) (interface{}, error) {
 }
 
 func (s *socket) modifyRedirect(data json.RawMessage) (interface{}, error) {
-	var mr struct {
-		nameID
-		redirectData
-	}
+	var n nameID
 
-	if err := json.Unmarshal(data, &mr); err != nil {
+	if err := json.Unmarshal(data, &n); err != nil {
 		return nil, err
 	}
 
-	return nil, s.getRedirect(mr.nameID, func(_ *server, r *redirect) error {
-		r.redirectData = mr.redirectData
+	return nil, s.getRedirect(n, func(_ *server, r *redirect) error {
+		rd, err := mergeData(r.redirectData, data)
+		if err != nil {
+			return err
+		} else if err = checkMatches(rd.Match); err != nil {
+			return err
+		}
+
+		r.redirectData = rd
+		r.matchServiceName = makeMatchService(rd.Match)
+
 		broadcast(broadcastModifyRedirect, data, s.id)
 
 		return nil
@@ -482,23 +551,62 @@ func (s *socket) modifyRedirect(data json.RawMessage) (interface{}, error) {
 }
 
 func (s *socket) modifyCommand(data json.RawMessage) (interface{}, error) {
-	var mc struct {
-		nameID
-		commandData
-	}
+	var n nameID
 
-	if err := json.Unmarshal(data, &mc); err != nil {
+	if err := json.Unmarshal(data, &n); err != nil {
 		return nil, err
 	}
 
-	return nil, s.getCommand(mc.nameID, func(_ *server, c *command) error {
-		c.commandData = mc.commandData
+	return nil, s.getCommand(n, func(_ *server, c *command) error {
+		cd, err := mergeData(c.commandData, data)
+		if err != nil {
+			return err
+		} else if err = checkMatches(cd.Match); err != nil {
+			return err
+		}
+
+		c.commandData = cd
+		c.matchServiceName = makeMatchService(cd.Match)
+
 		broadcast(broadcastModifyCommand, data, s.id)
 
 		return nil
 	})
 }
 
+// mergeData replaces the fields of current with those given in data, so that
+// those not given, such as the options that the UI does not edit, are kept.
+func mergeData[T any](current T, data json.RawMessage) (T, error) {
+	var (
+		merged T
+		fields map[string]json.RawMessage
+		given  map[string]json.RawMessage
+	)
+
+	existing, err := json.Marshal(current)
+	if err != nil {
+		return merged, err
+	}
+
+	if err := json.Unmarshal(existing, &fields); err != nil {
+		return merged, err
+	}
+
+	if err := json.Unmarshal(data, &given); err != nil {
+		return merged, err
+	}
+
+	maps.Copy(fields, given)
+
+	if existing, err = json.Marshal(fields); err != nil {
+		return merged, err
+	}
+
+	err = json.Unmarshal(existing, &merged)
+
+	return merged, err
+}
+
 func (s *socket) removeRedirect(data json.RawMessage) (interface{}, error) {
 	var rr nameID
 
@@ -660,6 +768,627 @@ func (s *socket) getCommandPorts(data json.RawMessage) (interface{}, error) {
 	return ports, nil
 }
 
+func (s *socket) getRedirectError(data json.RawMessage) (interface{}, error) {
+	var re nameID
+
+	if err := json.Unmarshal(data, &re); err != nil {
+		return nil, err
+	}
+
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	serv, ok := config.Servers[re.Server]
+	if !ok {
+		return nil, ErrNoServer
+	}
+
+	r, ok := serv.Redirects[re.ID]
+	if !ok {
+		return nil, ErrUnknownRedirect
+	}
+
+	if r.port != nil {
+		if err := r.port.Status().Err; err != nil {
+			return err.Error(), nil
+		}
+	}
+
+	if r.quicPort != nil {
+		if err := r.quicPort.Status().Err; err != nil {
+			return err.Error(), nil
+		}
+	}
+
+	return r.err, nil
+}
+
+func (s *socket) getBackends(data json.RawMessage) (interface{}, error) {
+	var re nameID
+
+	if err := json.Unmarshal(data, &re); err != nil {
+		return nil, err
+	}
+
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	serv, ok := config.Servers[re.Server]
+	if !ok {
+		return nil, ErrNoServer
+	}
+
+	r, ok := serv.Redirects[re.ID]
+	if !ok {
+		return nil, ErrUnknownRedirect
+	}
+
+	backends := []string{}
+
+	if r.port != nil {
+		backends = append(backends, r.port.Status().Backends...)
+	}
+
+	return backends, nil
+}
+
+type captureStatus struct {
+	Connections uint   `json:"connections"`
+	Bytes       uint64 `json:"bytes"`
+	Captured    uint   `json:"captured"`
+}
+
+func (s *socket) getCapture(data json.RawMessage) (interface{}, error) {
+	var re nameID
+
+	if err := json.Unmarshal(data, &re); err != nil {
+		return nil, err
+	}
+
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	serv, ok := config.Servers[re.Server]
+	if !ok {
+		return nil, ErrNoServer
+	}
+
+	r, ok := serv.Redirects[re.ID]
+	if !ok {
+		return nil, ErrUnknownRedirect
+	}
+
+	return r.captureStatus(), nil
+}
+
+// setCapture sets the capture of a redirect. Commands cannot be captured, as
+// their connections are passed to the command itself rather than proxied.
+func (s *socket) setCapture(data json.RawMessage) (interface{}, error) {
+	var sc struct {
+		nameID
+		Connections uint   `json:"connections"`
+		Bytes       uint64 `json:"bytes"`
+	}
+
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return nil, err
+	}
+
+	config.mu.Lock()
+	defer config.mu.Unlock()
+
+	serv, ok := config.Servers[sc.Server]
+	if !ok {
+		return nil, ErrNoServer
+	}
+
+	r, ok := serv.Redirects[sc.ID]
+	if !ok {
+		return nil, ErrUnknownRedirect
+	}
+
+	if err := r.setCapture(sc.Server, sc.ID, sc.Connections, sc.Bytes); err != nil {
+		return nil, err
+	}
+
+	return r.captureStatus(), nil
+}
+
+func (s *socket) getRejections(data json.RawMessage) (interface{}, error) {
+	var st serviceTarget
+
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	status, err := st.status()
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]uint64{
+		"version": status.Rejected.Version,
+		"sni":     status.Rejected.SNI,
+		"alpn":    status.Rejected.ALPN,
+	}, nil
+}
+
+func (s *socket) getFaults(data json.RawMessage) (interface{}, error) {
+	var ft serviceTarget
+
+	if err := json.Unmarshal(data, &ft); err != nil {
+		return nil, err
+	}
+
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	f, err := ft.getFaults()
+	if err != nil {
+		return nil, err
+	}
+
+	return faultsData(f), nil
+}
+
+func (s *socket) setFaults(data json.RawMessage) (interface{}, error) {
+	var sf struct {
+		serviceTarget
+		faults
+	}
+
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return nil, err
+	}
+
+	f, err := sf.faults.faults()
+	if err != nil {
+		return nil, err
+	}
+
+	config.mu.Lock()
+	defer config.mu.Unlock()
+
+	if err := sf.setFaults(f); err != nil {
+		return nil, err
+	}
+
+	return faultsData(f), nil
+}
+
+func (s *socket) getErrorPages() (interface{}, error) {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	pages := make(map[uint16]string, len(config.ErrorPages))
+
+	for port, tmpl := range config.ErrorPages {
+		pages[port] = tmpl
+	}
+
+	return pages, nil
+}
+
+func (s *socket) setErrorPage(data json.RawMessage) (interface{}, error) {
+	var ep struct {
+		Port     uint16 `json:"port"`
+		Template string `json:"template"`
+	}
+
+	if err := json.Unmarshal(data, &ep); err != nil {
+		return nil, err
+	}
+
+	if ep.Port == 0 {
+		return nil, reverseproxy.ErrInvalidPort
+	}
+
+	config.mu.Lock()
+	defer config.mu.Unlock()
+
+	if err := setErrorPage(ep.Port, ep.Template); err != nil {
+		return nil, err
+	}
+
+	if ep.Template == "" {
+		delete(config.ErrorPages, ep.Port)
+	} else {
+		config.ErrorPages[ep.Port] = ep.Template
+	}
+
+	if err := saveConfig(); err != nil {
+		return nil, fmt.Errorf("error saving config: %w", err)
+	}
+
+	broadcast(broadcastSetErrorPage, data, s.id)
+
+	return nil, nil
+}
+
+func (s *socket) getHTTPRouting() (interface{}, error) {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	ports := make([]uint16, 0, len(config.HTTPRouting))
+
+	for port := range config.HTTPRouting {
+		ports = append(ports, port)
+	}
+
+	return ports, nil
+}
+
+func (s *socket) setHTTPRouting(data json.RawMessage) (interface{}, error) {
+	var hr struct {
+		Port    uint16 `json:"port"`
+		Enabled bool   `json:"enabled"`
+	}
+
+	if err := json.Unmarshal(data, &hr); err != nil {
+		return nil, err
+	}
+
+	if hr.Port == 0 {
+		return nil, reverseproxy.ErrInvalidPort
+	}
+
+	config.mu.Lock()
+	defer config.mu.Unlock()
+
+	reverseproxy.SetHTTPRouting(hr.Port, hr.Enabled)
+
+	if hr.Enabled {
+		config.HTTPRouting[hr.Port] = true
+	} else {
+		delete(config.HTTPRouting, hr.Port)
+	}
+
+	if err := saveConfig(); err != nil {
+		return nil, fmt.Errorf("error saving config: %w", err)
+	}
+
+	broadcast(broadcastSetHTTPRouting, data, s.id)
+
+	return nil, nil
+}
+
+// getConnectTunnels returns the usernames accepted on each port with CONNECT
+// tunnelling enabled, without their passwords.
+func (s *socket) getConnectTunnels() (interface{}, error) {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	tunnels := make(map[uint16][]string, len(config.ConnectTunnels))
+
+	for port, users := range config.ConnectTunnels {
+		tunnels[port] = tunnelUsers(users)
+	}
+
+	return tunnels, nil
+}
+
+func tunnelUsers(users map[string]string) []string {
+	names := slices.AppendSeq(make([]string, 0, len(users)), maps.Keys(users))
+
+	slices.Sort(names)
+
+	return names
+}
+
+// setConnectTunnel enables or disables CONNECT tunnelling on a port; when
+// enabled with no users, tunnels are allowed without authentication.
+func (s *socket) setConnectTunnel(data json.RawMessage) (interface{}, error) {
+	var ct struct {
+		Port    uint16            `json:"port"`
+		Enabled bool              `json:"enabled"`
+		Users   map[string]string `json:"users"`
+	}
+
+	if err := json.Unmarshal(data, &ct); err != nil {
+		return nil, err
+	}
+
+	if ct.Port == 0 {
+		return nil, reverseproxy.ErrInvalidPort
+	}
+
+	config.mu.Lock()
+	defer config.mu.Unlock()
+
+	var auth reverseproxy.ConnectAuth
+
+	if len(ct.Users) > 0 {
+		auth = reverseproxy.BasicAuth(ct.Users)
+	}
+
+	reverseproxy.SetConnectTunnel(ct.Port, ct.Enabled, auth)
+
+	if ct.Enabled {
+		if ct.Users == nil {
+			ct.Users = map[string]string{}
+		}
+
+		config.ConnectTunnels[ct.Port] = ct.Users
+	} else {
+		delete(config.ConnectTunnels, ct.Port)
+	}
+
+	if err := saveConfig(); err != nil {
+		return nil, fmt.Errorf("error saving config: %w", err)
+	}
+
+	users, err := json.Marshal(struct {
+		Port    uint16   `json:"port"`
+		Enabled bool     `json:"enabled"`
+		Users   []string `json:"users"`
+	}{ct.Port, ct.Enabled, tunnelUsers(ct.Users)})
+	if err != nil {
+		return nil, err
+	}
+
+	broadcast(broadcastSetConnectTunnel, users, s.id)
+
+	return nil, nil
+}
+
+func (s *socket) getDenylists() (interface{}, error) {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	denylists := make(map[uint16][]string, len(config.Denylists))
+
+	for port, fingerprints := range config.Denylists {
+		denylists[port] = fingerprints
+	}
+
+	return denylists, nil
+}
+
+func (s *socket) setDenylist(data json.RawMessage) (interface{}, error) {
+	var dl struct {
+		Port         uint16   `json:"port"`
+		Fingerprints []string `json:"fingerprints"`
+	}
+
+	if err := json.Unmarshal(data, &dl); err != nil {
+		return nil, err
+	}
+
+	if dl.Port == 0 {
+		return nil, reverseproxy.ErrInvalidPort
+	}
+
+	config.mu.Lock()
+	defer config.mu.Unlock()
+
+	reverseproxy.SetFingerprintDenylist(dl.Port, dl.Fingerprints...)
+
+	if len(dl.Fingerprints) > 0 {
+		config.Denylists[dl.Port] = dl.Fingerprints
+	} else {
+		delete(config.Denylists, dl.Port)
+	}
+
+	if err := saveConfig(); err != nil {
+		return nil, fmt.Errorf("error saving config: %w", err)
+	}
+
+	broadcast(broadcastSetDenylist, data, s.id)
+
+	return nil, nil
+}
+
+func (s *socket) getECHKeys() (interface{}, error) {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	configs := make(map[uint16][][]byte, len(config.ECHKeys))
+
+	for port, keys := range config.ECHKeys {
+		configs[port] = echConfigs(keys)
+	}
+
+	return configs, nil
+}
+
+func (s *socket) setECHKeys(data json.RawMessage) (interface{}, error) {
+	var ek struct {
+		Port uint16   `json:"port"`
+		Keys []echKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &ek); err != nil {
+		return nil, err
+	}
+
+	if ek.Port == 0 {
+		return nil, reverseproxy.ErrInvalidPort
+	}
+
+	config.mu.Lock()
+	defer config.mu.Unlock()
+
+	if err := setECHKeys(ek.Port, ek.Keys); err != nil {
+		return nil, err
+	}
+
+	if len(ek.Keys) > 0 {
+		config.ECHKeys[ek.Port] = ek.Keys
+	} else {
+		delete(config.ECHKeys, ek.Port)
+	}
+
+	if err := saveConfig(); err != nil {
+		return nil, fmt.Errorf("error saving config: %w", err)
+	}
+
+	configs, err := json.Marshal(struct {
+		Port    uint16   `json:"port"`
+		Configs [][]byte `json:"configs"`
+	}{ek.Port, echConfigs(ek.Keys)})
+	if err != nil {
+		return nil, err
+	}
+
+	broadcast(broadcastSetECHKeys, configs, s.id)
+
+	return nil, nil
+}
+
+func (s *socket) getHostnames() (interface{}, error) {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	hostnames := make(map[string][]string, len(config.Servers))
+
+	for name, serv := range config.Servers {
+		if len(serv.Hostnames) > 0 {
+			hostnames[name] = serv.Hostnames
+		}
+	}
+
+	return hostnames, nil
+}
+
+func (s *socket) setHostnames(data json.RawMessage) (interface{}, error) {
+	var sh struct {
+		Server    string   `json:"server"`
+		Hostnames []string `json:"hostnames"`
+	}
+
+	if err := json.Unmarshal(data, &sh); err != nil {
+		return nil, err
+	}
+
+	config.mu.Lock()
+	defer config.mu.Unlock()
+
+	serv, ok := config.Servers[sh.Server]
+	if !ok {
+		return nil, ErrNoServer
+	}
+
+	if err := checkHostnames(config.Servers, sh.Server, sh.Hostnames); err != nil {
+		return nil, err
+	}
+
+	serv.Hostnames = sh.Hostnames
+
+	certs.setHosts(config.Servers)
+
+	if err := saveConfig(); err != nil {
+		return nil, fmt.Errorf("error saving config: %w", err)
+	}
+
+	broadcast(broadcastSetHostnames, data, s.id)
+
+	return nil, nil
+}
+
+func (s *socket) getSplits(data json.RawMessage) (interface{}, error) {
+	var name string
+
+	if err := json.Unmarshal(data, &name); err != nil {
+		return nil, err
+	}
+
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+
+	serv, ok := config.Servers[name]
+	if !ok {
+		return nil, ErrNoServer
+	}
+
+	splits := make(map[string]*split, len(serv.Splits))
+
+	for name, sp := range serv.Splits {
+		weights := sp.Weights
+
+		if sp.split != nil {
+			weights = sp.split.Weights()
+		}
+
+		splits[name] = &split{
+			Members: sp.Members,
+			Weights: weights,
+			Pin:     sp.Pin,
+		}
+	}
+
+	return splits, nil
+}
+
+func (s *socket) setSplit(data json.RawMessage) (interface{}, error) {
+	var ss struct {
+		Server string `json:"server"`
+		Name   string `json:"name"`
+		split
+	}
+
+	if err := json.Unmarshal(data, &ss); err != nil {
+		return nil, err
+	}
+
+	config.mu.Lock()
+	defer config.mu.Unlock()
+
+	serv, ok := config.Servers[ss.Server]
+	if !ok {
+		return nil, ErrNoServer
+	}
+
+	if existing, ok := serv.Splits[ss.Name]; ok {
+		if len(ss.Members) == 0 {
+			existing.Shutdown()
+			delete(serv.Splits, ss.Name)
+		} else if sameMembers(existing.Members, ss.Members) && existing.Pin == ss.Pin {
+			if err := existing.split.SetWeights(ss.Weights...); err != nil {
+				return nil, err
+			}
+
+			existing.Weights = ss.Weights
+		} else {
+			existing.Shutdown()
+
+			if err := ss.split.Run(serv); err != nil {
+				existing.Run(serv)
+
+				return nil, err
+			}
+
+			serv.Splits[ss.Name] = &ss.split
+		}
+	} else if len(ss.Members) > 0 {
+		if err := ss.split.Run(serv); err != nil {
+			return nil, err
+		}
+
+		if serv.Splits == nil {
+			serv.Splits = make(map[string]*split)
+		}
+
+		serv.Splits[ss.Name] = &ss.split
+	}
+
+	if err := saveConfig(); err != nil {
+		return nil, fmt.Errorf("error saving config: %w", err)
+	}
+
+	broadcast(broadcastSetSplit, data, s.id)
+
+	return nil, nil
+}
+
+func sameMembers(a, b []*splitMember) bool {
+	return slices.EqualFunc(a, b, func(a, b *splitMember) bool {
+		return a.Redirect == b.Redirect && a.Command == b.Command
+	})
+}
+
 var (
 	ErrNameExists       = errors.New("name already exists")
 	ErrNoServer         = errors.New("no server by that name exists")
@@ -667,4 +1396,5 @@ var (
 	ErrServerNotRunning = errors.New("server not running")
 	ErrUnknownRedirect  = errors.New("unknown redirect")
 	ErrUnknownCommand   = errors.New("unknown command")
+	ErrNoCaptureDir     = errors.New("no capture directory specified")
 )
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/reverseproxy"
+)
+
+func testConfig(t *testing.T) *server {
+	t.Helper()
+
+	configFile = filepath.Join(t.TempDir(), "config.json")
+	serv := &server{
+		name:      "test",
+		Redirects: make(map[uint64]*redirect),
+		Commands:  make(map[uint64]*command),
+	}
+	config.mu.Lock()
+	config.Servers = servers{"test": serv}
+	config.mu.Unlock()
+
+	t.Cleanup(func() {
+		config.mu.Lock()
+		config.Servers = nil
+		config.mu.Unlock()
+	})
+
+	return serv
+}
+
+func TestModifyKeepsOptions(t *testing.T) {
+	serv := testConfig(t)
+	forward := &forward{Headers: reverseproxy.HeaderXForwardedFor, Trusted: []string{"10.0.0.0/8"}}
+	policy := &tlsPolicy{MinVersion: "1.3", RequireSNI: true}
+
+	serv.Redirects[1] = &redirect{redirectData: redirectData{
+		From:       80,
+		To:         "127.0.0.1:8080",
+		Match:      []match{{Name: "old.example", Path: "/old", JA3: []string{"abc"}}},
+		Forward:    forward,
+		Rewrite:    &rewrite{Host: "backend"},
+		Mirror:     "127.0.0.1:9000",
+		TLSPolicy:  policy,
+		ECHBackend: true,
+	}}
+	serv.Commands[1] = &command{commandData: commandData{
+		Exe:        "/bin/true",
+		Match:      []match{{Name: "old.example"}},
+		Forward:    forward,
+		TLSPolicy:  policy,
+		ClaimPorts: []uint16{8443},
+	}}
+
+	var s socket
+
+	if _, err := s.modifyRedirect(json.RawMessage(`{"server":"test","id":1,"from":81,"to":"127.0.0.1:8081","match":[{"isSuffix":true,"name":"new.example"}]}`)); err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	expected := redirectData{
+		From:       81,
+		To:         "127.0.0.1:8081",
+		Match:      []match{{IsSuffix: true, Name: "new.example"}},
+		Forward:    forward,
+		Rewrite:    &rewrite{Host: "backend"},
+		Mirror:     "127.0.0.1:9000",
+		TLSPolicy:  policy,
+		ECHBackend: true,
+	}
+
+	if r := serv.Redirects[1]; !reflect.DeepEqual(r.redirectData, expected) {
+		t.Errorf("test 1: expecting redirect %+v, got %+v", expected, r.redirectData)
+	} else if !r.matchServiceName.MatchService("a.new.example") {
+		t.Errorf("test 1: expecting modified match to be used")
+	}
+
+	if _, err := s.modifyCommand(json.RawMessage(`{"server":"test","id":1,"exe":"/bin/false","params":["-v"],"workDir":"/tmp","env":{},"match":[{"isSuffix":false,"name":"new.example"}]}`)); err != nil {
+		t.Fatalf("test 2: unexpected error: %s", err)
+	}
+
+	expectedCmd := commandData{
+		Exe:        "/bin/false",
+		Params:     []string{"-v"},
+		WorkDir:    "/tmp",
+		Env:        map[string]string{},
+		Match:      []match{{Name: "new.example"}},
+		Forward:    forward,
+		TLSPolicy:  policy,
+		ClaimPorts: []uint16{8443},
+	}
+
+	if c := serv.Commands[1]; !reflect.DeepEqual(c.commandData, expectedCmd) {
+		t.Errorf("test 2: expecting command %+v, got %+v", expectedCmd, c.commandData)
+	}
+}
+
+func TestSetHostnames(t *testing.T) {
+	testConfig(t)
+
+	config.Servers["other"] = &server{name: "other", Hostnames: []string{"other.example"}}
+
+	certs.Init(nil, config.Servers)
+
+	var s socket
+
+	for n, test := range [...]struct {
+		Data string
+		Err  error
+	}{
+		{`{"server":"test","hostnames":["a.example","b.example"]}`, nil},
+		{`{"server":"test","hostnames":["a.example","other.example"]}`, ErrDuplicateHostname},
+		{`{"server":"test","hostnames":["a.example","a.example"]}`, ErrDuplicateHostname},
+		{`{"server":"test","hostnames":["a.example"]}`, nil},
+		{`{"server":"other","hostnames":["other.example","b.example"]}`, nil},
+	} {
+		if _, err := s.setHostnames(json.RawMessage(test.Data)); !errors.Is(err, test.Err) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		}
+	}
+
+	if hosts := config.Servers["test"].Hostnames; !reflect.DeepEqual(hosts, []string{"a.example"}) {
+		t.Errorf("test 6: expecting hostnames %v, got %v", []string{"a.example"}, hosts)
+	}
+}
+
+func TestMatchFingerprints(t *testing.T) {
+	serv := testConfig(t)
+
+	serv.Redirects[1] = &redirect{redirectData: redirectData{
+		From:  80,
+		To:    "127.0.0.1:8080",
+		Match: []match{{Name: "example.com"}},
+	}}
+
+	var s socket
+
+	if _, err := s.modifyRedirect(json.RawMessage(`{"server":"test","id":1,"match":[{"name":"example.com","path":"/a","ja3":["abc"]}]}`)); !errors.Is(err, ErrPathWithFingerprint) {
+		t.Errorf("test 1: expecting error %v, got %v", ErrPathWithFingerprint, err)
+	}
+
+	if _, err := s.addCommand(json.RawMessage(`{"server":"test","exe":"/bin/true","match":[{"name":"example.com","path":"/a","ja4":["abc"]}]}`)); !errors.Is(err, ErrPathWithFingerprint) {
+		t.Errorf("test 2: expecting error %v, got %v", ErrPathWithFingerprint, err)
+	}
+
+	for n, test := range [...]struct {
+		Match    match
+		Expected string
+	}{
+		{match{Name: "example.com"}, `[false,"example.com"]`},
+		{match{IsSuffix: true, Name: "example.com", Path: "/a"}, `[true,"example.com","/a"]`},
+		{match{Name: "example.com", JA3: []string{"abc"}}, `[false,"example.com","",["abc"],null]`},
+		{match{Name: "example.com", JA4: []string{"def", "ghi"}}, `[false,"example.com","",null,["def","ghi"]]`},
+	} {
+		if got := string(test.Match.appendTo(nil)); got != test.Expected {
+			t.Errorf("test %d: expecting %s, got %s", n+3, test.Expected, got)
+		}
+	}
+}
+
+func TestSetCapture(t *testing.T) {
+	serv := testConfig(t)
+	serv.Redirects[1] = &redirect{redirectData: redirectData{From: 80, To: "127.0.0.1:8080"}}
+	config.Servers[".."] = serv
+
+	captureDir = filepath.Join(t.TempDir(), "captures")
+
+	defer func() { captureDir = "" }()
+
+	var s socket
+
+	for n, test := range [...]struct {
+		Server, Dir string
+	}{
+		{"test", "test"},
+		{"..", "%2E%2E"},
+	} {
+		if _, err := s.setCapture(json.RawMessage(`{"server":"` + test.Server + `","id":1,"connections":1}`)); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		} else if _, err := os.Stat(filepath.Join(captureDir, test.Dir, "1")); err != nil {
+			t.Errorf("test %d: expecting capture directory: %s", n+1, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(captureDir, "..", "1")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("test 3: expecting no directory outside of the capture directory, got %v", err)
+	}
+}
+
+func TestSetConnectTunnel(t *testing.T) {
+	testConfig(t)
+
+	config.ConnectTunnels = make(map[uint16]map[string]string)
+
+	defer func() { config.ConnectTunnels = nil }()
+
+	var s socket
+
+	defer s.setConnectTunnel(json.RawMessage(`{"port":8080,"enabled":false}`))
+
+	for n, test := range [...]struct {
+		Data     string
+		Err      error
+		Expected map[uint16][]string
+	}{
+		{`{"port":0,"enabled":true}`, reverseproxy.ErrInvalidPort, map[uint16][]string{}},
+		{`{"port":8080,"enabled":true,"users":{"b":"pass","a":"word"}}`, nil, map[uint16][]string{8080: {"a", "b"}}},
+		{`{"port":8080,"enabled":true}`, nil, map[uint16][]string{8080: {}}},
+		{`{"port":8080,"enabled":false}`, nil, map[uint16][]string{}},
+	} {
+		if _, err := s.setConnectTunnel(json.RawMessage(test.Data)); !errors.Is(err, test.Err) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		} else if tunnels, _ := s.getConnectTunnels(); !reflect.DeepEqual(tunnels, test.Expected) {
+			t.Errorf("test %d: expecting tunnels %v, got %v", n+1, test.Expected, tunnels)
+		}
+	}
+}
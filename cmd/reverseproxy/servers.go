@@ -1,12 +1,21 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"net/url"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"vimagination.zapto.org/reverseproxy"
 )
@@ -28,6 +37,8 @@ func (s servers) Shutdown() {
 type server struct {
 	Redirects map[uint64]*redirect `json:"redirects"`
 	Commands  map[uint64]*command  `json:"commands"`
+	Hostnames []string             `json:"hostnames"`
+	Splits    map[string]*split    `json:"splits,omitempty"`
 	name      string
 	lastRID   uint64
 	lastCID   uint64
@@ -51,6 +62,10 @@ func (s *server) Init(name string) {
 			s.lastCID = id
 		}
 	}
+
+	for _, sp := range s.Splits {
+		sp.Run(s)
+	}
 }
 
 func (s *server) addRedirect(rd redirectData) uint64 {
@@ -88,12 +103,66 @@ func (s *server) Shutdown() {
 	for _, c := range s.Commands {
 		c.Shutdown()
 	}
+
+	for _, sp := range s.Splits {
+		sp.Shutdown()
+	}
 }
 
 type redirectData struct {
-	From  uint16  `json:"from"`
-	To    string  `json:"to"`
-	Match []match `json:"match"`
+	From       uint16     `json:"from"`
+	To         string     `json:"to"`
+	Match      []match    `json:"match"`
+	Forward    *forward   `json:"forward,omitempty"`
+	Rewrite    *rewrite   `json:"rewrite,omitempty"`
+	TLS        *tlsKeys   `json:"tls,omitempty"`
+	Upstream   *upstream  `json:"upstream,omitempty"`
+	Dialer     *dialer    `json:"dialer,omitempty"`
+	Discovery  *discovery `json:"discovery,omitempty"`
+	Mirror     string     `json:"mirror,omitempty"`
+	TLSPolicy  *tlsPolicy `json:"tlsPolicy,omitempty"`
+	ECHBackend bool       `json:"echBackend,omitempty"`
+	QUIC       bool       `json:"quic,omitempty"`
+	Claim      bool       `json:"claim,omitempty"`
+}
+
+func (r *redirectData) options() ([]reverseproxy.Option, error) {
+	opts, err := r.Forward.options()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsOpts, err := r.TLS.options()
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamOpts, err := r.Upstream.options()
+	if err != nil {
+		return nil, err
+	}
+
+	dialerOpts, err := r.Dialer.options()
+	if err != nil {
+		return nil, err
+	}
+
+	policyOpts, err := r.TLSPolicy.options()
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append(append(append(append(append(opts, r.Rewrite.options()...), tlsOpts...), upstreamOpts...), dialerOpts...), policyOpts...)
+
+	if r.Mirror != "" {
+		opts = append(opts, reverseproxy.MirrorTo(reverseproxy.HostAddr{Net: "tcp", Address: r.Mirror}))
+	}
+
+	if r.ECHBackend {
+		opts = append(opts, reverseproxy.ECHBackend())
+	}
+
+	return opts, nil
 }
 
 type redirect struct {
@@ -101,7 +170,15 @@ type redirect struct {
 	matchServiceName reverseproxy.MatchServiceName
 	Start            bool `json:"start"`
 	port             *reverseproxy.Port
+	quicPort         *reverseproxy.PacketPort
+	capture          *reverseproxy.Capture
+	faults           *reverseproxy.Faults
+	captureLimits    captureStatus
 	err              string
+
+	// live mirrors port for lookups, such as by splits, that are made while
+	// routing connections and so cannot take the config lock.
+	live atomic.Pointer[reverseproxy.Port]
 }
 
 func (r *redirect) Init() {
@@ -113,12 +190,23 @@ func (r *redirect) Init() {
 }
 
 func (r *redirect) Run() {
-	if r.From > 0 && r.To != "" && r.port == nil {
-		if addr, err := net.ResolveTCPAddr("tcp", r.To); err != nil {
+	if r.From > 0 && (r.To != "" || r.Discovery != nil) && r.port == nil {
+		if opts, err := r.options(); err != nil {
+			r.err = err.Error()
+		} else if r.port, err = r.add(opts); err != nil {
 			r.err = err.Error()
-		} else if r.port, err = reverseproxy.AddRedirect(r.matchServiceName, r.From, addr); err != nil {
+		} else if err = r.runQUIC(); err != nil {
 			r.err = err.Error()
+
+			r.Shutdown()
 		} else {
+			if r.capture != nil {
+				r.port.SetCapture(r.capture)
+			}
+
+			r.port.SetFaults(r.faults)
+			r.live.Store(r.port)
+
 			r.Start = true
 
 			saveConfig()
@@ -126,6 +214,94 @@ func (r *redirect) Run() {
 	}
 }
 
+// setCapture starts capturing connections to the redirect into a directory
+// for it beneath the capture directory, replacing any previous capture. Zero
+// connections stops capturing, and zero bytes captures connections in full.
+func (r *redirect) setCapture(server string, id uint64, connections uint, bytes uint64) error {
+	if connections == 0 {
+		r.capture = nil
+	} else if captureDir == "" {
+		return ErrNoCaptureDir
+	} else {
+		dir := filepath.Join(captureDir, captureDirName(server), strconv.FormatUint(id, 10))
+
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+
+		r.capture = reverseproxy.NewCapture(dir, connections, bytes)
+	}
+
+	r.captureLimits = captureStatus{Connections: connections, Bytes: bytes}
+
+	if r.port != nil {
+		return r.port.SetCapture(r.capture)
+	}
+
+	return nil
+}
+
+// captureDirName escapes a server name for use as a directory name, escaping
+// dots as well as path separators so that the name cannot be "." or "..".
+func captureDirName(server string) string {
+	return strings.ReplaceAll(url.PathEscape(server), ".", "%2E")
+}
+
+func (r *redirect) captureStatus() captureStatus {
+	status := r.captureLimits
+
+	if r.capture != nil {
+		status.Captured = r.capture.Captured()
+	}
+
+	return status
+}
+
+// add registers the redirect, either by the match rules or, when claiming the
+// port, for all connections, to either the fixed or the discovered targets.
+func (r *redirect) add(opts []reverseproxy.Option) (*reverseproxy.Port, error) {
+	if r.Discovery != nil {
+		d, err := r.Discovery.discovery()
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Claim {
+			return reverseproxy.AddDiscoveredRedirect(reverseproxy.Hosts{}, r.From, d, append(opts, reverseproxy.ClaimPorts())...)
+		}
+
+		return reverseproxy.AddDiscoveredRedirect(r.matchServiceName, r.From, d, opts...)
+	}
+
+	if _, _, err := net.SplitHostPort(r.To); err != nil {
+		return nil, err
+	}
+
+	addr := reverseproxy.HostAddr{Net: "tcp", Address: r.To}
+
+	if r.Claim {
+		return reverseproxy.AddForward(r.From, addr, opts...)
+	}
+
+	return reverseproxy.AddRedirect(r.matchServiceName, r.From, addr, opts...)
+}
+
+// runQUIC starts passing QUIC connections on the UDP port of the same number
+// to the target, when enabled.
+func (r *redirect) runQUIC() error {
+	if !r.QUIC {
+		return nil
+	} else if r.To == "" {
+		return ErrNoQUICTarget
+	}
+
+	var err error
+
+	r.quicPort, err = reverseproxy.AddQUICRedirect(r.matchServiceName, r.From, reverseproxy.HostAddr{Net: "udp", Address: r.To})
+
+	return err
+}
+
 func (r *redirect) Stop() {
 	r.Start = false
 
@@ -135,10 +311,17 @@ func (r *redirect) Stop() {
 
 func (r *redirect) Shutdown() {
 	if r.port != nil {
+		r.live.Store(nil)
 		r.port.Close()
 
 		r.port = nil
 	}
+
+	if r.quicPort != nil {
+		r.quicPort.Close()
+
+		r.quicPort = nil
+	}
 }
 
 type user struct {
@@ -147,12 +330,46 @@ type user struct {
 }
 
 type commandData struct {
-	Exe     string            `json:"exe"`
-	Params  []string          `json:"params"`
-	WorkDir string            `json:"workDir"`
-	Env     map[string]string `json:"env"`
-	Match   []match           `json:"match"`
-	User    *user             `json:"user,omitempty"`
+	Exe        string            `json:"exe"`
+	Params     []string          `json:"params"`
+	WorkDir    string            `json:"workDir"`
+	Env        map[string]string `json:"env"`
+	Match      []match           `json:"match"`
+	User       *user             `json:"user,omitempty"`
+	Forward    *forward          `json:"forward,omitempty"`
+	TLS        *tlsKeys          `json:"tls,omitempty"`
+	TLSPolicy  *tlsPolicy        `json:"tlsPolicy,omitempty"`
+	ECHBackend bool              `json:"echBackend,omitempty"`
+	ClaimPorts []uint16          `json:"claimPorts,omitempty"`
+}
+
+func (c *commandData) options() ([]reverseproxy.Option, error) {
+	opts, err := c.Forward.options()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsOpts, err := c.TLS.options()
+	if err != nil {
+		return nil, err
+	}
+
+	policyOpts, err := c.TLSPolicy.options()
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append(append(append(opts, tlsOpts...), policyOpts...), reverseproxy.ProvideCertificates(certs.GetCertificate))
+
+	if len(c.ClaimPorts) > 0 {
+		opts = append(opts, reverseproxy.ClaimPorts(c.ClaimPorts...))
+	}
+
+	if c.ECHBackend {
+		opts = append(opts, reverseproxy.ECHBackend())
+	}
+
+	return opts, nil
 }
 
 type command struct {
@@ -161,9 +378,13 @@ type command struct {
 	Start            bool `json:"start"`
 	status           int
 	unixCmd          *reverseproxy.UnixCmd
+	faults           *reverseproxy.Faults
 	err              string
 	server           *server
 	id               uint64
+
+	// live mirrors unixCmd for lookups made while routing connections.
+	live atomic.Pointer[reverseproxy.UnixCmd]
 }
 
 func (c *command) Init(server *server, id uint64) {
@@ -200,7 +421,15 @@ func (c *command) Run() error {
 			cmd.Dir = c.WorkDir
 		}
 
-		uc, err := reverseproxy.RegisterCmd(c.matchServiceName, cmd)
+		opts, err := c.options()
+		if err != nil {
+			c.err = err.Error()
+			c.status = 2
+
+			return err
+		}
+
+		uc, err := reverseproxy.RegisterCmd(c.matchServiceName, cmd, opts...)
 		if err != nil {
 			c.err = err.Error()
 			c.status = 2
@@ -212,6 +441,9 @@ func (c *command) Run() error {
 		c.err = ""
 		c.unixCmd = uc
 
+		uc.SetFaults(c.faults)
+		c.live.Store(uc)
+
 		go func() {
 			err := cmd.Wait()
 
@@ -230,6 +462,7 @@ func (c *command) Run() error {
 
 			c.unixCmd = nil
 
+			c.live.CompareAndSwap(uc, nil)
 			config.mu.Unlock()
 		}()
 
@@ -252,23 +485,309 @@ func (c *command) Shutdown() {
 	if c.unixCmd != nil {
 		c.status = 0
 
+		c.live.Store(nil)
 		c.unixCmd.Close()
 
 		c.unixCmd = nil
 	}
 }
 
+type forward struct {
+	Headers reverseproxy.ForwardHeader `json:"headers"`
+	Trusted []string                   `json:"trusted"`
+}
+
+func (f *forward) options() ([]reverseproxy.Option, error) {
+	if f == nil || f.Headers == 0 {
+		return nil, nil
+	}
+
+	var trust reverseproxy.TrustPolicy
+
+	if len(f.Trusted) > 0 {
+		networks := make([]*net.IPNet, len(f.Trusted))
+
+		for n, cidr := range f.Trusted {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+
+			networks[n] = network
+		}
+
+		trust = reverseproxy.TrustNetworks(networks...)
+	}
+
+	return []reverseproxy.Option{reverseproxy.InjectHeaders(f.Headers, trust)}, nil
+}
+
+type tlsKeys struct {
+	ACME bool   `json:"acme"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+func (t *tlsKeys) options() ([]reverseproxy.Option, error) {
+	if t == nil {
+		return nil, nil
+	} else if t.ACME {
+		tc, err := certs.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		return []reverseproxy.Option{reverseproxy.TerminateTLS(tc)}, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []reverseproxy.Option{reverseproxy.TerminateTLS(&tls.Config{Certificates: []tls.Certificate{cert}})}, nil
+}
+
+type upstream struct {
+	ServerName         string `json:"serverName"`
+	CACert             string `json:"caCert"`
+	Cert               string `json:"cert"`
+	Key                string `json:"key"`
+	MinVersion         string `json:"minVersion"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+type tlsPolicy struct {
+	MinVersion string   `json:"minVersion"`
+	RequireSNI bool     `json:"requireSNI"`
+	ALPN       []string `json:"alpn"`
+}
+
+func (t *tlsPolicy) options() ([]reverseproxy.Option, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	minVersion, ok := tlsVersions[t.MinVersion]
+	if !ok {
+		return nil, ErrInvalidTLSVersion
+	}
+
+	return []reverseproxy.Option{reverseproxy.EnforceTLSPolicy(reverseproxy.TLSPolicy{
+		MinVersion: minVersion,
+		RequireSNI: t.RequireSNI,
+		ALPN:       t.ALPN,
+	})}, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"":    0,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (u *upstream) options() ([]reverseproxy.Option, error) {
+	if u == nil {
+		return nil, nil
+	}
+
+	minVersion, ok := tlsVersions[u.MinVersion]
+	if !ok {
+		return nil, ErrInvalidTLSVersion
+	}
+
+	tc := &tls.Config{
+		ServerName:         u.ServerName,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+
+	if u.CACert != "" {
+		pem, err := os.ReadFile(u.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("error reading upstream CA bundle: %w", err)
+		}
+
+		tc.RootCAs = x509.NewCertPool()
+
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCABundle
+		}
+	}
+
+	if u.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(u.Cert, u.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return []reverseproxy.Option{reverseproxy.OriginateTLS(tc)}, nil
+}
+
+// dialer sets the Dialer of a redirect. The Password of the proxy is kept in
+// plaintext, both in the config file and in the updates sent to the other
+// connected clients.
+type dialer struct {
+	Type     string `json:"type"`
+	Proxy    string `json:"proxy"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Timeout  uint   `json:"timeout"`
+	Bind     string `json:"bind"`
+}
+
+func (d *dialer) options() ([]reverseproxy.Option, error) {
+	if d == nil {
+		return nil, nil
+	}
+
+	nd := &net.Dialer{Timeout: time.Duration(d.Timeout) * time.Second}
+
+	if d.Bind != "" {
+		ip := net.ParseIP(d.Bind)
+		if ip == nil {
+			return nil, ErrInvalidBindAddress
+		}
+
+		nd.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	var rd reverseproxy.Dialer
+
+	switch d.Type {
+	case "":
+		rd = nd
+	case "socks5":
+		rd = &reverseproxy.SOCKS5Dialer{Proxy: d.Proxy, Username: d.Username, Password: d.Password, Dialer: nd}
+	case "http":
+		rd = &reverseproxy.HTTPConnectDialer{Proxy: d.Proxy, Username: d.Username, Password: d.Password, Dialer: nd}
+	default:
+		return nil, ErrInvalidDialerType
+	}
+
+	return []reverseproxy.Option{reverseproxy.DialVia(rd)}, nil
+}
+
+type discovery struct {
+	Type    string `json:"type"`
+	Service string `json:"service"`
+	Proto   string `json:"proto"`
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Refresh uint   `json:"refresh"`
+}
+
+func (d *discovery) discovery() (reverseproxy.Discovery, error) {
+	switch d.Type {
+	case "srv":
+		return reverseproxy.NewSRVDiscovery(d.Service, d.Proto, d.Name, time.Duration(d.Refresh)*time.Second), nil
+	case "file":
+		return reverseproxy.NewFileDiscovery(d.Path), nil
+	}
+
+	return nil, ErrInvalidDiscoveryType
+}
+
+type header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type rewrite struct {
+	Host          string   `json:"host"`
+	StripPrefix   string   `json:"stripPrefix"`
+	AddPrefix     string   `json:"addPrefix"`
+	SetHeaders    []header `json:"setHeaders"`
+	RemoveHeaders []string `json:"removeHeaders"`
+}
+
+func (r *rewrite) options() []reverseproxy.Option {
+	if r == nil {
+		return nil
+	}
+
+	var opts []reverseproxy.Option
+
+	if r.Host != "" {
+		opts = append(opts, reverseproxy.RewriteHost(r.Host))
+	}
+
+	if r.StripPrefix != "" {
+		opts = append(opts, reverseproxy.StripPathPrefix(r.StripPrefix))
+	}
+
+	if r.AddPrefix != "" {
+		opts = append(opts, reverseproxy.AddPathPrefix(r.AddPrefix))
+	}
+
+	for _, name := range r.RemoveHeaders {
+		opts = append(opts, reverseproxy.RemoveHeader(name))
+	}
+
+	for _, h := range r.SetHeaders {
+		opts = append(opts, reverseproxy.SetHeader(h.Name, h.Value))
+	}
+
+	return opts
+}
+
 type match struct {
-	IsSuffix bool   `json:"isSuffix"`
-	Name     string `json:"name"`
+	IsSuffix bool     `json:"isSuffix"`
+	Name     string   `json:"name"`
+	Path     string   `json:"path,omitempty"`
+	JA3      []string `json:"ja3,omitempty"`
+	JA4      []string `json:"ja4,omitempty"`
 }
 
 func (m match) makeMatchService() reverseproxy.MatchServiceName {
+	var msn reverseproxy.MatchServiceName
+
 	if m.IsSuffix {
-		return reverseproxy.HostNameSuffix(m.Name)
+		msn = reverseproxy.HostNameSuffix(m.Name)
+	} else {
+		msn = reverseproxy.HostName(m.Name)
+	}
+
+	if m.Path != "" {
+		return reverseproxy.PathPrefix{Host: msn, Prefix: m.Path}
 	}
 
-	return reverseproxy.HostName(m.Name)
+	if len(m.JA3) > 0 || len(m.JA4) > 0 {
+		return reverseproxy.FingerprintMatch{Host: msn, JA3: m.JA3, JA4: m.JA4}
+	}
+
+	return msn
+}
+
+func (m match) appendTo(buf []byte) []byte {
+	if len(m.JA3) > 0 || len(m.JA4) > 0 {
+		ja3, _ := json.Marshal(m.JA3)
+		ja4, _ := json.Marshal(m.JA4)
+
+		return fmt.Appendf(buf, "[%t,%q,%q,%s,%s]", m.IsSuffix, m.Name, m.Path, ja3, ja4)
+	} else if m.Path != "" {
+		return fmt.Appendf(buf, "[%t,%q,%q]", m.IsSuffix, m.Name, m.Path)
+	}
+
+	return fmt.Appendf(buf, "[%t,%q]", m.IsSuffix, m.Name)
+}
+
+// checkMatches rejects matches with both a path and fingerprints, as paths
+// are only matched for plaintext HTTP and fingerprints only for TLS, so such a
+// match could never be met.
+func checkMatches(matches []match) error {
+	for _, m := range matches {
+		if m.Path != "" && (len(m.JA3) > 0 || len(m.JA4) > 0) {
+			return fmt.Errorf("%w: %s", ErrPathWithFingerprint, m.Name)
+		}
+	}
+
+	return nil
 }
 
 func makeMatchService(match []match) reverseproxy.MatchServiceName {
@@ -290,3 +809,13 @@ func makeMatchService(match []match) reverseproxy.MatchServiceName {
 type none struct{}
 
 func (none) MatchService(_ string) bool { return false }
+
+var (
+	ErrInvalidTLSVersion    = errors.New("invalid TLS version")
+	ErrInvalidCABundle      = errors.New("invalid CA bundle")
+	ErrInvalidBindAddress   = errors.New("invalid bind address")
+	ErrInvalidDialerType    = errors.New("invalid dialer type")
+	ErrInvalidDiscoveryType = errors.New("invalid discovery type")
+	ErrNoQUICTarget         = errors.New("QUIC requires a fixed target")
+	ErrPathWithFingerprint  = errors.New("match cannot have both a path and fingerprints")
+)
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+
+	"vimagination.zapto.org/reverseproxy"
+)
+
+type splitMember struct {
+	Redirect uint64 `json:"redirect,omitempty"`
+	Command  uint64 `json:"command,omitempty"`
+	redirect *redirect
+	command  *command
+}
+
+// PortFor looks up the current port of the redirect or command, which changes
+// as they are stopped and started.
+//
+// As it is called while routing connections, it must not take the config
+// lock, which is held while split weights are changed.
+func (s *splitMember) PortFor(port uint16) *reverseproxy.Port {
+	if s.redirect != nil {
+		if p := s.redirect.live.Load(); p != nil {
+			return p.PortFor(port)
+		}
+	} else if s.command != nil {
+		if u := s.command.live.Load(); u != nil {
+			return u.PortFor(port)
+		}
+	}
+
+	return nil
+}
+
+type split struct {
+	Members []*splitMember `json:"members"`
+	Weights []uint         `json:"weights"`
+	Pin     bool           `json:"pin"`
+	split   *reverseproxy.Split
+}
+
+// Run enables the split, its members having been checked against the server.
+func (s *split) Run(serv *server) error {
+	members := make([]reverseproxy.SplitMember, len(s.Members))
+
+	for n, m := range s.Members {
+		if m.Redirect != 0 && m.Command != 0 {
+			return ErrInvalidSplitMember
+		} else if _, ok := serv.Redirects[m.Redirect]; m.Redirect != 0 && !ok {
+			return ErrUnknownRedirect
+		} else if _, ok := serv.Commands[m.Command]; m.Redirect == 0 && !ok {
+			return ErrUnknownCommand
+		}
+
+		if m.redirect == nil && m.command == nil {
+			m.redirect = serv.Redirects[m.Redirect]
+			m.command = serv.Commands[m.Command]
+		}
+
+		members[n] = m
+	}
+
+	rs := reverseproxy.NewSplit(s.Pin, members...)
+
+	if len(s.Weights) > 0 {
+		if err := rs.SetWeights(s.Weights...); err != nil {
+			rs.Close()
+
+			return err
+		}
+	}
+
+	s.split = rs
+
+	return nil
+}
+
+func (s *split) Shutdown() {
+	if s.split != nil {
+		s.split.Close()
+
+		s.split = nil
+	}
+}
+
+var ErrInvalidSplitMember = errors.New("split member must be either a redirect or a command")
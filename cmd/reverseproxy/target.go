@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+
+	"vimagination.zapto.org/reverseproxy"
+)
+
+// serviceTarget identifies a single redirect or command of a server in an RPC
+// request.
+type serviceTarget struct {
+	Server   string `json:"server"`
+	Redirect uint64 `json:"redirect,omitempty"`
+	Command  uint64 `json:"command,omitempty"`
+}
+
+// status returns the Status of the running redirect or command.
+func (t *serviceTarget) status() (reverseproxy.Status, error) {
+	serv, ok := config.Servers[t.Server]
+	if !ok {
+		return reverseproxy.Status{}, ErrNoServer
+	}
+
+	if t.Redirect != 0 && t.Command != 0 {
+		return reverseproxy.Status{}, ErrInvalidTarget
+	} else if t.Redirect != 0 {
+		r, ok := serv.Redirects[t.Redirect]
+		if !ok {
+			return reverseproxy.Status{}, ErrUnknownRedirect
+		} else if r.port == nil {
+			return reverseproxy.Status{}, nil
+		}
+
+		return r.port.Status(), nil
+	}
+
+	c, ok := serv.Commands[t.Command]
+	if !ok {
+		return reverseproxy.Status{}, ErrUnknownCommand
+	} else if c.unixCmd == nil {
+		return reverseproxy.Status{}, nil
+	}
+
+	return c.unixCmd.Status(), nil
+}
+
+var ErrInvalidTarget = errors.New("target must be a redirect or a command")
@@ -11,9 +11,9 @@ import (
 	"net/smtp"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 
-	"golang.org/x/crypto/acme/autocert"
 	"vimagination.zapto.org/form"
 	"vimagination.zapto.org/httpgzip"
 	"vimagination.zapto.org/reverseproxy/unixconn"
@@ -63,6 +63,18 @@ func (s *serverNames) Set(serverName string) error {
 	return nil
 }
 
+// GetCertificate retrieves the certificate for a whitelisted server name from
+// the reverse proxy.
+func (s serverNames) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !slices.Contains(s, hello.ServerName) {
+		return nil, errUnknownServerName
+	}
+
+	return unixconn.GetCertificate(hello)
+}
+
+var errUnknownServerName = errors.New("unknown server name")
+
 type contact struct {
 	Template *template.Template
 	From, To string
@@ -169,14 +181,9 @@ func run() error {
 			return errors.New("unable to open port 443")
 		}
 
-		leManager := &autocert.Manager{
-			Prompt:     autocert.AcceptTOS,
-			Cache:      autocert.DirCache("./certcache/"),
-			HostPolicy: autocert.HostWhitelist(sNames...),
-		}
-		server.Handler = leManager.HTTPHandler(http2https{server.Handler})
+		server.Handler = http2https{server.Handler}
 		server.TLSConfig = &tls.Config{
-			GetCertificate: leManager.GetCertificate,
+			GetCertificate: sNames.GetCertificate,
 			NextProtos:     []string{"h2", "http/1.1"},
 		}
 
@@ -0,0 +1,209 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ConnectAuth authorises a tunnel using the credentials from the Basic
+// Proxy-Authorization header of a CONNECT request.
+type ConnectAuth func(username, password string) bool
+
+var connectPorts = make(map[uint16]ConnectAuth)
+
+// SetConnectTunnel enables or disables the tunnelling of CONNECT requests on
+// the given plaintext port.
+//
+// When enabled, the authority of a CONNECT request is matched against the
+// services on the port and the client, once sent a '200 Connection
+// Established' response, is passed to the matching service, which only sees
+// the bytes sent through the tunnel.
+//
+// As services are matched by name alone, only tunnels to the port itself are
+// accepted; a request for any other port, such as 'CONNECT a.example:22' on
+// port 443, is refused with a '403 Forbidden' response.
+//
+// When auth is not nil, requests without Basic credentials that it accepts
+// are refused with a '407 Proxy Authentication Required' response.
+func SetConnectTunnel(port uint16, enabled bool, auth ConnectAuth) {
+	lMu.Lock()
+
+	if enabled {
+		connectPorts[port] = auth
+	} else {
+		delete(connectPorts, port)
+	}
+
+	lMu.Unlock()
+}
+
+// BasicAuth returns a ConnectAuth that accepts the given usernames and
+// passwords.
+//
+// The SHA-256 hashes of the credentials are compared against those of every
+// user, so that the time taken reveals neither whether a user exists nor the
+// length of a password.
+func BasicAuth(users map[string]string) ConnectAuth {
+	u := make([][2][sha256.Size]byte, 0, len(users))
+
+	for username, password := range users {
+		u = append(u, [2][sha256.Size]byte{sha256.Sum256([]byte(username)), sha256.Sum256([]byte(password))})
+	}
+
+	return func(username, password string) bool {
+		user := sha256.Sum256([]byte(username))
+		pass := sha256.Sum256([]byte(password))
+		match := 0
+
+		for _, creds := range u {
+			match |= subtle.ConstantTimeCompare(creds[0][:], user[:]) & subtle.ConstantTimeCompare(creds[1][:], pass[:])
+		}
+
+		return match == 1
+	}
+}
+
+func (l *listener) connectAuth() (ConnectAuth, bool) {
+	lMu.RLock()
+	defer lMu.RUnlock()
+
+	auth, ok := connectPorts[l.port]
+
+	return auth, ok
+}
+
+// tunnelling returns whether the plaintext HTTP request is a CONNECT that
+// should be tunnelled by the proxy.
+func (l *listener) tunnelling(buf []byte) bool {
+	if _, ok := l.connectAuth(); !ok {
+		return false
+	}
+
+	var h httpParser
+
+	done, err := h.parse(buf)
+
+	return done && err == nil && string(h.method) == http.MethodConnect
+}
+
+// tunnel authorises a CONNECT request and passes the tunnel to the service for
+// the requested authority.
+func (l *listener) tunnel(c *net.TCPConn, buf []byte, serviceName string) error {
+	var h httpParser
+
+	h.parse(buf)
+
+	if auth, _ := l.connectAuth(); auth != nil && !proxyAuthorised(buf[:h.pos], auth) {
+		c.Write(l.authenticationRequired(serviceName))
+		closeWait(c)
+		c.Close()
+
+		return nil
+	}
+
+	if _, p, err := net.SplitHostPort(string(h.authority)); err != nil || p != strconv.Itoa(int(l.port)) {
+		return &HTTPError{Code: http.StatusForbidden, Err: ErrTunnelPort}
+	}
+
+	port := l.route(serviceName, "", nil, remoteIP(c))
+	if port == nil {
+		return ErrNoService
+	}
+
+	buf = buf[h.pos:]
+
+	ds, ok := port.service.(dialService)
+	if !ok {
+		if _, err := c.Write(connectEstablished); err != nil {
+			c.Close()
+
+			return nil
+		}
+
+		if err := port.Transfer(buf, c); err != nil {
+			c.Close()
+		}
+
+		return nil
+	}
+
+	backend, err := ds.dial()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrServiceUnavailable, err)
+	}
+
+	if _, err := c.Write(connectEstablished); err != nil {
+		backend.Close()
+		c.Close()
+
+		return nil
+	}
+
+	if len(buf) > 0 {
+		if _, err := backend.Write(buf); err != nil {
+			backend.Close()
+			c.Close()
+
+			return nil
+		}
+	}
+
+	go pipeTunnel(backend, c)
+	go pipeTunnel(c, backend)
+
+	return nil
+}
+
+func pipeTunnel(a, b net.Conn) {
+	io.Copy(a, b)
+	a.Close()
+	b.Close()
+}
+
+func proxyAuthorised(head []byte, auth ConnectAuth) bool {
+	r := splitHead(head)
+
+	for _, value := range r.remove("Proxy-Authorization") {
+		scheme, credentials, _ := bytes.Cut(value, []byte{' '})
+		if !strings.EqualFold(string(scheme), "Basic") {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(string(trimOWS(credentials)))
+		if err != nil {
+			continue
+		}
+
+		if username, password, ok := strings.Cut(string(decoded), ":"); ok && auth(username, password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *listener) authenticationRequired(serviceName string) []byte {
+	resp := l.errorResponse(http.StatusProxyAuthRequired, serviceName)
+	eol := bytes.IndexByte(resp, '\n') + 1
+
+	return append(append(append(make([]byte, 0, len(resp)+len(proxyAuthenticate)), resp[:eol]...), proxyAuthenticate...), resp[eol:]...)
+}
+
+var (
+	connectEstablished = []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
+	proxyAuthenticate  = []byte("Proxy-Authenticate: Basic realm=\"proxy\"\r\n")
+)
+
+// Errors.
+var (
+	ErrTunnelPort = errors.New("tunnel to another port not allowed")
+)
@@ -0,0 +1,148 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestConnectTunnel(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, l.Addr())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	SetConnectTunnel(pa, true, BasicAuth(map[string]string{"user": "pass"}))
+
+	defer SetConnectTunnel(pa, false, nil)
+
+	portA := fmt.Sprintf(":%d", pa)
+	auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")) + "\r\n"
+	badAuth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("user:wrong")) + "\r\n"
+
+	for n, test := range [...]struct {
+		Send   string
+		Status int
+		Echo   string
+	}{
+		{"CONNECT " + aDomain + portA + " HTTP/1.1\r\nHost: " + aDomain + portA + "\r\n\r\n", http.StatusProxyAuthRequired, ""},
+		{"CONNECT " + aDomain + portA + " HTTP/1.1\r\nHost: " + aDomain + portA + "\r\n" + badAuth + "\r\n", http.StatusProxyAuthRequired, ""},
+		{"CONNECT " + aDomain + portA + " HTTP/1.1\r\nHost: " + aDomain + portA + "\r\n" + auth + "\r\nhello", http.StatusOK, "hello"},
+		{"CONNECT " + bDomain + portA + " HTTP/1.1\r\nHost: " + bDomain + portA + "\r\n" + auth + "\r\n", http.StatusMisdirectedRequest, ""},
+		{"CONNECT " + aDomain + ":22 HTTP/1.1\r\nHost: " + aDomain + ":22\r\n" + auth + "\r\n", http.StatusForbidden, ""},
+	} {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		c.Write([]byte(test.Send))
+
+		br := bufio.NewReader(c)
+
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if resp.StatusCode != test.Status {
+			t.Errorf("test %d: expecting status %d, got %d", n+1, test.Status, resp.StatusCode)
+		} else if test.Status == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("test %d: expecting Proxy-Authenticate header", n+1)
+		} else if test.Echo != "" {
+			buf := make([]byte, len(test.Echo))
+
+			if _, err := io.ReadFull(br, buf); err != nil {
+				t.Errorf("test %d: unexpected error: %s", n+1, err)
+			} else if string(buf) != test.Echo {
+				t.Errorf("test %d: expecting echo %q, got %q", n+1, test.Echo, buf)
+			}
+		}
+
+		c.Close()
+	}
+
+	pb := getUnusedPort()
+	sa := make(testService)
+
+	q, err := addPort(pb, testServiceA{sa})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	SetConnectTunnel(pb, true, nil)
+
+	defer SetConnectTunnel(pb, false, nil)
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pb))
+	if err != nil {
+		t.Fatalf("test 6: unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	c.Write([]byte(fmt.Sprintf("CONNECT %[1]s:%[2]d HTTP/1.1\r\nHost: %[1]s:%[2]d\r\n\r\ndata", aDomain, pb)))
+
+	if data := <-sa; string(data.buf) != "data" {
+		t.Errorf("test 6: expecting buf %q, got %q", "data", data.buf)
+	} else {
+		data.conn.Close()
+	}
+
+	if resp, err := io.ReadAll(c); err != nil {
+		t.Errorf("test 7: unexpected error: %s", err)
+	} else if !bytes.Equal(resp, connectEstablished) {
+		t.Errorf("test 7: expecting response %q, got %q", connectEstablished, resp)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	auth := BasicAuth(map[string]string{"user": "pass", "other": "longer password"})
+
+	for n, test := range [...]struct {
+		Username, Password string
+		Accepted           bool
+	}{
+		{"user", "pass", true},
+		{"other", "longer password", true},
+		{"user", "longer password", false},
+		{"user", "pas", false},
+		{"user", "", false},
+		{"nobody", "pass", false},
+		{"", "", false},
+	} {
+		if accepted := auth(test.Username, test.Password); accepted != test.Accepted {
+			t.Errorf("test %d: expecting accepted %v, got %v", n+1, test.Accepted, accepted)
+		}
+	}
+}
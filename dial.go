@@ -0,0 +1,312 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// Dialer is used by a redirect to connect to its target.
+//
+// A *net.Dialer can be used to set a connect timeout or the source address of
+// direct connections.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// DialVia sets the Dialer used by a redirect to connect to its target.
+func DialVia(d Dialer) Option {
+	return func(o *options) {
+		o.dialer = d
+	}
+}
+
+// SOCKS5Dialer connects to targets through a SOCKS5 proxy, as described in
+// RFC 1928, optionally authenticating with a username and password, as
+// described in RFC 1929.
+type SOCKS5Dialer struct {
+	// Proxy is the address of the SOCKS5 proxy.
+	Proxy string
+
+	// Username and Password, when set, are used to authenticate with the
+	// proxy.
+	Username, Password string
+
+	// Dialer, when not nil, is used to connect to the proxy, and its Timeout
+	// also bounds the negotiation with the proxy. Without a Timeout, both are
+	// bounded by a default of ten seconds.
+	Dialer *net.Dialer
+}
+
+const (
+	socksVersion        = 5
+	socksAuthVersion    = 1
+	socksNoAuth         = 0
+	socksUserPass       = 2
+	socksNoAcceptable   = 0xff
+	socksConnect        = 1
+	socksAddrIPv4       = 1
+	socksAddrDomain     = 3
+	socksAddrIPv6       = 4
+	socksSucceeded      = 0
+	maxSOCKSFieldLength = 255
+	proxyTimeout        = 10 * time.Second
+)
+
+// Dial connects to the address through the SOCKS5 proxy.
+func (s *SOCKS5Dialer) Dial(network, address string) (net.Conn, error) {
+	request, err := socksConnectRequest(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dialProxy(s.Dialer, s.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.negotiate(c, request); err != nil {
+		c.Close()
+
+		return nil, err
+	}
+
+	c.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+func (s *SOCKS5Dialer) negotiate(c net.Conn, request []byte) error {
+	methods := []byte{socksVersion, 1, socksNoAuth}
+
+	if s.Username != "" {
+		if len(s.Username) > maxSOCKSFieldLength || len(s.Password) > maxSOCKSFieldLength {
+			return ErrProxyAuthentication
+		}
+
+		methods = []byte{socksVersion, 2, socksNoAuth, socksUserPass}
+	}
+
+	if _, err := c.Write(methods); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return err
+	} else if reply[0] != socksVersion {
+		return ErrInvalidProxyResponse
+	}
+
+	switch reply[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if s.Username == "" {
+			return ErrProxyAuthentication
+		}
+
+		auth := append(append([]byte{socksAuthVersion, byte(len(s.Username))}, s.Username...), byte(len(s.Password)))
+
+		if _, err := c.Write(append(auth, s.Password...)); err != nil {
+			return err
+		} else if _, err := io.ReadFull(c, reply[:]); err != nil {
+			return err
+		} else if reply[1] != socksSucceeded {
+			return ErrProxyAuthentication
+		}
+	case socksNoAcceptable:
+		return ErrProxyAuthentication
+	default:
+		return ErrInvalidProxyResponse
+	}
+
+	if _, err := c.Write(request); err != nil {
+		return err
+	}
+
+	return readSOCKSReply(c)
+}
+
+func socksConnectRequest(network, address string) ([]byte, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ErrUnsupportedNetwork
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+
+	if ip, err := netip.ParseAddr(host); err != nil {
+		if len(host) > maxSOCKSFieldLength {
+			return nil, ErrInvalidHost
+		}
+
+		request = append(append(request, socksAddrDomain, byte(len(host))), host...)
+	} else if ip.Is4() {
+		request = append(append(request, socksAddrIPv4), ip.AsSlice()...)
+	} else {
+		request = append(append(request, socksAddrIPv6), ip.AsSlice()...)
+	}
+
+	return append(request, byte(port>>8), byte(port)), nil
+}
+
+func readSOCKSReply(c net.Conn) error {
+	var reply [5]byte
+
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return err
+	} else if reply[0] != socksVersion {
+		return ErrInvalidProxyResponse
+	} else if reply[1] != socksSucceeded {
+		return fmt.Errorf("%w: SOCKS reply %d", ErrProxyRefused, reply[1])
+	}
+
+	var remaining int
+
+	switch reply[3] {
+	case socksAddrIPv4:
+		remaining = 4 - 1 + 2
+	case socksAddrIPv6:
+		remaining = 16 - 1 + 2
+	case socksAddrDomain:
+		remaining = int(reply[4]) + 2
+	default:
+		return ErrInvalidProxyResponse
+	}
+
+	_, err := io.CopyN(io.Discard, c, int64(remaining))
+
+	return err
+}
+
+// HTTPConnectDialer connects to targets through an HTTP proxy, using CONNECT
+// requests, optionally authenticating with Basic credentials.
+type HTTPConnectDialer struct {
+	// Proxy is the address of the HTTP proxy.
+	Proxy string
+
+	// Username and Password, when set, are sent to the proxy in a
+	// Proxy-Authorization header.
+	Username, Password string
+
+	// Dialer, when not nil, is used to connect to the proxy, and its Timeout
+	// also bounds the CONNECT request. Without a Timeout, both are bounded by
+	// a default of ten seconds.
+	Dialer *net.Dialer
+}
+
+// Dial connects to the address through the HTTP proxy.
+func (h *HTTPConnectDialer) Dial(network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ErrUnsupportedNetwork
+	}
+
+	c, err := dialProxy(h.Dialer, h.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	br, err := h.connect(c, address)
+	if err != nil {
+		c.Close()
+
+		return nil, err
+	}
+
+	c.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, br: br}, nil
+	}
+
+	return c, nil
+}
+
+func (h *HTTPConnectDialer) connect(c net.Conn, address string) (*bufio.Reader, error) {
+	request := append(append(append(append([]byte("CONNECT "), address...), " HTTP/1.1\r\nHost: "...), address...), "\r\n"...)
+
+	if h.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		request = append(append(append(request, "Proxy-Authorization: Basic "...), credentials...), "\r\n"...)
+	}
+
+	if _, err := c.Write(append(request, "\r\n"...)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	p := httpParser{response: true}
+
+	if _, err := readHead(br, &p, maxHeadLength); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.status == http.StatusProxyAuthRequired:
+		return nil, ErrProxyAuthentication
+	case p.status/100 != 2:
+		return nil, fmt.Errorf("%w: HTTP status %d", ErrProxyRefused, p.status)
+	}
+
+	return br, nil
+}
+
+// dialProxy connects to a proxy, setting a deadline for the negotiation with
+// it from the timeout of the dialer, or proxyTimeout when it has none.
+func dialProxy(d *net.Dialer, proxy string) (net.Conn, error) {
+	if d == nil {
+		d = &net.Dialer{Timeout: proxyTimeout}
+	} else if d.Timeout == 0 {
+		dc := *d
+		dc.Timeout = proxyTimeout
+		d = &dc
+	}
+
+	c, err := d.Dial("tcp", proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetDeadline(time.Now().Add(d.Timeout))
+
+	return c, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.br.Read(p)
+}
+
+// Errors.
+var (
+	ErrUnsupportedNetwork   = errors.New("unsupported network")
+	ErrInvalidHost          = errors.New("invalid host")
+	ErrProxyAuthentication  = errors.New("proxy authentication failed")
+	ErrProxyRefused         = errors.New("proxy refused connection")
+	ErrInvalidProxyResponse = errors.New("invalid proxy response")
+)
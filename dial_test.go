@@ -0,0 +1,216 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func listenTest(t *testing.T, handler func(net.Conn)) net.Addr {
+	t.Helper()
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go handler(c)
+		}
+	}()
+
+	return l.Addr()
+}
+
+func echoConn(c net.Conn) {
+	io.Copy(c, c)
+	c.Close()
+}
+
+func pipeConns(a, b net.Conn) {
+	go pipeTunnel(a, b)
+	pipeTunnel(b, a)
+}
+
+func socksProxy(c net.Conn) {
+	defer c.Close()
+
+	var buf [262]byte
+
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	} else if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return
+	}
+
+	c.Write([]byte{socksVersion, socksUserPass})
+
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+
+	username := make([]byte, buf[1])
+	io.ReadFull(c, username)
+	io.ReadFull(c, buf[:1])
+
+	password := make([]byte, buf[0])
+	io.ReadFull(c, password)
+
+	if string(username) != "user" || string(password) != "pass" {
+		c.Write([]byte{socksAuthVersion, 1})
+
+		return
+	}
+
+	c.Write([]byte{socksAuthVersion, socksSucceeded})
+
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return
+	}
+
+	var host string
+
+	switch buf[3] {
+	case socksAddrIPv4:
+		io.ReadFull(c, buf[:4])
+
+		host = net.IP(buf[:4]).String()
+	case socksAddrIPv6:
+		io.ReadFull(c, buf[:16])
+
+		host = net.IP(buf[:16]).String()
+	case socksAddrDomain:
+		io.ReadFull(c, buf[:1])
+		io.ReadFull(c, buf[1:1+buf[0]])
+
+		host = string(buf[1 : 1+buf[0]])
+	default:
+		return
+	}
+
+	io.ReadFull(c, buf[:2])
+
+	p, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1]))))
+	if err != nil {
+		c.Write([]byte{socksVersion, 5, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+
+		return
+	}
+
+	c.Write([]byte{socksVersion, socksSucceeded, 0, socksAddrIPv4, 127, 0, 0, 1, 0, 0})
+	pipeConns(c, p)
+}
+
+func httpProxy(c net.Conn) {
+	defer c.Close()
+
+	r, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		return
+	}
+
+	if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+		c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+
+		return
+	}
+
+	p, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+
+		return
+	}
+
+	c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	pipeConns(c, p)
+}
+
+func TestDialers(t *testing.T) {
+	echo := listenTest(t, echoConn).String()
+	socks := listenTest(t, socksProxy).String()
+	httpP := listenTest(t, httpProxy).String()
+	d := &net.Dialer{Timeout: time.Second}
+
+	for n, test := range [...]struct {
+		Dialer Dialer
+		Err    error
+	}{
+		{&SOCKS5Dialer{Proxy: socks, Username: "user", Password: "pass", Dialer: d}, nil},
+		{&SOCKS5Dialer{Proxy: socks, Username: "user", Password: "wrong"}, ErrProxyAuthentication},
+		{&HTTPConnectDialer{Proxy: httpP, Username: "user", Password: "pass", Dialer: d}, nil},
+		{&HTTPConnectDialer{Proxy: httpP}, ErrProxyAuthentication},
+	} {
+		c, err := test.Dialer.Dial("tcp", echo)
+		if !errors.Is(err, test.Err) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		c.Write([]byte("hello"))
+
+		var buf [5]byte
+
+		if _, err := io.ReadFull(c, buf[:]); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(buf[:]) != "hello" {
+			t.Errorf("test %d: expecting %q, got %q", n+1, "hello", buf)
+		}
+
+		c.Close()
+	}
+}
+
+func TestRedirectDialVia(t *testing.T) {
+	echo, err := net.ResolveTCPAddr("tcp", listenTest(t, echoConn).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	socks := listenTest(t, socksProxy).String()
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, echo, DialVia(&SOCKS5Dialer{Proxy: socks, Username: "user", Password: "pass"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	const req = "GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"
+
+	c.Write([]byte(req))
+
+	buf := make([]byte, len(req))
+
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(buf) != req {
+		t.Errorf("test 1: expecting %q, got %q", req, buf)
+	}
+}
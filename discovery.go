@@ -0,0 +1,408 @@
+package reverseproxy
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSRVRefresh  = 30 * time.Second
+	fileCheckInterval  = time.Second
+	srvLookupTimeout   = 5 * time.Second
+	backendDialTimeout = 5 * time.Second
+)
+
+// Backend is a target of a redirect, provided by a Discovery.
+//
+// Backends with a lower Priority are tried first, with those of the same
+// Priority tried in a random order weighted by their Weight, as described in
+// RFC 2782.
+type Backend struct {
+	Addr     string `json:"addr"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+}
+
+// UnmarshalJSON allows a Backend to be given as either an object or a plain
+// 'host:port' string.
+func (b *Backend) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*b = Backend{}
+
+		return json.Unmarshal(data, &b.Addr)
+	}
+
+	type backend Backend
+
+	return json.Unmarshal(data, (*backend)(b))
+}
+
+// Discovery provides the current backends of a redirect, which it may change at
+// any time.
+//
+// When an error is returned with backends, the backends are still used, which
+// allows a Discovery to keep the last known set when a refresh fails.
+type Discovery interface {
+	Backends() ([]Backend, error)
+}
+
+// AddDiscoveredRedirect sets a port to be redirected to the backends provided
+// by the Discovery, which is consulted for each connection, so that changes to
+// the set of backends take effect without affecting existing connections.
+//
+// As there is no single target, an OriginateTLS config should have a
+// ServerName set.
+//
+// Backends are tried in turn, with each attempt limited to five seconds when
+// connecting directly, or through a *net.Dialer without a Timeout.
+func AddDiscoveredRedirect(serviceName MatchServiceName, port uint16, discovery Discovery, opts ...Option) (*Port, error) {
+	o := makeOptions(opts)
+
+	return addPort(port, &addrService{
+		MatchServiceName: serviceName,
+		Addr:             HostAddr{Net: "tcp"},
+		tlsConfig:        o.upstreamTLS,
+		dialer:           o.dialer,
+		discovery:        discovery,
+		mirror:           o.newMirror(),
+	}, opts...)
+}
+
+// backendService is implemented by services whose targets are discovered.
+type backendService interface {
+	backends() []string
+}
+
+// dialBackends connects to the first available of the discovered backends.
+func (a *addrService) dialBackends() (net.Conn, error) {
+	backends, err := a.discovery.Backends()
+	if len(backends) == 0 {
+		if err == nil {
+			err = ErrNoBackends
+		}
+
+		return nil, err
+	}
+
+	for _, b := range orderBackends(backends) {
+		var c net.Conn
+
+		if c, err = a.dialBackend(a.Network(), b.Addr); err == nil {
+			return c, nil
+		}
+	}
+
+	return nil, err
+}
+
+// dialBackend connects to a discovered backend, bounding the attempt so that
+// an unreachable backend does not hold up trying the others.
+func (a *addrService) dialBackend(network, address string) (net.Conn, error) {
+	switch d := a.dialer.(type) {
+	case nil:
+		return net.DialTimeout(network, address, backendDialTimeout)
+	case *net.Dialer:
+		if d.Timeout == 0 {
+			bounded := *d
+			bounded.Timeout = backendDialTimeout
+
+			return bounded.Dial(network, address)
+		}
+	}
+
+	return a.dialAddr(network, address)
+}
+
+func (a *addrService) backends() []string {
+	if a.discovery == nil {
+		return nil
+	}
+
+	backends, _ := a.discovery.Backends()
+	addrs := make([]string, len(backends))
+
+	for n, b := range backends {
+		addrs[n] = b.Addr
+	}
+
+	return addrs
+}
+
+// orderBackends returns the backends in the order they should be tried.
+func orderBackends(backends []Backend) []Backend {
+	ordered := slices.Clone(backends)
+
+	slices.SortStableFunc(ordered, func(a, b Backend) int {
+		if c := cmp.Compare(a.Priority, b.Priority); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(min(a.Weight, 1), min(b.Weight, 1))
+	})
+
+	for start := 0; start < len(ordered); {
+		end := start + 1
+
+		for end < len(ordered) && ordered[end].Priority == ordered[start].Priority {
+			end++
+		}
+
+		weightedShuffle(ordered[start:end])
+
+		start = end
+	}
+
+	return ordered
+}
+
+// weightedShuffle orders backends of the same priority using the selection
+// algorithm from RFC 2782, with those of zero weight sorted first.
+func weightedShuffle(backends []Backend) {
+	for n := range backends {
+		total := 0
+
+		for _, b := range backends[n:] {
+			total += int(b.Weight)
+		}
+
+		r := rand.IntN(total + 1)
+		sum := 0
+
+		for m, b := range backends[n:] {
+			if sum += int(b.Weight); sum >= r {
+				backends[n], backends[n+m] = backends[n+m], backends[n]
+
+				break
+			}
+		}
+	}
+}
+
+// SRVDiscovery provides backends from the DNS SRV records of a service, which
+// are looked up again in the background once the refresh interval has passed.
+type SRVDiscovery struct {
+	service, proto, name string
+	refresh              time.Duration
+	lookupSRV            func(context.Context, string, string, string) (string, []*net.SRV, error)
+
+	mu         sync.Mutex
+	expires    time.Time
+	refreshing chan struct{}
+	resolved   bool
+	backends   []Backend
+	err        error
+}
+
+// NewSRVDiscovery creates an SRVDiscovery for the records of
+// _service._proto.name, such as '_http._tcp.example.com'. A refresh of zero
+// uses a default interval of 30 seconds.
+func NewSRVDiscovery(service, proto, name string, refresh time.Duration) *SRVDiscovery {
+	if refresh <= 0 {
+		refresh = defaultSRVRefresh
+	}
+
+	return &SRVDiscovery{
+		service:   service,
+		proto:     proto,
+		name:      name,
+		refresh:   refresh,
+		lookupSRV: net.DefaultResolver.LookupSRV,
+	}
+}
+
+// Backends returns the backends from the last lookup of the SRV records,
+// starting another lookup if the refresh interval has passed.
+//
+// Only the first call waits for the records to be looked up; later calls
+// return the previous backends while a refresh is in progress.
+func (s *SRVDiscovery) Backends() ([]Backend, error) {
+	s.mu.Lock()
+
+	if now := time.Now(); now.After(s.expires) && s.refreshing == nil {
+		s.expires = now.Add(s.refresh)
+		s.refreshing = make(chan struct{})
+
+		go s.update(s.refreshing)
+	}
+
+	refreshing, resolved := s.refreshing, s.resolved
+
+	s.mu.Unlock()
+
+	if !resolved {
+		<-refreshing
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.backends, s.err
+}
+
+func (s *SRVDiscovery) update(done chan struct{}) {
+	backends, err := s.lookup()
+
+	s.mu.Lock()
+
+	if err != nil {
+		s.err = err
+	} else {
+		s.backends = backends
+		s.err = nil
+	}
+
+	s.resolved = true
+	s.refreshing = nil
+
+	s.mu.Unlock()
+
+	close(done)
+}
+
+func (s *SRVDiscovery) lookup() ([]Backend, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+
+	_, records, err := s.lookupSRV(ctx, s.service, s.proto, s.name)
+	if err != nil {
+		return nil, err
+	}
+
+	backends := make([]Backend, 0, len(records))
+
+	for _, r := range records {
+		if target := strings.TrimSuffix(r.Target, "."); target != "" {
+			backends = append(backends, Backend{
+				Addr:     net.JoinHostPort(target, strconv.Itoa(int(r.Port))),
+				Priority: r.Priority,
+				Weight:   r.Weight,
+			})
+		}
+	}
+
+	return backends, nil
+}
+
+// FileDiscovery provides backends from a JSON file, or a directory of them,
+// which is reloaded whenever it changes.
+//
+// Each file holds an array of backends, given either as 'host:port' strings
+// or as Backend objects; in a directory, all files with a '.json' extension
+// are combined.
+type FileDiscovery struct {
+	path string
+
+	mu       sync.Mutex
+	checked  time.Time
+	state    string
+	backends []Backend
+	err      error
+}
+
+// NewFileDiscovery creates a FileDiscovery for the given file or directory.
+func NewFileDiscovery(path string) *FileDiscovery {
+	return &FileDiscovery{path: path}
+}
+
+// Backends returns the backends from the file or directory, reloading them if
+// they have changed since last checked.
+func (f *FileDiscovery) Backends() ([]Backend, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now := time.Now(); now.Sub(f.checked) >= fileCheckInterval {
+		f.checked = now
+
+		if backends, err := f.reload(); err != nil {
+			f.err = err
+		} else if backends != nil {
+			f.backends = backends
+			f.err = nil
+		}
+	}
+
+	return f.backends, f.err
+}
+
+// reload reads the backends if any of the files have changed, returning nil
+// backends if they have not.
+func (f *FileDiscovery) reload() ([]Backend, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{f.path}
+	infos := []os.FileInfo{fi}
+
+	if fi.IsDir() {
+		entries, err := os.ReadDir(f.path)
+		if err != nil {
+			return nil, err
+		}
+
+		files = files[:0]
+		infos = infos[:0]
+
+		for _, e := range entries {
+			if e.Type().IsRegular() && filepath.Ext(e.Name()) == ".json" {
+				info, err := e.Info()
+				if err != nil {
+					return nil, err
+				}
+
+				files = append(files, filepath.Join(f.path, e.Name()))
+				infos = append(infos, info)
+			}
+		}
+	}
+
+	var state strings.Builder
+
+	for n, info := range infos {
+		state.WriteString(files[n])
+		state.WriteString(info.ModTime().String())
+		state.WriteString(strconv.FormatInt(info.Size(), 10))
+	}
+
+	if state.String() == f.state && f.err == nil {
+		return nil, nil
+	}
+
+	backends := []Backend{}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var b []Backend
+
+		if err := json.Unmarshal(data, &b); err != nil {
+			return nil, err
+		}
+
+		backends = append(backends, b...)
+	}
+
+	f.state = state.String()
+
+	return backends, nil
+}
+
+// Errors.
+var (
+	ErrNoBackends = errors.New("no backends available")
+)
@@ -0,0 +1,173 @@
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderBackends(t *testing.T) {
+	backends := []Backend{
+		{Addr: "c", Priority: 2, Weight: 10},
+		{Addr: "a", Priority: 1, Weight: 0},
+		{Addr: "b", Priority: 1, Weight: 5},
+		{Addr: "d", Priority: 3},
+	}
+
+	for n := range 20 {
+		ordered := orderBackends(backends)
+		addrs := make([]string, len(ordered))
+
+		for m, b := range ordered {
+			addrs[m] = b.Addr
+		}
+
+		if addrs[2] != "c" || addrs[3] != "d" || !slices.Contains(addrs[:2], "a") || !slices.Contains(addrs[:2], "b") {
+			t.Errorf("test %d: invalid order: %v", n+1, addrs)
+		}
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	a := listenTest(t, func(c net.Conn) {
+		c.Write([]byte("A"))
+		c.Close()
+	}).(*net.TCPAddr)
+	b := listenTest(t, func(c net.Conn) {
+		c.Write([]byte("B"))
+		c.Close()
+	}).(*net.TCPAddr)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "backends.json")
+	write := func(data string, mod time.Time) {
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		os.Chtimes(file, mod, mod)
+	}
+
+	write(fmt.Sprintf("[%q]", fmt.Sprintf("127.0.0.1:%d", a.Port)), time.Now().Add(-time.Hour))
+
+	fd := NewFileDiscovery(dir)
+	pa := getUnusedPort()
+
+	p, err := AddDiscoveredRedirect(HostName(aDomain), pa, fd)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	read := func() string {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+		if err != nil {
+			return err.Error()
+		}
+
+		defer c.Close()
+
+		c.Write([]byte("GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"))
+
+		buf, _ := io.ReadAll(c)
+
+		return string(buf)
+	}
+
+	if got := read(); got != "A" {
+		t.Errorf("test 1: expecting response %q, got %q", "A", got)
+	}
+
+	write(fmt.Sprintf(`[{"addr": "127.0.0.1:%d", "priority": 1}, {"addr": "127.0.0.1:%d", "priority": 2}]`, b.Port, a.Port), time.Now())
+
+	fd.mu.Lock()
+	fd.checked = time.Time{}
+	fd.mu.Unlock()
+
+	if got := read(); got != "B" {
+		t.Errorf("test 2: expecting response %q, got %q", "B", got)
+	}
+
+	expected := []string{fmt.Sprintf("127.0.0.1:%d", b.Port), fmt.Sprintf("127.0.0.1:%d", a.Port)}
+
+	if backends := p.Status().Backends; !slices.Equal(backends, expected) {
+		t.Errorf("test 3: expecting backends %v, got %v", expected, backends)
+	}
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		records = []*net.SRV{{Target: "a.example.", Port: 80, Priority: 1, Weight: 2}}
+		lookErr error
+		block   = make(chan struct{})
+	)
+
+	close(block)
+
+	s := NewSRVDiscovery("http", "tcp", "example.com", time.Millisecond)
+	s.lookupSRV = func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		mu.Lock()
+		r, err, b := records, lookErr, block
+		mu.Unlock()
+
+		<-b
+
+		return "_" + service + "._" + proto + "." + name, r, err
+	}
+
+	if backends, err := s.Backends(); err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	} else if expected := []Backend{{Addr: "a.example:80", Priority: 1, Weight: 2}}; !slices.Equal(backends, expected) {
+		t.Errorf("test 1: expecting backends %v, got %v", expected, backends)
+	}
+
+	mu.Lock()
+	records = []*net.SRV{{Target: "b.example.", Port: 81}}
+	block = make(chan struct{})
+	mu.Unlock()
+
+	time.Sleep(2 * time.Millisecond)
+
+	if backends, err := s.Backends(); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if len(backends) != 1 || backends[0].Addr != "a.example:80" {
+		t.Errorf("test 2: expecting cached backends while refreshing, got %v", backends)
+	}
+
+	mu.Lock()
+	close(block)
+	mu.Unlock()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if backends, _ := s.Backends(); len(backends) == 1 && backends[0].Addr == "b.example:81" {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("test 3: expecting refreshed backends, got %v", backends)
+		}
+	}
+
+	mu.Lock()
+	lookErr = ErrNoBackends
+	mu.Unlock()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if backends, err := s.Backends(); err != nil {
+			if len(backends) != 1 || backends[0].Addr != "b.example:81" {
+				t.Errorf("test 4: expecting last known backends to be kept, got %v", backends)
+			}
+
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("test 4: expecting lookup error")
+		}
+	}
+}
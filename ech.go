@@ -0,0 +1,370 @@
+package reverseproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"slices"
+)
+
+const (
+	echConfigVersion = 0xfe0d
+	echOuter         = 0
+	echInfoPrefix    = "tls ech\x00"
+	hpkeVersion      = "HPKE-v1"
+	hpkeNonceSize    = 12
+)
+
+// echExtension holds the contents of the encrypted_client_hello extension of an
+// outer ClientHello.
+type echExtension struct {
+	kdf, aead    uint16
+	configID     uint8
+	enc, payload []byte
+}
+
+// parseECHExtension parses an encrypted_client_hello extension, returning nil
+// if it is malformed or is not from an outer ClientHello.
+func parseECHExtension(ext []byte) *echExtension {
+	if len(ext) < 8 || ext[0] != echOuter {
+		return nil
+	}
+
+	e := &echExtension{
+		kdf:      binary.BigEndian.Uint16(ext[1:3]),
+		aead:     binary.BigEndian.Uint16(ext[3:5]),
+		configID: ext[5],
+		enc:      lengthPrefixed(ext[6:], 2),
+	}
+
+	if e.enc == nil {
+		return nil
+	}
+
+	if e.payload = lengthPrefixed(ext[8+len(e.enc):], 2); len(e.payload) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+type hpkeKEM struct {
+	curve ecdh.Curve
+	hash  func() hash.Hash
+	size  int
+}
+
+var (
+	hpkeKEMs = map[uint16]hpkeKEM{
+		0x0010: {ecdh.P256(), sha256.New, sha256.Size},
+		0x0011: {ecdh.P384(), sha512.New384, sha512.Size384},
+		0x0012: {ecdh.P521(), sha512.New, sha512.Size},
+		0x0020: {ecdh.X25519(), sha256.New, sha256.Size},
+	}
+	hpkeKDFs = map[uint16]func() hash.Hash{
+		0x0001: sha256.New,
+		0x0002: sha512.New384,
+		0x0003: sha512.New,
+	}
+	hpkeAEADs = map[uint16]int{
+		0x0001: 16,
+		0x0002: 32,
+	}
+)
+
+// echKey is a parsed ECHConfig with its private key.
+type echKey struct {
+	config     []byte
+	configID   uint8
+	kemID      uint16
+	kem        hpkeKEM
+	privateKey *ecdh.PrivateKey
+	suites     [][2]uint16
+}
+
+func parseECHKey(key tls.EncryptedClientHelloKey) (*echKey, error) {
+	config := key.Config
+
+	if len(config) < 4 || binary.BigEndian.Uint16(config) != echConfigVersion || int(binary.BigEndian.Uint16(config[2:])) != len(config)-4 {
+		return nil, ErrInvalidECHConfig
+	}
+
+	contents := config[4:]
+
+	if len(contents) < 3 {
+		return nil, ErrInvalidECHConfig
+	}
+
+	k := &echKey{
+		config:   slices.Clone(config),
+		configID: contents[0],
+		kemID:    binary.BigEndian.Uint16(contents[1:3]),
+	}
+
+	var ok bool
+
+	if k.kem, ok = hpkeKEMs[k.kemID]; !ok {
+		return nil, ErrUnsupportedECHConfig
+	}
+
+	publicKey := lengthPrefixed(contents[3:], 2)
+	if len(publicKey) == 0 {
+		return nil, ErrInvalidECHConfig
+	}
+
+	suites := lengthPrefixed(contents[5+len(publicKey):], 2)
+	if len(suites) == 0 || len(suites)%4 != 0 {
+		return nil, ErrInvalidECHConfig
+	}
+
+	for ; len(suites) > 0; suites = suites[4:] {
+		k.suites = append(k.suites, [2]uint16{binary.BigEndian.Uint16(suites), binary.BigEndian.Uint16(suites[2:])})
+	}
+
+	privateKey, err := k.kem.curve.NewPrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidECHKey, err)
+	}
+
+	if string(privateKey.PublicKey().Bytes()) != string(publicKey) {
+		return nil, ErrInvalidECHKey
+	}
+
+	k.privateKey = privateKey
+
+	return k, nil
+}
+
+// open decrypts the payload of the extension using HPKE in base mode, as
+// described in RFC 9180, returning the EncodedClientHelloInner.
+func (k *echKey) open(e *echExtension, aad []byte) ([]byte, error) {
+	kdf, ok := hpkeKDFs[e.kdf]
+	if !ok || !slices.Contains(k.suites, [2]uint16{e.kdf, e.aead}) {
+		return nil, ErrUnsupportedECHConfig
+	}
+
+	keySize, ok := hpkeAEADs[e.aead]
+	if !ok {
+		return nil, ErrUnsupportedECHConfig
+	}
+
+	sharedSecret, err := k.decap(e.enc)
+	if err != nil {
+		return nil, err
+	}
+
+	suite := []byte{'H', 'P', 'K', 'E', byte(k.kemID >> 8), byte(k.kemID), byte(e.kdf >> 8), byte(e.kdf), byte(e.aead >> 8), byte(e.aead)}
+
+	pskIDHash, err := labeledExtract(kdf, suite, nil, "psk_id_hash", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	infoHash, err := labeledExtract(kdf, suite, nil, "info_hash", append([]byte(echInfoPrefix), k.config...))
+	if err != nil {
+		return nil, err
+	}
+
+	context := slices.Concat([]byte{0}, pskIDHash, infoHash)
+
+	secret, err := labeledExtract(kdf, suite, sharedSecret, "secret", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := labeledExpand(kdf, suite, secret, "key", context, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := labeledExpand(kdf, suite, secret, "base_nonce", context, hpkeNonceSize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Open(nil, nonce, e.payload, aad)
+}
+
+// decap derives the shared secret from the encapsulated key, using the DHKEM
+// of the config.
+func (k *echKey) decap(enc []byte) ([]byte, error) {
+	pub, err := k.kem.curve.NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	dh, err := k.privateKey.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	suite := []byte{'K', 'E', 'M', byte(k.kemID >> 8), byte(k.kemID)}
+
+	prk, err := labeledExtract(k.kem.hash, suite, nil, "eae_prk", dh)
+	if err != nil {
+		return nil, err
+	}
+
+	return labeledExpand(k.kem.hash, suite, prk, "shared_secret", slices.Concat(enc, k.privateKey.PublicKey().Bytes()), k.kem.size)
+}
+
+func labeledExtract(h func() hash.Hash, suite, salt []byte, label string, ikm []byte) ([]byte, error) {
+	return hkdf.Extract(h, slices.Concat([]byte(hpkeVersion), suite, []byte(label), ikm), salt)
+}
+
+func labeledExpand(h func() hash.Hash, suite, prk []byte, label string, info []byte, length int) ([]byte, error) {
+	labeledInfo := slices.Concat([]byte{byte(length >> 8), byte(length)}, []byte(hpkeVersion), suite, []byte(label), info)
+
+	return hkdf.Expand(h, prk, string(labeledInfo), length)
+}
+
+var echKeys = make(map[uint16][]*echKey)
+
+// SetECHKeys sets the Encrypted Client Hello keys used to decrypt the inner
+// ClientHellos sent on the given port, so that those connections are routed by
+// their real server name instead of the public name of the ECH config.
+//
+// The ClientHello is passed on unchanged, so the services still need the same
+// keys to accept ECH, such as in the EncryptedClientHelloKeys of their
+// tls.Config.
+//
+// Only ClientHellos using the AES-GCM cipher suites of a config can be
+// decrypted; others are treated as though no keys were set.
+//
+// Setting no keys clears those of the port.
+func SetECHKeys(port uint16, keys ...tls.EncryptedClientHelloKey) error {
+	parsed := make([]*echKey, len(keys))
+
+	for n, key := range keys {
+		k, err := parseECHKey(key)
+		if err != nil {
+			return err
+		}
+
+		parsed[n] = k
+	}
+
+	lMu.Lock()
+	defer lMu.Unlock()
+
+	if len(parsed) == 0 {
+		delete(echKeys, port)
+	} else {
+		echKeys[port] = parsed
+	}
+
+	return nil
+}
+
+// ECHBackend marks a service as terminating Encrypted Client Hello for the
+// public name that it matches, so that ClientHellos whose inner ClientHello
+// cannot be decrypted by the proxy are sent to it in preference to any other
+// service matching that name.
+func ECHBackend() Option {
+	return func(o *options) {
+		o.echBackend = true
+	}
+}
+
+// openECH returns the server name from the inner ClientHello of an ECH
+// ClientHello, or an empty string if it cannot be decrypted with the keys of
+// the port.
+func (l *listener) openECH(h *clientHello) string {
+	lMu.RLock()
+	keys := echKeys[l.port]
+	lMu.RUnlock()
+
+	if len(keys) == 0 {
+		return ""
+	}
+
+	aad := h.outerAAD()
+	if aad == nil {
+		return ""
+	}
+
+	for _, k := range keys {
+		if k.configID != h.ech.configID {
+			continue
+		}
+
+		encoded, err := k.open(h.ech, aad)
+		if err != nil {
+			continue
+		}
+
+		var inner clientHello
+
+		if inner.parseBody(encoded) == nil {
+			return inner.serverName
+		}
+	}
+
+	return ""
+}
+
+// outerAAD returns the ClientHelloOuterAAD, which is the ClientHello with the
+// ECH payload replaced by zeros.
+func (h *clientHello) outerAAD() []byte {
+	offset := cap(h.body) - cap(h.ech.payload)
+	if offset < 0 || offset+len(h.ech.payload) > len(h.body) {
+		return nil
+	}
+
+	aad := slices.Clone(h.body)
+
+	clear(aad[offset : offset+len(h.ech.payload)])
+
+	return aad
+}
+
+// routeHello finds the Port for a connection, preferring an ECHBackend
+// matching the public name when the inner ClientHello was not decrypted.
+func (l *listener) routeHello(name, path string, fp *Fingerprint, outer bool, ip net.IP) *Port {
+	if outer {
+		if p := l.matchECHBackend(name); p != nil {
+			return l.split(p, ip)
+		}
+	}
+
+	return l.route(name, path, fp, ip)
+}
+
+func (l *listener) matchECHBackend(name string) *Port {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for p := range l.ports {
+		if p.opts.echBackend && p.MatchService(name) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// Errors.
+var (
+	ErrInvalidECHConfig     = errors.New("invalid ECH config")
+	ErrUnsupportedECHConfig = errors.New("unsupported ECH config")
+	ErrInvalidECHKey        = errors.New("invalid ECH private key")
+)
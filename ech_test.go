@@ -0,0 +1,180 @@
+package reverseproxy
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testECHKey(t *testing.T, publicName string) tls.EncryptedClientHelloKey {
+	t.Helper()
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pub := key.PublicKey().Bytes()
+	contents := append(append([]byte{1, 0x00, 0x20}, u16(len(pub))...), pub...)
+	contents = append(contents, 0, 4, 0, 1, 0, 1)
+	contents = append(append(append(contents, 0, byte(len(publicName))), publicName...), 0, 0)
+	config := append(append([]byte{0xfe, 0x0d}, u16(len(contents))...), contents...)
+
+	return tls.EncryptedClientHelloKey{Config: config, PrivateKey: key.Bytes(), SendAsRetry: true}
+}
+
+func echServer(t *testing.T, key tls.EncryptedClientHelloKey) net.Addr {
+	t.Helper()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates:             []tls.Certificate{testCertificate(t, "secret.example", "public.example")},
+		EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{key},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				if err := c.(*tls.Conn).Handshake(); err == nil {
+					c.Write([]byte(c.(*tls.Conn).ConnectionState().ServerName))
+				}
+
+				c.Close()
+			}()
+		}
+	}()
+
+	return l.Addr()
+}
+
+func dialECH(port uint16, key tls.EncryptedClientHelloKey) (string, bool, error) {
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+		ServerName:                     "secret.example",
+		InsecureSkipVerify:             true,
+		MinVersion:                     tls.VersionTLS13,
+		EncryptedClientHelloConfigList: append(u16(len(key.Config)), key.Config...),
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(time.Second))
+
+	name, err := io.ReadAll(c)
+
+	return string(name), c.ConnectionState().ECHAccepted, err
+}
+
+func TestECHDecrypt(t *testing.T) {
+	key := testECHKey(t, "public.example")
+	backend := echServer(t, key)
+	wrong := listenTest(t, func(c net.Conn) { c.Close() })
+	pa := getUnusedPort()
+
+	if err := SetECHKeys(pa, key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer SetECHKeys(pa)
+
+	p, err := AddRedirect(HostName("secret.example"), pa, backend)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	q, err := AddRedirect(HostName("public.example"), pa, wrong)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	access := make(chan Access, 1)
+
+	SetAccessLog(func(a Access) { access <- a })
+	defer SetAccessLog(nil)
+
+	if name, accepted, err := dialECH(pa, key); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if !accepted {
+		t.Errorf("test 1: expecting ECH to be accepted")
+	} else if name != "secret.example" {
+		t.Errorf("test 1: expecting name %q, got %q", "secret.example", name)
+	}
+
+	if a := <-access; a.ServiceName != "secret.example" {
+		t.Errorf("test 2: expecting service name %q, got %q", "secret.example", a.ServiceName)
+	}
+}
+
+func TestECHBackend(t *testing.T) {
+	key := testECHKey(t, "public.example")
+	backend := echServer(t, key)
+	wrong := listenTest(t, func(c net.Conn) { c.Close() })
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName("public.example"), pa, wrong)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	q, err := AddRedirect(HostName("public.example"), pa, backend, ECHBackend())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	for n := range 5 {
+		if name, accepted, err := dialECH(pa, key); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !accepted {
+			t.Errorf("test %d: expecting ECH to be accepted", n+1)
+		} else if name != "secret.example" {
+			t.Errorf("test %d: expecting name %q, got %q", n+1, "secret.example", name)
+		}
+	}
+}
+
+func TestSetECHKeys(t *testing.T) {
+	key := testECHKey(t, "public.example")
+	other := testECHKey(t, "public.example")
+
+	for n, test := range [...]struct {
+		Key tls.EncryptedClientHelloKey
+		Err error
+	}{
+		{key, nil},
+		{tls.EncryptedClientHelloKey{Config: key.Config[:len(key.Config)-1], PrivateKey: key.PrivateKey}, ErrInvalidECHConfig},
+		{tls.EncryptedClientHelloKey{Config: key.Config, PrivateKey: other.PrivateKey}, ErrInvalidECHKey},
+		{tls.EncryptedClientHelloKey{Config: key.Config, PrivateKey: key.PrivateKey[1:]}, ErrInvalidECHKey},
+		{tls.EncryptedClientHelloKey{Config: append(append([]byte{}, key.Config[:5]...), append([]byte{0, 0x42}, key.Config[7:]...)...), PrivateKey: key.PrivateKey}, ErrUnsupportedECHConfig},
+	} {
+		if err := SetECHKeys(1, test.Key); !errors.Is(err, test.Err) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		}
+	}
+
+	SetECHKeys(1)
+}
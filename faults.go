@@ -0,0 +1,277 @@
+package reverseproxy
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Faults describes the failures injected into the connections passed to a
+// Port, as set with Port.SetFaults, for testing the resilience of clients.
+type Faults struct {
+	// Latency delays each connection before it is passed to the service.
+	Latency time.Duration
+
+	// Bandwidth limits the rate, in bytes per second, at which data is passed
+	// in each direction. Zero is unlimited.
+	Bandwidth uint64
+
+	// ResetRate is the probability, from 0 to 1, that a connection is reset
+	// once ResetAfter bytes, counting both directions, have been passed.
+	ResetRate  float64
+	ResetAfter uint64
+
+	// RefuseRate is the probability, from 0 to 1, that a connection is reset
+	// without being passed to the service.
+	RefuseRate float64
+
+	// CorruptFirstByte inverts the bits of the first byte sent by the client.
+	CorruptFirstByte bool
+
+	// Expires, when not zero, is the time after which the Faults are no
+	// longer applied.
+	Expires time.Time
+}
+
+// SetFaults starts injecting the given Faults into new connections to the
+// Port, replacing any set previously. A nil Faults stops the injection.
+//
+// Faults are not applied to requests forwarded individually with
+// SetHTTPRouting, or to CONNECT tunnels.
+func (p *Port) SetFaults(f *Faults) {
+	if f == nil {
+		p.faults.Store(nil)
+	} else {
+		fc := *f
+
+		p.faults.Store(&fc)
+	}
+}
+
+// Faults returns the Faults currently applied to the Port, or nil if there are
+// none.
+func (p *Port) Faults() *Faults {
+	f := p.activeFaults()
+	if f == nil {
+		return nil
+	}
+
+	fc := *f
+
+	return &fc
+}
+
+func (p *Port) activeFaults() *Faults {
+	f := p.faults.Load()
+	if f != nil && !f.Expires.IsZero() && time.Now().After(f.Expires) {
+		p.faults.CompareAndSwap(f, nil)
+
+		return nil
+	}
+
+	return f
+}
+
+// SetFaults sets the Faults for all current and future ports of the command.
+func (u *UnixCmd) SetFaults(f *Faults) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.faults = f
+
+	for _, p := range u.open {
+		p.SetFaults(f)
+	}
+}
+
+// Transfer passes the connection to the service, injecting any Faults.
+//
+// A connection refused by the Faults is reset, and ErrFaultRefused returned.
+// The Latency, and the Bandwidth limit on the data already read, are applied
+// before the connection is passed on, so Transfer does not return until they
+// have elapsed; the proxy calls it on a goroutine dedicated to the connection,
+// so other connections are not held up.
+func (p *Port) Transfer(buf []byte, c *net.TCPConn) error {
+	f := p.activeFaults()
+	if f == nil {
+		return p.service.Transfer(buf, c)
+	}
+
+	cs, ok := p.service.(connService)
+	if !ok {
+		return p.service.Transfer(buf, c)
+	}
+
+	buf, conn, err := f.apply(buf, c)
+	if err != nil {
+		return err
+	}
+
+	return cs.transferConn(buf, conn, p.port)
+}
+
+// apply injects the connection level faults, returning the buffer and a
+// connection that injects the stream level faults, or ErrFaultRefused if the
+// connection was refused.
+func (f *Faults) apply(buf []byte, c net.Conn) ([]byte, net.Conn, error) {
+	if f.RefuseRate > 0 && rand.Float64() < f.RefuseRate {
+		resetConn(c)
+
+		return nil, nil, ErrFaultRefused
+	}
+
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+
+	corrupt := f.CorruptFirstByte
+
+	if corrupt && len(buf) > 0 {
+		buf = append([]byte{^buf[0]}, buf[1:]...)
+		corrupt = false
+	}
+
+	reset := f.ResetRate > 0 && rand.Float64() < f.ResetRate
+
+	if !corrupt && !reset && f.Bandwidth == 0 {
+		return buf, c, nil
+	}
+
+	fc := &faultConn{
+		Conn:    c,
+		corrupt: corrupt,
+		reset:   reset,
+		limit:   f.ResetAfter,
+	}
+
+	if f.Bandwidth > 0 {
+		fc.read = &throttle{rate: f.Bandwidth}
+		fc.write = &throttle{rate: f.Bandwidth}
+	}
+
+	fc.passed.Add(uint64(len(buf)))
+	fc.read.wait(len(buf))
+
+	return buf, fc, nil
+}
+
+func resetConn(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+
+	c.Close()
+}
+
+type faultConn struct {
+	net.Conn
+	corrupt     bool
+	reset       bool
+	limit       uint64
+	passed      atomic.Uint64
+	read, write *throttle
+}
+
+func (f *faultConn) Read(p []byte) (int, error) {
+	p, err := f.allow(p, f.read)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := f.Conn.Read(p)
+
+	if n > 0 && f.corrupt {
+		p[0] = ^p[0]
+		f.corrupt = false
+	}
+
+	f.passed.Add(uint64(n))
+	f.read.wait(n)
+
+	return n, err
+}
+
+func (f *faultConn) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) > 0 {
+		q, err := f.allow(p, f.write)
+		if err != nil {
+			return written, err
+		}
+
+		f.write.wait(len(q))
+
+		n, err := f.Conn.Write(q)
+		written += n
+
+		f.passed.Add(uint64(n))
+
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// allow limits the data to be passed by the bandwidth and the number of bytes
+// remaining before a reset, resetting the connection when none remain.
+func (f *faultConn) allow(p []byte, t *throttle) ([]byte, error) {
+	p = t.limit(p)
+
+	if !f.reset {
+		return p, nil
+	}
+
+	passed := f.passed.Load()
+
+	if passed >= f.limit {
+		resetConn(f.Conn)
+
+		return nil, ErrFaultReset
+	}
+
+	if remaining := f.limit - passed; uint64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	return p, nil
+}
+
+type throttle struct {
+	rate uint64
+	next time.Time
+}
+
+func (t *throttle) limit(p []byte) []byte {
+	if t == nil || uint64(len(p)) <= t.rate {
+		return p
+	}
+
+	return p[:t.rate]
+}
+
+func (t *throttle) wait(n int) {
+	if t == nil || n <= 0 {
+		return
+	}
+
+	if now := time.Now(); t.next.Before(now) {
+		t.next = now
+	}
+
+	t.next = t.next.Add(time.Duration(uint64(n) * uint64(time.Second) / t.rate))
+
+	time.Sleep(time.Until(t.next))
+}
+
+// Errors.
+var (
+	ErrFaultReset   = errors.New("connection reset by injected fault")
+	ErrFaultRefused = errors.New("connection refused by injected fault")
+)
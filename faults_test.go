@@ -0,0 +1,112 @@
+package reverseproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFaults(t *testing.T) {
+	echo, err := net.ResolveTCPAddr("tcp", listenTest(t, echoConn).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, echo)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	const req = "GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"
+
+	for n, test := range [...]struct {
+		Faults   *Faults
+		Expected string
+		Min      time.Duration
+	}{
+		{
+			Faults:   nil,
+			Expected: req,
+		},
+		{
+			Faults:   &Faults{RefuseRate: 1},
+			Expected: "",
+		},
+		{
+			Faults:   &Faults{CorruptFirstByte: true},
+			Expected: "\xb8" + req[1:],
+		},
+		{
+			Faults:   &Faults{ResetRate: 1, ResetAfter: uint64(len(req)) + 10},
+			Expected: req[:10],
+		},
+		{
+			Faults:   &Faults{Latency: 100 * time.Millisecond},
+			Expected: req,
+			Min:      100 * time.Millisecond,
+		},
+		{
+			Faults:   &Faults{Bandwidth: uint64(len(req)) * 5},
+			Expected: req,
+			Min:      200 * time.Millisecond,
+		},
+		{
+			Faults:   &Faults{RefuseRate: 1, Expires: time.Now().Add(-time.Second)},
+			Expected: req,
+		},
+	} {
+		p.SetFaults(test.Faults)
+
+		start := time.Now()
+
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		c.Write([]byte(req))
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		buf := make([]byte, len(req))
+		m, _ := io.ReadFull(c, buf)
+
+		if got := string(buf[:m]); got != test.Expected {
+			t.Errorf("test %d: expecting %q, got %q", n+1, test.Expected, got)
+		} else if d := time.Since(start); d < test.Min {
+			t.Errorf("test %d: expecting at least %s, took %s", n+1, test.Min, d)
+		}
+
+		c.Close()
+	}
+
+	if f := p.Faults(); f != nil {
+		t.Errorf("test 8: expecting expired faults to be removed, got %v", f)
+	}
+
+	access := make(chan Access, 1)
+
+	SetAccessLog(func(a Access) { access <- a })
+	defer SetAccessLog(nil)
+
+	p.SetFaults(&Faults{RefuseRate: 1})
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 9: unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	c.Write([]byte(req))
+
+	if a := <-access; !errors.Is(a.Err, ErrFaultRefused) {
+		t.Errorf("test 9: expecting error %v, got %v", ErrFaultRefused, a.Err)
+	}
+}
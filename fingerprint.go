@@ -0,0 +1,290 @@
+package reverseproxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Fingerprint holds the JA3 and JA4 fingerprints of the ClientHello of a TLS
+// connection, which identify the TLS library, and so often the kind of client,
+// that made the connection.
+type Fingerprint struct {
+	JA3 string
+	JA4 string
+}
+
+// fingerprint computes the Fingerprint of the ClientHello.
+func (h *clientHello) fingerprint() *Fingerprint {
+	return &Fingerprint{
+		JA3: h.ja3(),
+		JA4: h.ja4(),
+	}
+}
+
+// isGREASE returns whether the value is one reserved by RFC 8701, which are
+// ignored when fingerprinting.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), isGREASE)
+}
+
+// ja3 returns the MD5 hash of the version, cipher suites, extensions, curves
+// and point formats of the ClientHello.
+func (h *clientHello) ja3() string {
+	var sb strings.Builder
+
+	sb.WriteString(strconv.FormatUint(uint64(h.version), 10))
+
+	for _, list := range [...][]uint16{h.ciphers, h.extensions, h.curves} {
+		sb.WriteByte(',')
+		writeJoined(&sb, withoutGREASE(list), 10, "-")
+	}
+
+	sb.WriteByte(',')
+
+	for n, p := range h.pointFormats {
+		if n > 0 {
+			sb.WriteByte('-')
+		}
+
+		sb.WriteString(strconv.FormatUint(uint64(p), 10))
+	}
+
+	sum := md5.Sum([]byte(sb.String()))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint of the ClientHello, made up of a description
+// of the connection, and truncated SHA256 hashes of the sorted cipher suites
+// and of the sorted extensions and signature algorithms.
+func (h *clientHello) ja4() string {
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+	sni := 'i'
+
+	if slices.Contains(extensions, extServerName) {
+		sni = 'd'
+	}
+
+	a := fmt.Sprintf("t%s%c%02d%02d%s", ja4Version(h.version, h.supportedVersions), sni, min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(h.alpn))
+
+	slices.Sort(ciphers)
+
+	hashed := slices.DeleteFunc(extensions, func(e uint16) bool {
+		return e == extServerName || e == extALPN
+	})
+
+	slices.Sort(hashed)
+
+	var sb strings.Builder
+
+	writeJoined(&sb, ciphers, 16, ",")
+
+	b := ja4Hash(sb.String(), len(ciphers) == 0)
+
+	sb.Reset()
+	writeJoined(&sb, hashed, 16, ",")
+
+	if sigs := withoutGREASE(h.signatureAlgs); len(sigs) > 0 {
+		sb.WriteByte('_')
+		writeJoined(&sb, sigs, 16, ",")
+	}
+
+	c := ja4Hash(sb.String(), len(hashed) == 0)
+
+	return a + "_" + b + "_" + c
+}
+
+func writeJoined(sb *strings.Builder, values []uint16, base int, sep string) {
+	for n, v := range values {
+		if n > 0 {
+			sb.WriteString(sep)
+		}
+
+		if base == 16 {
+			fmt.Fprintf(sb, "%04x", v)
+		} else {
+			sb.WriteString(strconv.FormatUint(uint64(v), base))
+		}
+	}
+}
+
+func ja4Version(legacy uint16, supported []uint16) string {
+	version := legacy
+
+	if s := withoutGREASE(supported); len(s) > 0 {
+		version = slices.Max(s)
+	}
+
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+
+	return "00"
+}
+
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+
+	first, last := alpn[0][0], alpn[0][len(alpn[0])-1]
+
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		h := hex.EncodeToString([]byte{first, last})
+
+		return h[:1] + h[3:]
+	}
+
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func ja4Hash(s string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(s))
+
+	return hex.EncodeToString(sum[:6])
+}
+
+// MatchServiceFingerprint allows a service to be matched on the Fingerprint of
+// a TLS connection as well as the service name.
+//
+// Services matched by Fingerprint are preferred over those matched only by
+// name, allowing particular clients to be sent to a different service.
+type MatchServiceFingerprint interface {
+	MatchServiceName
+
+	// MatchServiceFingerprint returns whether the service matches the name
+	// and Fingerprint.
+	MatchServiceFingerprint(serviceName string, fp Fingerprint) bool
+}
+
+// FingerprintMatch restricts the services matched by Host to those TLS
+// connections with one of the given JA3 or JA4 fingerprints.
+//
+// As plaintext connections have no Fingerprint, FingerprintMatch never matches
+// them.
+type FingerprintMatch struct {
+	Host     MatchServiceName
+	JA3, JA4 []string
+}
+
+// MatchService implements the MatchServiceName interface.
+func (FingerprintMatch) MatchService(_ string) bool {
+	return false
+}
+
+// MatchServiceFingerprint implements the MatchServiceFingerprint interface.
+func (f FingerprintMatch) MatchServiceFingerprint(serviceName string, fp Fingerprint) bool {
+	return f.Host.MatchService(serviceName) && (slices.Contains(f.JA3, fp.JA3) || slices.Contains(f.JA4, fp.JA4))
+}
+
+func matchServiceFingerprint(m MatchServiceName, serviceName string, fp Fingerprint) bool {
+	if mf, ok := m.(MatchServiceFingerprint); ok {
+		return mf.MatchServiceFingerprint(serviceName, fp)
+	}
+
+	return false
+}
+
+// MatchServiceFingerprint implements the MatchServiceFingerprint interface.
+func (h Hosts) MatchServiceFingerprint(serviceName string, fp Fingerprint) bool {
+	for _, s := range h {
+		if matchServiceFingerprint(s, serviceName, fp) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchFingerprint finds a service that matches the name by the Fingerprint.
+func (l *listener) matchFingerprint(name string, fp *Fingerprint) *Port {
+	if fp == nil {
+		return nil
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for p := range l.ports {
+		if matchServiceFingerprint(p.service, name, *fp) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+var denylists = make(map[uint16]map[string]struct{})
+
+// SetFingerprintDenylist sets the JA3 and JA4 fingerprints of TLS connections
+// to be refused, with an access_denied alert, on the given port. Setting no
+// fingerprints clears the denylist.
+//
+// As the connections to a claimed port are not sniffed, they are not checked.
+func SetFingerprintDenylist(port uint16, fingerprints ...string) {
+	lMu.Lock()
+	defer lMu.Unlock()
+
+	if len(fingerprints) == 0 {
+		delete(denylists, port)
+
+		return
+	}
+
+	denylist := make(map[string]struct{}, len(fingerprints))
+
+	for _, fp := range fingerprints {
+		denylist[fp] = struct{}{}
+	}
+
+	denylists[port] = denylist
+}
+
+// denied returns whether the Fingerprint is on the denylist of the port.
+func (l *listener) denied(fp *Fingerprint) bool {
+	if fp == nil {
+		return false
+	}
+
+	lMu.RLock()
+	defer lMu.RUnlock()
+
+	denylist := denylists[l.port]
+	_, ja3 := denylist[fp.JA3]
+	_, ja4 := denylist[fp.JA4]
+
+	return ja3 || ja4
+}
+
+// Errors.
+var (
+	ErrFingerprintDenied = errors.New("fingerprint denied")
+)
@@ -0,0 +1,238 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func u16(v int) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func tlsExtension(typ int, data []byte) []byte {
+	return append(append(u16(typ), u16(len(data))...), data...)
+}
+
+func u16s(values ...int) []byte {
+	var b []byte
+
+	for _, v := range values {
+		b = append(b, u16(v)...)
+	}
+
+	return b
+}
+
+func buildClientHello(version int, ciphers []int, exts ...[]byte) []byte {
+	body := u16(version)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)
+	body = append(append(body, u16(2*len(ciphers))...), u16s(ciphers...)...)
+	body = append(body, 1, 0)
+	body = append(append(body, u16(len(bytes.Join(exts, nil)))...), bytes.Join(exts, nil)...)
+
+	hs := append([]byte{1, 0}, u16(len(body))...)
+	hs = append(hs, body...)
+
+	return append(append([]byte{22, 3, 1}, u16(len(hs))...), hs...)
+}
+
+func sniExtension(name string) []byte {
+	sni := append(append([]byte{0}, u16(len(name))...), name...)
+
+	return tlsExtension(extServerName, append(u16(len(sni)), sni...))
+}
+
+func testClientHello(name string) []byte {
+	alpn := []byte{2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'}
+
+	return buildClientHello(0x0303, []int{0x0a0a, 0x1301, 0x1302},
+		tlsExtension(0x0a0a, nil),
+		sniExtension(name),
+		tlsExtension(extSupportedGroups, []byte{0, 4, 0x0a, 0x0a, 0, 0x1d}),
+		tlsExtension(extECPointFormats, []byte{1, 0}),
+		tlsExtension(extSignatureAlgorithms, []byte{0, 4, 4, 3, 8, 4}),
+		tlsExtension(extALPN, append(u16(len(alpn)), alpn...)),
+		tlsExtension(extSupportedVersions, []byte{4, 3, 4, 3, 3}),
+	)
+}
+
+func parseHello(record []byte) *clientHello {
+	h := new(clientHello)
+
+	if h.parse(record[5:]) != nil {
+		return nil
+	}
+
+	return h
+}
+
+func hashPrefix(s string) string {
+	sum := sha256.Sum256([]byte(s))
+
+	return hex.EncodeToString(sum[:6])
+}
+
+func TestFingerprint(t *testing.T) {
+	h := parseHello(testClientHello("example.com"))
+	if h == nil {
+		t.Fatalf("test 1: expecting ClientHello, got nil")
+	}
+
+	fp := h.fingerprint()
+
+	ja3 := md5.Sum([]byte("771,4865-4866,0-10-11-13-16-43,29,0"))
+
+	if expected := hex.EncodeToString(ja3[:]); fp.JA3 != expected {
+		t.Errorf("test 1: expecting JA3 %q, got %q", expected, fp.JA3)
+	}
+
+	if expected := "t13d0206h2_" + hashPrefix("1301,1302") + "_" + hashPrefix("000a,000b,000d,002b_0403,0804"); fp.JA4 != expected {
+		t.Errorf("test 2: expecting JA4 %q, got %q", expected, fp.JA4)
+	}
+
+	for n, test := range [...]struct {
+		ALPN     []string
+		Expected string
+	}{
+		{nil, "00"},
+		{[]string{"http/1.1"}, "h1"},
+		{[]string{"\xab\xcd"}, "ad"},
+	} {
+		if alpn := ja4ALPN(test.ALPN); alpn != test.Expected {
+			t.Errorf("test %d: expecting ALPN %q, got %q", n+3, test.Expected, alpn)
+		}
+	}
+}
+
+// TestFingerprintReference checks the fingerprints of ClientHellos matching
+// the examples published with the JA3 and JA4 specifications.
+func TestFingerprintReference(t *testing.T) {
+	ja3 := parseHello(buildClientHello(0x0301, []int{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		sniExtension("example.com"),
+		tlsExtension(extSupportedGroups, append(u16(6), u16s(23, 24, 25)...)),
+		tlsExtension(extECPointFormats, []byte{1, 0}),
+	))
+	if ja3 == nil {
+		t.Fatalf("test 1: expecting ClientHello, got nil")
+	} else if fp := ja3.fingerprint(); fp.JA3 != "ada70206e40642a3e4461f35503241d5" {
+		t.Errorf("test 1: expecting JA3 %q, got %q", "ada70206e40642a3e4461f35503241d5", fp.JA3)
+	}
+
+	alpn := []byte{2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'}
+	sigAlgs := u16s(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)
+
+	ja4 := parseHello(buildClientHello(0x0303, []int{0x3a3a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		tlsExtension(0x5a5a, nil),
+		sniExtension("example.com"),
+		tlsExtension(0x0017, nil),
+		tlsExtension(0xff01, []byte{0}),
+		tlsExtension(extSupportedGroups, append(u16(8), u16s(0x6a6a, 0x001d, 0x0017, 0x0018)...)),
+		tlsExtension(extECPointFormats, []byte{1, 0}),
+		tlsExtension(0x0023, nil),
+		tlsExtension(extALPN, append(u16(len(alpn)), alpn...)),
+		tlsExtension(0x0005, []byte{1, 0, 0, 0, 0}),
+		tlsExtension(extSignatureAlgorithms, append(u16(len(sigAlgs)), sigAlgs...)),
+		tlsExtension(0x0012, nil),
+		tlsExtension(0x0033, nil),
+		tlsExtension(0x002d, []byte{1, 1}),
+		tlsExtension(extSupportedVersions, []byte{6, 0x7a, 0x7a, 3, 4, 3, 3}),
+		tlsExtension(0x001b, []byte{2, 0, 2}),
+		tlsExtension(0x4469, nil),
+		tlsExtension(0x0015, make([]byte, 16)),
+		tlsExtension(0x8a8a, []byte{0}),
+	))
+	if ja4 == nil {
+		t.Fatalf("test 2: expecting ClientHello, got nil")
+	} else if fp := ja4.fingerprint(); fp.JA4 != "t13d1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Errorf("test 2: expecting JA4 %q, got %q", "t13d1516h2_8daaf6152771_e5627efa2ab1", fp.JA4)
+	}
+}
+
+func TestFingerprintRouting(t *testing.T) {
+	reply := func(s string) func(net.Conn) {
+		return func(c net.Conn) {
+			c.Write([]byte(s))
+			c.Close()
+		}
+	}
+
+	backend, err := net.ResolveTCPAddr("tcp", listenTest(t, reply("backend")).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tarpit, err := net.ResolveTCPAddr("tcp", listenTest(t, reply("tarpit")).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	hello := testClientHello(aDomain)
+	fp := parseHello(hello).fingerprint()
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, backend)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	read := func() string {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		defer c.Close()
+
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write(hello)
+
+		data, _ := io.ReadAll(c)
+
+		return string(data)
+	}
+
+	if got := read(); got != "backend" {
+		t.Errorf("test 1: expecting %q, got %q", "backend", got)
+	}
+
+	q, err := AddRedirect(Hosts{FingerprintMatch{Host: HostName(aDomain), JA4: []string{fp.JA4}}}, pa, tarpit)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	accesses := make(chan Access, 1)
+
+	SetAccessLog(func(a Access) { accesses <- a })
+	defer SetAccessLog(nil)
+
+	if got := read(); got != "tarpit" {
+		t.Errorf("test 2: expecting %q, got %q", "tarpit", got)
+	}
+
+	if a := <-accesses; a.ServiceName != aDomain || a.Port != pa || a.Fingerprint == nil || *a.Fingerprint != *fp || a.Err != nil {
+		t.Errorf("test 3: unexpected access log entry: %v", a)
+	}
+
+	SetFingerprintDenylist(pa, fp.JA3)
+	defer SetFingerprintDenylist(pa)
+
+	if got, expected := read(), string([]byte{21, 3, 3, 0, 2, 2, byte(AlertAccessDenied)}); got != expected {
+		t.Errorf("test 4: expecting %q, got %q", expected, got)
+	}
+
+	if a := <-accesses; a.Err == nil {
+		t.Errorf("test 5: expecting access log entry with error")
+	}
+}
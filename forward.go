@@ -0,0 +1,122 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"net"
+)
+
+// ForwardHeader is a set of headers that can be added to plaintext HTTP
+// requests, to pass on information about the client.
+type ForwardHeader uint8
+
+// Forward Headers.
+const (
+	HeaderForwarded ForwardHeader = 1 << iota
+	HeaderXForwardedFor
+	HeaderXForwardedProto
+	HeaderXRealIP
+)
+
+// TrustPolicy determines whether forwarding headers sent by a client, with the
+// given IP, should be kept; a nil TrustPolicy trusts no-one.
+type TrustPolicy func(net.IP) bool
+
+// TrustAll is a TrustPolicy that trusts all clients.
+func TrustAll(net.IP) bool {
+	return true
+}
+
+// TrustNetworks creates a TrustPolicy that trusts only clients within the given
+// networks.
+func TrustNetworks(networks ...*net.IPNet) TrustPolicy {
+	return func(ip net.IP) bool {
+		for _, n := range networks {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// InjectHeaders sets the forwarding headers that will be added to plaintext
+// HTTP requests before they are passed to the service.
+//
+// Any matching headers sent by a client are removed unless the client is
+// trusted by the given TrustPolicy, in which case the Forwarded and
+// X-Forwarded-For headers are appended to, and the X-Forwarded-Proto and
+// X-Real-IP headers are kept.
+//
+// See SetHTTPRouting for how keep-alive connections are handled.
+func InjectHeaders(headers ForwardHeader, trust TrustPolicy) Option {
+	return func(o *options) {
+		o.forward = headers
+		o.trust = trust
+	}
+}
+
+func (o *options) forwardHeaders(r *requestHead, ip net.IP, proto string) {
+	if o.forward == 0 || ip == nil {
+		return
+	}
+
+	trusted := o.trust != nil && o.trust(ip)
+	addr := []byte(ip.String())
+
+	if o.forward&HeaderForwarded != 0 {
+		var node []byte
+
+		if ip.To4() == nil { // RFC 7239 section 6: IPv6 addresses are bracketed and quoted
+			node = append(append([]byte(`"[`), addr...), `]"`...)
+		} else {
+			node = addr
+		}
+
+		r.forward(headerForwarded, append(append(append([]byte("for="), node...), ";proto="...), proto...), trusted, true)
+	}
+
+	if o.forward&HeaderXForwardedFor != 0 {
+		r.forward(headerXForwardedFor, addr, trusted, true)
+	}
+
+	if o.forward&HeaderXForwardedProto != 0 {
+		r.forward(headerXForwardedProto, []byte(proto), trusted, false)
+	}
+
+	if o.forward&HeaderXRealIP != 0 {
+		r.forward(headerXRealIP, addr, trusted, false)
+	}
+}
+
+// forward sets the named field to the given value, either appending it to, or
+// keeping, the value sent by a trusted client.
+func (r *requestHead) forward(name string, value []byte, trusted, appendValue bool) {
+	existing := r.remove(name)
+
+	if trusted && len(existing) > 0 {
+		if !appendValue {
+			for _, v := range existing {
+				r.add(name, v)
+			}
+
+			return
+		}
+
+		value = append(append(bytes.Join(existing, listSep), listSep...), value...)
+	}
+
+	r.add(name, value)
+}
+
+const (
+	protoHTTP  = "http"
+	protoHTTPS = "https"
+
+	headerForwarded       = "Forwarded"
+	headerXForwardedFor   = "X-Forwarded-For"
+	headerXForwardedProto = "X-Forwarded-Proto"
+	headerXRealIP         = "X-Real-IP"
+)
+
+var listSep = []byte(", ")
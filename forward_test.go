@@ -0,0 +1,95 @@
+package reverseproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestForwardHeaders(t *testing.T) {
+	_, local, _ := net.ParseCIDR("10.0.0.0/8")
+
+	for n, test := range [...]struct {
+		Headers       ForwardHeader
+		Trust         TrustPolicy
+		IP            string
+		Input, Output string
+	}{
+		{ // 1
+			IP:     "10.0.0.1",
+			Input:  "GET / HTTP/1.1\r\nHost: a.com\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n",
+			Output: "GET / HTTP/1.1\r\nHost: a.com\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n",
+		},
+		{ // 2
+			Headers: HeaderXForwardedFor | HeaderXForwardedProto | HeaderXRealIP,
+			IP:      "10.0.0.1",
+			Input:   "GET / HTTP/1.1\r\nHost: a.com\r\n\r\nBODY",
+			Output:  "GET / HTTP/1.1\r\nHost: a.com\r\nX-Forwarded-For: 10.0.0.1\r\nX-Forwarded-Proto: http\r\nX-Real-IP: 10.0.0.1\r\nConnection: close\r\n\r\nBODY",
+		},
+		{ // 3
+			Headers: HeaderXForwardedFor | HeaderXRealIP,
+			IP:      "192.168.0.1",
+			Input:   "GET / HTTP/1.1\nx-forwarded-for: 1.2.3.4\nHost: a.com\nX-Real-IP: 1.2.3.4\nAccept: */*\n\n",
+			Output:  "GET / HTTP/1.1\r\nHost: a.com\r\nAccept: */*\r\nX-Forwarded-For: 192.168.0.1\r\nX-Real-IP: 192.168.0.1\r\nConnection: close\r\n\r\n",
+		},
+		{ // 4
+			Headers: HeaderXForwardedFor | HeaderXRealIP,
+			Trust:   TrustAll,
+			IP:      "192.168.0.1",
+			Input:   "GET / HTTP/1.1\r\nX-Forwarded-For: 1.2.3.4\r\nHost: a.com\r\nX-Forwarded-For: 5.6.7.8\r\nX-Real-IP: 1.2.3.4\r\n\r\n",
+			Output:  "GET / HTTP/1.1\r\nHost: a.com\r\nX-Forwarded-For: 1.2.3.4, 5.6.7.8, 192.168.0.1\r\nX-Real-IP: 1.2.3.4\r\nConnection: close\r\n\r\n",
+		},
+		{ // 5
+			Headers: HeaderForwarded,
+			Trust:   TrustNetworks(local),
+			IP:      "10.1.2.3",
+			Input:   "GET / HTTP/1.1\r\nHost: a.com\r\nForwarded: for=1.2.3.4\r\n\r\n",
+			Output:  "GET / HTTP/1.1\r\nHost: a.com\r\nForwarded: for=1.2.3.4, for=10.1.2.3;proto=http\r\nConnection: close\r\n\r\n",
+		},
+		{ // 6
+			Headers: HeaderForwarded,
+			Trust:   TrustNetworks(local),
+			IP:      "2001:db8::1",
+			Input:   "GET / HTTP/1.1\r\nHost: a.com\r\nForwarded: for=1.2.3.4\r\n\r\n",
+			Output:  "GET / HTTP/1.1\r\nHost: a.com\r\nForwarded: for=\"[2001:db8::1]\";proto=http\r\nConnection: close\r\n\r\n",
+		},
+		{ // 7
+			Headers: HeaderXForwardedFor,
+			IP:      "10.0.0.1",
+			Input:   "\x16\x03\x01",
+			Output:  "\x16\x03\x01",
+		},
+	} {
+		o := makeOptions([]Option{InjectHeaders(test.Headers, test.Trust)})
+
+		if out := o.rewrite([]byte(test.Input), net.ParseIP(test.IP), protoHTTP); string(out) != test.Output {
+			t.Errorf("test %d: expecting output %q, got %q", n+1, test.Output, out)
+		}
+	}
+}
+
+func TestForwardHeadersListener(t *testing.T) {
+	pa := getUnusedPort()
+	sa := make(testService)
+
+	p, err := addPort(pa, testServiceA{sa}, InjectHeaders(HeaderXForwardedFor, nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	go func() {
+		c, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(pa)})
+		if err == nil {
+			c.Write([]byte("GET / HTTP/1.1\r\nHost: " + aDomain + "\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n"))
+		}
+	}()
+
+	data := <-sa
+
+	data.conn.Close()
+
+	if expected := "GET / HTTP/1.1\r\nHost: " + aDomain + "\r\nX-Forwarded-For: 127.0.0.1\r\nConnection: close\r\n\r\n"; string(data.buf) != expected {
+		t.Errorf("expecting buf %q, got %q", expected, data.buf)
+	}
+}
@@ -0,0 +1,205 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	h2FrameHeaderLength = 9
+	h2MaxFrameSize      = 1 << 14
+
+	h2FrameHeaders      = 1
+	h2FrameSettings     = 4
+	h2FrameGoAway       = 7
+	h2FrameContinuation = 9
+
+	h2FlagEndStream  = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+)
+
+var h2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+func (h *httpParser) isH2Preface() bool {
+	return string(h.method) == "PRI" && string(h.target) == "*" && string(h.version) == "HTTP/2.0"
+}
+
+// readH2CServerName continues reading an HTTP/2 connection with prior
+// knowledge, decoding the first HEADERS frame to find the :authority, or Host,
+// and the :path of the first request.
+//
+// The first n bytes of buf have already been read.
+func readH2CServerName(r io.Reader, buf []byte, n int) (string, string, []byte, error) {
+	var (
+		authority, host, path string
+		hasHost               bool
+		err                   error
+	)
+
+	if n, err = readAtLeast(r, buf, n, len(h2Preface)); err != nil {
+		return "", "", buf, err
+	} else if !bytes.HasPrefix(buf, h2Preface) {
+		return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: errInvalidH2Preface}
+	}
+
+	dec := hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		switch f.Name {
+		case ":authority":
+			authority = f.Value
+		case ":path":
+			path = f.Value
+		case "host":
+			host = f.Value
+			hasHost = true
+		}
+	})
+
+	dec.SetMaxStringLength(len(buf))
+
+	var (
+		pos          = len(h2Preface)
+		headerStream uint32
+		first        = true
+	)
+
+	for {
+		if n, err = readAtLeast(r, buf, n, pos+h2FrameHeaderLength); err != nil {
+			return "", "", buf, err
+		}
+
+		length := int(buf[pos])<<16 | int(buf[pos+1])<<8 | int(buf[pos+2])
+		typ := buf[pos+3]
+		flags := buf[pos+4]
+		stream := (uint32(buf[pos+5])<<24 | uint32(buf[pos+6])<<16 | uint32(buf[pos+7])<<8 | uint32(buf[pos+8])) & 0x7fffffff
+
+		if length > h2MaxFrameSize {
+			return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: errInvalidH2Frame}
+		}
+
+		pos += h2FrameHeaderLength
+
+		if n, err = readAtLeast(r, buf, n, pos+length); err != nil {
+			return "", "", buf, err
+		}
+
+		payload := buf[pos : pos+length]
+		pos += length
+
+		if first {
+			if typ != h2FrameSettings || stream != 0 {
+				return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: errInvalidH2Frame}
+			}
+
+			first = false
+
+			continue
+		}
+
+		switch typ {
+		case h2FrameHeaders:
+			if headerStream != 0 || stream&1 == 0 {
+				return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: errInvalidH2Frame}
+			}
+
+			if flags&h2FlagPadded != 0 {
+				if len(payload) == 0 || int(payload[0]) >= len(payload) {
+					return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: errInvalidH2Frame}
+				}
+
+				payload = payload[1 : len(payload)-int(payload[0])]
+			}
+
+			if flags&h2FlagPriority != 0 {
+				if len(payload) < 5 {
+					return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: errInvalidH2Frame}
+				}
+
+				payload = payload[5:]
+			}
+
+			headerStream = stream
+		case h2FrameContinuation:
+			if headerStream == 0 || stream != headerStream {
+				return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: errInvalidH2Frame}
+			}
+		default:
+			if headerStream != 0 {
+				return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: errInvalidH2Frame}
+			}
+
+			continue
+		}
+
+		if _, err := dec.Write(payload); err != nil {
+			return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: fmt.Errorf("error decoding headers: %w", err)}
+		}
+
+		if flags&h2FlagEndHeaders != 0 {
+			break
+		}
+	}
+
+	if err := dec.Close(); err != nil {
+		return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: fmt.Errorf("error decoding headers: %w", err)}
+	}
+
+	if authority == "" {
+		if !hasHost {
+			return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: errNoServerHeader}
+		}
+
+		authority = host
+	} else if hasHost && !bytes.EqualFold(hostOnly([]byte(host)), hostOnly([]byte(authority))) {
+		return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: errConflictingHost}
+	}
+
+	return authority, path, buf[:n], nil
+}
+
+func readAtLeast(r io.Reader, buf []byte, n, min int) (int, error) {
+	if min > len(buf) {
+		return n, &HTTPError{Code: http.StatusRequestHeaderFieldsTooLarge, Err: errHeadersTooLarge}
+	}
+
+	if n >= min {
+		return n, nil
+	}
+
+	m, err := io.ReadAtLeast(r, buf[n:], min-n)
+	if err != nil {
+		return n + m, fmt.Errorf("error reading headers: %w", err)
+	}
+
+	return n + m, nil
+}
+
+// h2Rejection builds an HTTP/2 response to the first stream of a connection,
+// containing only the given status code, followed by a GOAWAY frame.
+func h2Rejection(code int) []byte {
+	var block bytes.Buffer
+
+	hpack.NewEncoder(&block).WriteField(hpack.HeaderField{Name: ":status", Value: fmt.Sprint(code)})
+
+	resp := make([]byte, 0, 3*h2FrameHeaderLength+block.Len()+8)
+	resp = appendH2FrameHeader(resp, 0, h2FrameSettings, 0, 0)
+	resp = append(appendH2FrameHeader(resp, block.Len(), h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1), block.Bytes()...)
+	resp = append(appendH2FrameHeader(resp, 8, h2FrameGoAway, 0, 0), 0, 0, 0, 1, 0, 0, 0, 0)
+
+	return resp
+}
+
+func appendH2FrameHeader(buf []byte, length int, typ, flags byte, stream uint32) []byte {
+	return append(buf, byte(length>>16), byte(length>>8), byte(length), typ, flags, byte(stream>>24), byte(stream>>16), byte(stream>>8), byte(stream))
+}
+
+var (
+	errInvalidH2Preface = errors.New("invalid HTTP/2 connection preface")
+	errInvalidH2Frame   = errors.New("invalid HTTP/2 frame")
+)
@@ -0,0 +1,169 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func h2cRequest(authority, host string, split bool) []byte {
+	var (
+		buf, block bytes.Buffer
+		enc        = hpack.NewEncoder(&block)
+		fr         = http2.NewFramer(&buf, nil)
+	)
+
+	buf.Write(h2Preface)
+	fr.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100})
+	fr.WriteWindowUpdate(0, 1<<20)
+
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: http.MethodGet})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+
+	if authority != "" {
+		enc.WriteField(hpack.HeaderField{Name: ":authority", Value: authority})
+	}
+
+	if host != "" {
+		enc.WriteField(hpack.HeaderField{Name: "host", Value: host})
+	}
+
+	enc.WriteField(hpack.HeaderField{Name: "user-agent", Value: "test"})
+
+	b := block.Bytes()
+
+	if split {
+		fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: b[:3], EndStream: true, PadLength: 4})
+		fr.WriteContinuation(1, false, b[3:5])
+		fr.WriteContinuation(1, true, b[5:])
+	} else {
+		fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: b, EndStream: true, EndHeaders: true, Priority: http2.PriorityParam{Weight: 15}})
+	}
+
+	return buf.Bytes()
+}
+
+func TestH2C(t *testing.T) {
+	buf := make([]byte, 1024)
+
+	for n, test := range [...]struct {
+		Request []byte
+		Name    string
+		Err     error
+	}{
+		{ // 1
+			Request: h2cRequest("example.com", "", false),
+			Name:    "example.com",
+		},
+		{ // 2
+			Request: h2cRequest("example.com:8080", "", true),
+			Name:    "example.com:8080",
+		},
+		{ // 3
+			Request: h2cRequest("", "example.com", false),
+			Name:    "example.com",
+		},
+		{ // 4
+			Request: h2cRequest("example.com", "example.com", true),
+			Name:    "example.com",
+		},
+		{ // 5
+			Request: h2cRequest("", "", false),
+			Err:     errNoServerHeader,
+		},
+		{ // 6
+			Request: h2cRequest("example.com", "example.net", false),
+			Err:     errConflictingHost,
+		},
+		{ // 7
+			Request: append(append([]byte{}, h2Preface...), 0, 0, 0, 1, 0, 0, 0, 0, 1),
+			Err:     errInvalidH2Frame,
+		},
+		{ // 8
+			Request: []byte("PRI * HTTP/2.0\r\n\r\nXX\r\n\r\n"),
+			Err:     errInvalidH2Preface,
+		},
+	} {
+		data := delayReader(test.Request[1:])
+		buf[0] = test.Request[0]
+
+		name, _, b, err := readHTTPServerName(&data, buf)
+		if !errors.Is(err, test.Err) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		} else if name != test.Name {
+			t.Errorf("test %d: expecting name %q, got %q", n+1, test.Name, name)
+		} else if test.Err == nil && !bytes.Equal(b, test.Request) {
+			t.Errorf("test %d: expecting buffer %v, got %v", n+1, test.Request, b)
+		}
+	}
+}
+
+func TestH2CListener(t *testing.T) {
+	pa := getUnusedPort()
+	sa := make(testService)
+
+	p, err := addPort(pa, testServiceA{sa})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	req := h2cRequest(aDomain, "", true)
+
+	go func() {
+		c, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(pa)})
+		if err == nil {
+			c.Write(req)
+		}
+	}()
+
+	data := <-sa
+
+	data.conn.Close()
+
+	if !bytes.Equal(data.buf, req) {
+		t.Errorf("test 1: expecting buf to equal %v, got %v", req, data.buf)
+	}
+
+	c, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(pa)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	c.Write(h2cRequest(bDomain, "", false))
+
+	var status string
+
+	fr := http2.NewFramer(nil, c)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+	for status == "" {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("test 2: unexpected error: %s", err)
+		}
+
+		if mh, ok := f.(*http2.MetaHeadersFrame); ok {
+			status = mh.PseudoValue("status")
+		}
+	}
+
+	if status != "421" {
+		t.Errorf("test 2: expecting status 421, got %q", status)
+	}
+
+	if f, err := fr.ReadFrame(); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if _, ok := f.(*http2.GoAwayFrame); !ok {
+		t.Errorf("test 3: expecting GOAWAY frame, got %v", f)
+	}
+}
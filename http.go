@@ -5,37 +5,498 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 )
 
-var (
-	eoh  = []byte("\r\n\r\n")
-	eol  = eoh[:2]
-	host = []byte("\r\nHost: ")
-)
+// readHTTPServerName reads the head of the first request on a plaintext HTTP
+// connection, returning the server name and the path of the request target.
+func readHTTPServerName(r io.Reader, buf []byte) (string, string, []byte, error) {
+	var h httpParser
 
-func readHTTPServerName(r io.Reader, buf []byte) (string, []byte, error) {
 	n := 1
-	h := -1
-	l := -1
 
-	for l < 0 {
+	for {
+		if n == len(buf) {
+			return "", "", buf, &HTTPError{Code: http.StatusRequestHeaderFieldsTooLarge, Err: errHeadersTooLarge}
+		}
+
 		m, err := r.Read(buf[n:])
 		n += m
-		h = bytes.Index(buf[:n], host)
 
-		if e := bytes.Index(buf[:n], eoh); h > 0 && (e > h || e == -1) {
-			h += len(host)
-			l = bytes.Index(buf[h:n], eol)
-		} else if e >= 0 {
-			return "", buf, errNoServerHeader
+		if done, perr := h.parse(buf[:n]); perr != nil {
+			return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: perr}
+		} else if done {
+			if h.isH2Preface() {
+				name, path, buf, err := readH2CServerName(r, buf, n)
+				if path != "" {
+					path = requestPath([]byte(path))
+				}
+
+				return name, path, buf, err
+			}
+
+			name, perr := h.serverName()
+			if perr != nil {
+				return "", "", buf, &HTTPError{Code: http.StatusBadRequest, Err: perr}
+			}
+
+			return name, h.path(), buf[:n], nil
 		}
 
 		if err != nil {
-			return "", buf, fmt.Errorf("error reading headers: %w", err)
+			return "", "", buf, fmt.Errorf("error reading headers: %w", err)
+		}
+	}
+}
+
+// httpParser incrementally parses the request-line and header fields of an
+// HTTP/1.x request, as described in RFC 9112.
+//
+// All slices reference the buffer being parsed.
+type httpParser struct {
+	pos       int
+	response  bool
+	started   bool
+	method    []byte
+	target    []byte
+	version   []byte
+	status    int
+	authority []byte
+	host      []byte
+	hasHost   bool
+
+	contentLength    []byte
+	transferEncoding []byte
+	upgrade          bool
+	connUpgrade      bool
+}
+
+// parse consumes all complete lines in buf, returning true once the end of the
+// header block has been reached.
+//
+// The same, possibly extended, buffer should be passed on each call.
+func (h *httpParser) parse(buf []byte) (bool, error) {
+	for {
+		e := bytes.IndexByte(buf[h.pos:], '\n')
+		if e < 0 {
+			return false, nil
+		}
+
+		line := buf[h.pos : h.pos+e]
+		h.pos += e + 1
+
+		if l := len(line); l > 0 && line[l-1] == '\r' {
+			line = line[:l-1]
+		}
+
+		if bytes.IndexByte(line, '\r') >= 0 {
+			return false, errBareCR
+		}
+
+		if !h.started {
+			if len(line) == 0 { // RFC 9112 section 2.2: ignore empty lines before the request-line
+				continue
+			}
+
+			if err := h.parseStartLine(line); err != nil {
+				return false, err
+			}
+
+			h.started = true
+		} else if len(line) == 0 {
+			return true, nil
+		} else if err := h.parseField(line); err != nil {
+			return false, err
+		}
+	}
+}
+
+func (h *httpParser) parseStartLine(line []byte) error {
+	if h.response {
+		return h.parseStatusLine(line)
+	}
+
+	return h.parseRequestLine(line)
+}
+
+func (h *httpParser) parseStatusLine(line []byte) error {
+	if len(line) < 12 || !isHTTPVersion(line[:8]) || line[8] != ' ' || len(line) > 12 && line[12] != ' ' {
+		return errInvalidStatusLine
+	}
+
+	for _, c := range line[9:12] {
+		if c < '0' || c > '9' {
+			return errInvalidStatusLine
+		}
+
+		h.status = h.status*10 + int(c-'0')
+	}
+
+	h.version = line[:8]
+
+	return nil
+}
+
+func (h *httpParser) parseRequestLine(line []byte) error {
+	sp := bytes.IndexByte(line, ' ')
+	if sp <= 0 || !isToken(line[:sp]) {
+		return errInvalidRequestLine
+	}
+
+	method := line[:sp]
+	line = line[sp+1:]
+
+	sp = bytes.IndexByte(line, ' ')
+	if sp <= 0 || !isHTTPVersion(line[sp+1:]) {
+		return errInvalidRequestLine
+	}
+
+	target := line[:sp]
+
+	for _, c := range target {
+		if c <= ' ' || c == 0x7f {
+			return errInvalidRequestLine
+		}
+	}
+
+	switch target[0] {
+	case '/', '*':
+	default:
+		if s := bytes.Index(target, schemeSep); s > 0 && isScheme(target[:s]) { // absolute-form
+			authority := target[s+len(schemeSep):]
+
+			if e := bytes.IndexAny(authority, "/?#"); e >= 0 {
+				authority = authority[:e]
+			}
+
+			if u := bytes.LastIndexByte(authority, '@'); u >= 0 {
+				authority = authority[u+1:]
+			}
+
+			if len(authority) == 0 {
+				return errInvalidRequestLine
+			}
+
+			h.authority = authority
+		} else if string(method) == http.MethodConnect { // authority-form
+			h.authority = target
+		} else {
+			return errInvalidRequestLine
+		}
+	}
+
+	h.method = method
+	h.target = target
+	h.version = line[sp+1:]
+
+	return nil
+}
+
+func (h *httpParser) parseField(line []byte) error {
+	c := bytes.IndexByte(line, ':')
+	if c <= 0 || !isToken(line[:c]) { // also rejects obs-fold and whitespace before the colon
+		return errInvalidHeader
+	}
+
+	value := trimOWS(line[c+1:])
+
+	for _, c := range value {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return errInvalidHeader
+		}
+	}
+
+	switch name := line[:c]; {
+	case isHostField(name):
+		if h.hasHost {
+			return errDuplicateHost
+		}
+
+		h.hasHost = true
+		h.host = value
+	case bytes.EqualFold(name, fieldContentLength):
+		if h.contentLength != nil && !bytes.Equal(h.contentLength, value) {
+			return errInvalidContentLength
+		}
+
+		h.contentLength = value
+	case bytes.EqualFold(name, fieldTransferEncoding):
+		if h.transferEncoding != nil {
+			h.transferEncoding = append(append(append([]byte{}, h.transferEncoding...), ','), value...)
+		} else {
+			h.transferEncoding = value
+		}
+	case bytes.EqualFold(name, fieldUpgrade):
+		h.upgrade = true
+	case bytes.EqualFold(name, fieldConnection):
+		for option := range bytes.SplitSeq(value, []byte{','}) {
+			if bytes.EqualFold(trimOWS(option), tokenUpgrade) {
+				h.connUpgrade = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// bodyLength returns the framing of the message body, as described in RFC
+// 9112 section 6.3, with a length of -1 meaning the body continues until the
+// connection is closed.
+func (h *httpParser) bodyLength() (length int64, chunked bool, err error) {
+	if h.transferEncoding != nil {
+		if h.contentLength != nil {
+			return 0, false, errInvalidContentLength
+		}
+
+		te := h.transferEncoding
+
+		if c := bytes.LastIndexByte(te, ','); c >= 0 {
+			te = te[c+1:]
+		}
+
+		if bytes.EqualFold(trimOWS(te), codingChunked) {
+			return 0, true, nil
+		} else if h.response {
+			return -1, false, nil
+		}
+
+		return 0, false, errInvalidTransferEncoding
+	} else if h.contentLength != nil {
+		for _, c := range h.contentLength {
+			if c < '0' || c > '9' || length > (1<<62)/10 {
+				return 0, false, errInvalidContentLength
+			}
+
+			length = length*10 + int64(c-'0')
+		}
+
+		if len(h.contentLength) == 0 {
+			return 0, false, errInvalidContentLength
+		}
+
+		return length, false, nil
+	} else if h.response {
+		return -1, false, nil
+	}
+
+	return 0, false, nil
+}
+
+func (h *httpParser) serverName() (string, error) {
+	host := h.host
+
+	if !h.hasHost && string(h.version) != "HTTP/1.0" {
+		return "", errNoServerHeader
+	}
+
+	if h.authority != nil { // RFC 9112 section 3.2.2: the request-target takes precedence over Host
+		host = h.authority
+	}
+
+	if len(host) == 0 {
+		return "", errNoServerHeader
+	}
+
+	for _, c := range host {
+		if c <= ' ' || c == 0x7f || strings.IndexByte("/\\?#@,", c) >= 0 {
+			return "", errInvalidHost
+		}
+	}
+
+	return string(host), nil
+}
+
+// path returns the path of the request target, which is empty for the
+// authority-form.
+func (h *httpParser) path() string {
+	target := h.target
+
+	if h.authority != nil {
+		if string(h.method) == http.MethodConnect && !bytes.Contains(target, schemeSep) {
+			return ""
+		}
+
+		target = target[bytes.Index(target, schemeSep)+len(schemeSep):]
+
+		if e := bytes.IndexAny(target, "/?#"); e >= 0 {
+			target = target[e:]
+		} else {
+			target = nil
+		}
+	}
+
+	return requestPath(target)
+}
+
+func requestPath(target []byte) string {
+	if e := bytes.IndexAny(target, "?#"); e >= 0 {
+		target = target[:e]
+	}
+
+	if len(target) == 0 {
+		return "/"
+	}
+
+	return string(target)
+}
+
+var (
+	schemeSep             = []byte("://")
+	fieldContentLength    = []byte("Content-Length")
+	fieldTransferEncoding = []byte("Transfer-Encoding")
+	fieldUpgrade          = []byte("Upgrade")
+	fieldConnection       = []byte("Connection")
+	tokenUpgrade          = []byte("upgrade")
+	codingChunked         = []byte("chunked")
+)
+
+func isTChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func isToken(b []byte) bool {
+	for _, c := range b {
+		if !isTChar(c) {
+			return false
+		}
+	}
+
+	return len(b) > 0
+}
+
+func isScheme(b []byte) bool {
+	for n, c := range b {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case n > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func isHTTPVersion(b []byte) bool {
+	return len(b) == 8 && string(b[:5]) == "HTTP/" && '0' <= b[5] && b[5] <= '9' && b[6] == '.' && '0' <= b[7] && b[7] <= '9'
+}
+
+func isHostField(name []byte) bool {
+	return len(name) == 4 && name[0]|0x20 == 'h' && name[1]|0x20 == 'o' && name[2]|0x20 == 's' && name[3]|0x20 == 't'
+}
+
+func trimOWS(b []byte) []byte {
+	return bytes.Trim(b, " \t")
+}
+
+func hostOnly(b []byte) []byte {
+	if len(b) > 0 && b[0] == '[' {
+		if e := bytes.IndexByte(b, ']'); e > 0 {
+			return b[:e+1]
+		}
+	} else if c := bytes.LastIndexByte(b, ':'); c >= 0 {
+		return b[:c]
+	}
+
+	return b
+}
+
+// requestHead holds the request-line and header fields of an HTTP/1.x request
+// so that they can be modified before being passed to a service.
+type requestHead struct {
+	line   []byte
+	fields [][]byte
+}
+
+// splitHead splits a complete, previously parsed, request head into its lines.
+func splitHead(head []byte) requestHead {
+	var r requestHead
+
+	for len(head) > 0 {
+		line := head
+
+		if e := bytes.IndexByte(head, '\n'); e >= 0 {
+			line, head = head[:e], head[e+1:]
+		} else {
+			head = nil
+		}
+
+		line = trimEOL(line)
+
+		if r.line == nil {
+			if len(line) > 0 {
+				r.line = line
+			}
+		} else if len(line) == 0 {
+			break
+		} else {
+			r.fields = append(r.fields, line)
+		}
+	}
+
+	return r
+}
+
+// remove deletes all fields with the given name, returning their values.
+func (r *requestHead) remove(name string) [][]byte {
+	var values [][]byte
+
+	fields := r.fields[:0]
+
+	for _, field := range r.fields {
+		if isField(field, name) {
+			values = append(values, trimOWS(field[len(name)+1:]))
+		} else {
+			fields = append(fields, field)
 		}
 	}
 
-	return string(buf[h : h+l]), buf[:n], nil
+	r.fields = fields
+
+	return values
+}
+
+func isField(field []byte, name string) bool {
+	return len(field) > len(name) && field[len(name)] == ':' && strings.EqualFold(string(field[:len(name)]), name)
+}
+
+func (r *requestHead) add(name string, value []byte) {
+	r.fields = append(r.fields, append(append([]byte(name), ':', ' '), value...))
+}
+
+func (r *requestHead) bytes() []byte {
+	l := len(r.line) + 4
+
+	for _, field := range r.fields {
+		l += len(field) + 2
+	}
+
+	buf := append(append(make([]byte, 0, l), r.line...), eol...)
+
+	for _, field := range r.fields {
+		buf = append(append(buf, field...), eol...)
+	}
+
+	return append(buf, eol...)
 }
 
-var errNoServerHeader = errors.New("no server header")
+var (
+	errNoServerHeader     = errors.New("no server header")
+	errHeadersTooLarge    = errors.New("headers too large")
+	errBareCR             = errors.New("bare CR in request")
+	errInvalidRequestLine = errors.New("invalid request line")
+	errInvalidHeader      = errors.New("invalid header field")
+	errDuplicateHost      = errors.New("duplicate host header")
+	errConflictingHost    = errors.New("host header conflicts with request target")
+	errInvalidHost        = errors.New("invalid host")
+
+	errInvalidStatusLine       = errors.New("invalid status line")
+	errInvalidContentLength    = errors.New("invalid content length")
+	errInvalidTransferEncoding = errors.New("invalid transfer encoding")
+)
@@ -0,0 +1,409 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+var httpRoutingPorts = make(map[uint16]bool)
+
+// SetHTTPRouting enables or disables per-request routing of plaintext HTTP/1.x
+// connections on the given port.
+//
+// When enabled, every request on a keep-alive connection is matched against the
+// services on the port. Requests for a redirect are forwarded by the proxy,
+// which switches to another redirect when the Host changes, once all earlier
+// responses have been sent. As a connection passed to a command cannot be
+// taken back, the request handed over is given a 'Connection: close' header so
+// that the client reconnects for its next request.
+//
+// When disabled, only the first request of a connection passes through the
+// proxy, so a service with InjectHeaders or a request rewriting option, such
+// as RewriteHost, has that request given a 'Connection: close' header, which
+// stops later requests reaching the service without them.
+func SetHTTPRouting(port uint16, enabled bool) {
+	lMu.Lock()
+
+	if enabled {
+		httpRoutingPorts[port] = true
+	} else {
+		delete(httpRoutingPorts, port)
+	}
+
+	lMu.Unlock()
+}
+
+func (l *listener) httpRouting() bool {
+	lMu.RLock()
+	defer lMu.RUnlock()
+
+	return httpRoutingPorts[l.port]
+}
+
+// dialService is implemented by services that the proxy can connect to
+// directly, rather than handing over the client connection.
+type dialService interface {
+	dial() (net.Conn, error)
+}
+
+const (
+	maxPipelined  = 32
+	maxHeadLength = http.DefaultMaxHeaderBytes - 4096
+)
+
+type httpRouter struct {
+	l        *listener
+	client   *net.TCPConn
+	br       *bufio.Reader
+	port     *Port
+	backend  net.Conn
+	pending  chan pendingRequest
+	switched chan bool
+	done     chan struct{}
+}
+
+// pendingRequest is a request awaiting its response, with upgrade set for
+// requests that may switch the connection to another protocol.
+type pendingRequest struct {
+	method  string
+	upgrade bool
+}
+
+func (l *listener) routeHTTP(c *net.TCPConn, initial []byte) {
+	r := httpRouter{
+		l:      l,
+		client: c,
+		br:     bufio.NewReaderSize(io.MultiReader(bytes.NewReader(initial), c), len(initial)+maxSniffPeek),
+	}
+
+	if !r.serve() {
+		c.Close()
+	}
+}
+
+// serve routes requests until the client connection closes, returning true if
+// the connection was handed to a service.
+func (r *httpRouter) serve() bool {
+	defer r.closeBackend()
+
+	for {
+		var h httpParser
+
+		head, err := readHead(r.br, &h, maxHeadLength)
+		if err != nil {
+			if he := httpRejection(err); he != nil {
+				r.reject(he.Code, "")
+			}
+
+			return false
+		}
+
+		name, err := h.serverName()
+		if err != nil {
+			r.reject(http.StatusBadRequest, "")
+
+			return false
+		}
+
+		length, chunked, err := h.bodyLength()
+		if err != nil {
+			r.reject(http.StatusBadRequest, "")
+
+			return false
+		}
+
+		name = stripPort(name)
+
+		if port := r.l.match(name, h.path()); port != r.port && !r.l.together(port, r.port) {
+			r.closeBackend()
+
+			if port == nil {
+				r.reject(http.StatusMisdirectedRequest, name)
+
+				return false
+			}
+
+			port = r.l.split(port, remoteIP(r.client))
+
+			ds, ok := port.service.(dialService)
+			if !ok {
+				if err := port.Transfer(append(insertHeader(port.opts.rewriteHead(head, remoteIP(r.client), protoHTTP), connectionClose), buffered(r.br)...), r.client); err != nil {
+					r.reject(http.StatusServiceUnavailable, name)
+
+					return false
+				}
+
+				return true
+			}
+
+			backend, err := ds.dial()
+			if err != nil {
+				r.reject(http.StatusServiceUnavailable, name)
+
+				return false
+			}
+
+			r.port = port
+			r.backend = backend
+			r.pending = make(chan pendingRequest, maxPipelined)
+			r.switched = make(chan bool, 1)
+			r.done = make(chan struct{})
+
+			go r.copyResponses(backend, r.pending, r.switched, r.done)
+		}
+
+		upgrade := h.upgrade && h.connUpgrade || string(h.method) == http.MethodConnect
+
+		select {
+		case r.pending <- pendingRequest{method: string(h.method), upgrade: upgrade}:
+		case <-r.done:
+			return false
+		}
+
+		if _, err = r.backend.Write(r.port.opts.rewriteHead(head, remoteIP(r.client), protoHTTP)); err == nil {
+			if chunked {
+				err = copyChunked(r.backend, r.br)
+			} else {
+				_, err = io.CopyN(r.backend, r.br, length)
+			}
+		}
+
+		if err != nil {
+			r.backend.Close()
+
+			return false
+		}
+
+		if !upgrade {
+			continue
+		}
+
+		select { // only splice once the backend has accepted the switch
+		case switched := <-r.switched:
+			if !switched {
+				continue
+			}
+
+			io.Copy(r.backend, r.br)
+			r.backend.Close()
+		case <-r.done:
+		}
+
+		return false
+	}
+}
+
+func (r *httpRouter) copyResponses(backend net.Conn, pending chan pendingRequest, switched chan bool, done chan struct{}) {
+	defer close(done)
+
+	br := bufio.NewReader(backend)
+
+	for req := range pending {
+		for {
+			h := httpParser{response: true}
+
+			head, err := readHead(br, &h, maxHeadLength)
+			if err != nil {
+				r.client.Close()
+
+				return
+			}
+
+			if _, err = r.client.Write(head); err != nil {
+				return
+			}
+
+			if req.upgrade && (h.status == http.StatusSwitchingProtocols || req.method == http.MethodConnect && h.status/100 == 2) {
+				switched <- true
+
+				io.Copy(r.client, br)
+				r.client.Close()
+
+				return
+			} else if h.status == http.StatusSwitchingProtocols {
+				r.client.Close()
+
+				return
+			} else if h.status/100 == 1 {
+				continue
+			} else if req.method == http.MethodHead || h.status == http.StatusNoContent || h.status == http.StatusNotModified {
+				break
+			}
+
+			length, chunked, err := h.bodyLength()
+			if err == nil {
+				if chunked {
+					err = copyChunked(r.client, br)
+				} else if length < 0 {
+					io.Copy(r.client, br)
+
+					err = io.EOF
+				} else {
+					_, err = io.CopyN(r.client, br, length)
+				}
+			}
+
+			if err != nil {
+				r.client.Close()
+
+				return
+			}
+
+			break
+		}
+
+		if req.upgrade {
+			switched <- false
+		}
+	}
+}
+
+// closeBackend waits for all outstanding responses to be sent to the client
+// before closing the current backend connection.
+func (r *httpRouter) closeBackend() {
+	if r.backend != nil {
+		close(r.pending)
+		<-r.done
+		r.backend.Close()
+
+		r.backend = nil
+		r.port = nil
+	}
+}
+
+func (r *httpRouter) reject(code int, serviceName string) {
+	r.closeBackend()
+	r.client.Write(r.l.errorResponse(code, serviceName))
+	closeWait(r.client)
+}
+
+func readHead(br *bufio.Reader, h *httpParser, max int) ([]byte, error) {
+	var head []byte
+
+	for {
+		line, err := br.ReadSlice('\n')
+		head = append(head, line...)
+
+		if len(head) > max {
+			return head, &HTTPError{Code: http.StatusRequestHeaderFieldsTooLarge, Err: errHeadersTooLarge}
+		}
+
+		if err == nil {
+			if done, perr := h.parse(head); perr != nil {
+				return head, &HTTPError{Code: http.StatusBadRequest, Err: perr}
+			} else if done {
+				return head, nil
+			}
+		} else if !errors.Is(err, bufio.ErrBufferFull) {
+			return head, err
+		}
+	}
+}
+
+func copyChunked(w io.Writer, br *bufio.Reader) error {
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+
+		size, err := parseChunkSize(line)
+		if err != nil {
+			return err
+		}
+
+		if _, err = w.Write(line); err != nil {
+			return err
+		}
+
+		if size == 0 {
+			for { // trailer section
+				line, err = br.ReadSlice('\n')
+				if err != nil {
+					return err
+				} else if _, err = w.Write(line); err != nil {
+					return err
+				} else if len(trimEOL(line)) == 0 {
+					return nil
+				}
+			}
+		}
+
+		if _, err = io.CopyN(w, br, size); err != nil {
+			return err
+		}
+
+		if line, err = br.ReadSlice('\n'); err != nil {
+			return err
+		} else if len(trimEOL(line)) != 0 {
+			return errInvalidChunk
+		} else if _, err = w.Write(line); err != nil {
+			return err
+		}
+	}
+}
+
+func parseChunkSize(line []byte) (int64, error) {
+	line = trimEOL(line)
+
+	if e := bytes.IndexByte(line, ';'); e >= 0 {
+		line = line[:e]
+	}
+
+	line = trimOWS(line)
+
+	if len(line) == 0 || len(line) > 15 {
+		return 0, errInvalidChunk
+	}
+
+	var size int64
+
+	for _, c := range line {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c -= 'a' - 10
+		case 'A' <= c && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, errInvalidChunk
+		}
+
+		size = size<<4 | int64(c)
+	}
+
+	return size, nil
+}
+
+func trimEOL(line []byte) []byte {
+	return bytes.TrimSuffix(bytes.TrimSuffix(line, eol[1:]), eol[:1])
+}
+
+var (
+	eol             = []byte("\r\n")
+	connectionClose = []byte("Connection: close")
+)
+
+// insertHeader adds a header field to the end of a request or response head.
+func insertHeader(head, field []byte) []byte {
+	end := len(head) - 1
+
+	if end > 0 && head[end-1] == '\r' {
+		end--
+	}
+
+	return append(append(append(append(make([]byte, 0, len(head)+len(field)+2), head[:end]...), field...), eol...), head[end:]...)
+}
+
+func buffered(br *bufio.Reader) []byte {
+	b, _ := br.Peek(br.Buffered())
+
+	return b
+}
+
+var errInvalidChunk = errors.New("invalid chunk")
@@ -0,0 +1,319 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPRouting(t *testing.T) {
+	pa := getUnusedPort()
+
+	SetHTTPRouting(pa, true)
+
+	defer SetHTTPRouting(pa, false)
+
+	for _, domain := range [...]string{aDomain, bDomain} {
+		l, err := net.ListenTCP("tcp", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		defer l.Close()
+
+		go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+
+			fmt.Fprintf(w, "%s:%s:%s", domain, r.Host, body)
+		}))
+
+		p, err := AddRedirect(HostName(domain), pa, l.Addr())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		defer p.Close()
+	}
+
+	c, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(pa)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	br := bufio.NewReader(c)
+
+	for n, test := range [...]struct {
+		Host, Body, Response string
+	}{
+		{Host: aDomain, Response: aDomain + ":" + aDomain + ":"},
+		{Host: aDomain, Body: "abc", Response: aDomain + ":" + aDomain + ":abc"},
+		{Host: bDomain, Response: bDomain + ":" + bDomain + ":"},
+		{Host: bDomain, Body: "chunked", Response: bDomain + ":" + bDomain + ":chunked"},
+		{Host: aDomain, Body: "def", Response: aDomain + ":" + aDomain + ":def"},
+	} {
+		var body io.Reader
+
+		if test.Body == "chunked" {
+			body = io.MultiReader(strings.NewReader("chun"), strings.NewReader("ked"))
+		} else if test.Body != "" {
+			body = strings.NewReader(test.Body)
+		}
+
+		req, _ := http.NewRequest(http.MethodPost, "http://"+test.Host+"/", body)
+
+		if err := req.Write(c); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		data, err := io.ReadAll(resp.Body)
+
+		resp.Body.Close()
+
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(data) != test.Response {
+			t.Errorf("test %d: expecting response %q, got %q", n+1, test.Response, data)
+		}
+	}
+
+	c.Close()
+
+	c, err = net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(pa)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\nGET / HTTP/1.1\r\nHost: ccc.com\r\n\r\n"))
+
+	br = bufio.NewReader(c)
+
+	if resp, err := http.ReadResponse(br, nil); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if resp.StatusCode != http.StatusOK {
+		t.Errorf("test 6: expecting status 200, got %d", resp.StatusCode)
+	} else {
+		io.Copy(io.Discard, resp.Body)
+	}
+
+	if resp, err := http.ReadResponse(br, nil); err != nil {
+		t.Errorf("test 7: unexpected error: %s", err)
+	} else if resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("test 7: expecting status 421, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPRoutingCommand(t *testing.T) {
+	pa := getUnusedPort()
+	sa := make(testService)
+
+	SetHTTPRouting(pa, true)
+
+	defer SetHTTPRouting(pa, false)
+
+	p, err := addPort(pa, testServiceA{sa})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	go func() {
+		c, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(pa)})
+		if err == nil {
+			c.Write([]byte("GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"))
+		}
+	}()
+
+	data := <-sa
+
+	data.conn.Close()
+
+	if expected := "GET / HTTP/1.1\r\nHost: " + aDomain + "\r\nConnection: close\r\n\r\n"; string(data.buf) != expected {
+		t.Errorf("expecting buf %q, got %q", expected, data.buf)
+	}
+}
+
+func TestHTTPRoutingUpgrade(t *testing.T) {
+	pa := getUnusedPort()
+
+	SetHTTPRouting(pa, true)
+
+	defer SetHTTPRouting(pa, false)
+
+	for _, domain := range [...]string{aDomain, bDomain} {
+		l, err := net.ListenTCP("tcp", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		defer l.Close()
+
+		go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") != "echo" || !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+				fmt.Fprintf(w, "%s:%s", domain, r.Host)
+
+				return
+			}
+
+			c, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+
+			defer c.Close()
+
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: upgrade\r\nUpgrade: echo\r\n\r\n")
+			brw.Flush()
+			io.Copy(c, brw)
+		}))
+
+		p, err := AddRedirect(HostName(domain), pa, l.Addr())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		defer p.Close()
+	}
+
+	c, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(pa)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	br := bufio.NewReader(c)
+
+	for n, test := range [...]struct {
+		Host, Upgrade, Response string
+	}{
+		{Host: aDomain, Upgrade: "Upgrade: other\r\nConnection: upgrade\r\n", Response: aDomain + ":" + aDomain},
+		{Host: bDomain, Response: bDomain + ":" + bDomain},
+		{Host: aDomain, Upgrade: "Upgrade: echo\r\n", Response: aDomain + ":" + aDomain},
+		{Host: bDomain, Response: bDomain + ":" + bDomain},
+	} {
+		c.Write([]byte("GET / HTTP/1.1\r\nHost: " + test.Host + "\r\n" + test.Upgrade + "\r\n"))
+
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		data, err := io.ReadAll(resp.Body)
+
+		resp.Body.Close()
+
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(data) != test.Response {
+			t.Errorf("test %d: expecting response %q, got %q", n+1, test.Response, data)
+		}
+	}
+
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: " + aDomain + "\r\nUpgrade: echo\r\nConnection: keep-alive, Upgrade\r\n\r\n"))
+
+	if resp, err := http.ReadResponse(br, nil); err != nil {
+		t.Fatalf("test 5: unexpected error: %s", err)
+	} else if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("test 5: expecting status 101, got %d", resp.StatusCode)
+	}
+
+	const echo = "GET / HTTP/1.1\r\nHost: " + bDomain + "\r\n\r\n"
+
+	c.Write([]byte(echo))
+
+	buf := make([]byte, len(echo))
+
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if string(buf) != echo {
+		t.Errorf("test 6: expecting echo %q, got %q", echo, buf)
+	}
+}
+
+func TestHTTPRoutingCommandLarge(t *testing.T) {
+	pa := getUnusedPort()
+	sa := make(testService)
+
+	SetHTTPRouting(pa, true)
+
+	defer SetHTTPRouting(pa, false)
+
+	p, err := addPort(pa, testServiceA{sa})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	head := "POST / HTTP/1.1\r\nHost: " + aDomain + "\r\nX-Large: " + strings.Repeat("a", 10000) + "\r\nContent-Length: 20000\r\n"
+	body := strings.Repeat("b", 20000)
+
+	go func() {
+		c, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(pa)})
+		if err == nil {
+			c.Write([]byte(head + "\r\n" + body))
+		}
+	}()
+
+	data := <-sa
+
+	defer data.conn.Close()
+
+	data.conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	expected := head + "Connection: close\r\n\r\n" + body
+	got := make([]byte, len(expected))
+	n := copy(got, data.buf)
+
+	if _, err := io.ReadFull(data.conn, got[n:]); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if string(got) != expected {
+		t.Errorf("expecting %d bytes of request, got %d bytes differing", len(expected), len(got))
+	}
+}
+
+func TestCopyChunked(t *testing.T) {
+	for n, test := range [...]struct {
+		Input, Output string
+		Err           error
+	}{
+		{
+			Input:  "3\r\nabc\r\n0\r\n\r\nEXTRA",
+			Output: "3\r\nabc\r\n0\r\n\r\n",
+		},
+		{
+			Input:  "A;ext=1\r\n0123456789\r\n0\r\nTrailer: a\r\n\r\n",
+			Output: "A;ext=1\r\n0123456789\r\n0\r\nTrailer: a\r\n\r\n",
+		},
+		{
+			Input: "3\r\nabcd\r\n0\r\n\r\n",
+			Err:   errInvalidChunk,
+		},
+		{
+			Input: "x\r\n",
+			Err:   errInvalidChunk,
+		},
+	} {
+		var buf bytes.Buffer
+
+		if err := copyChunked(&buf, bufio.NewReader(strings.NewReader(test.Input))); err != test.Err {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		} else if test.Err == nil && buf.String() != test.Output {
+			t.Errorf("test %d: expecting output %q, got %q", n+1, test.Output, buf.String())
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package reverseproxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mirrorBufferSize  = 1 << 20
+	mirrorQueueLength = 256
+	mirrorDialTimeout = 5 * time.Second
+)
+
+// MirrorTo sets a redirect to copy the data sent by each client, including that
+// read to route the connection, to a shadow target, whose responses are
+// discarded.
+//
+// Data is passed to the shadow through a bounded buffer, so that a slow or
+// failed shadow never delays the client. When the buffer fills, or the shadow
+// cannot be reached, the mirroring of that connection is abandoned and counted
+// in the Dropped field of the Status of the Port.
+//
+// Requests forwarded individually with SetHTTPRouting are not mirrored.
+func MirrorTo(to net.Addr) Option {
+	return func(o *options) {
+		o.mirror = to
+	}
+}
+
+type mirror struct {
+	addr    net.Addr
+	dropped atomic.Uint64
+}
+
+func (o *options) newMirror() *mirror {
+	if o.mirror == nil {
+		return nil
+	}
+
+	return &mirror{addr: o.mirror}
+}
+
+// mirrorService is implemented by services that mirror connections.
+type mirrorService interface {
+	droppedMirrors() uint64
+}
+
+func (a *addrService) droppedMirrors() uint64 {
+	if a.mirror == nil {
+		return 0
+	}
+
+	return a.mirror.dropped.Load()
+}
+
+// tee starts mirroring a connection, returning a connection that copies all
+// data read from it to the shadow.
+func (m *mirror) tee(buf []byte, conn net.Conn) net.Conn {
+	s := &shadow{
+		mirror: m,
+		queue:  make(chan []byte, mirrorQueueLength),
+	}
+
+	s.Write(buf)
+
+	go s.run()
+
+	return &teeConn{Conn: conn, shadow: s}
+}
+
+type shadow struct {
+	*mirror
+	queue  chan []byte
+	queued atomic.Int64
+	failed atomic.Bool
+	once   sync.Once
+}
+
+// Write queues a copy of the data for the shadow, abandoning the shadow if it
+// cannot keep up. It never blocks.
+func (s *shadow) Write(p []byte) (int, error) {
+	if len(p) == 0 || s.failed.Load() {
+		return len(p), nil
+	}
+
+	if s.queued.Add(int64(len(p))) > mirrorBufferSize {
+		s.fail()
+
+		return len(p), nil
+	}
+
+	select {
+	case s.queue <- append(make([]byte, 0, len(p)), p...):
+	default:
+		s.fail()
+	}
+
+	return len(p), nil
+}
+
+func (s *shadow) fail() {
+	if !s.failed.Swap(true) {
+		s.dropped.Add(1)
+	}
+}
+
+func (s *shadow) end() {
+	s.once.Do(func() { close(s.queue) })
+}
+
+func (s *shadow) run() {
+	c, err := net.DialTimeout(s.addr.Network(), s.addr.String(), mirrorDialTimeout)
+	if err != nil {
+		s.fail()
+
+		return
+	}
+
+	defer c.Close()
+
+	go io.Copy(io.Discard, c)
+
+	for data := range s.queue {
+		if s.failed.Load() {
+			return
+		}
+
+		if _, err := c.Write(data); err != nil {
+			s.fail()
+
+			return
+		}
+
+		s.queued.Add(-int64(len(data)))
+	}
+}
+
+type teeConn struct {
+	net.Conn
+	shadow *shadow
+}
+
+func (t *teeConn) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+
+	t.shadow.Write(p[:n])
+
+	return n, err
+}
+
+func (t *teeConn) Close() error {
+	t.shadow.end()
+
+	return t.Conn.Close()
+}
@@ -0,0 +1,159 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	echo, err := net.ResolveTCPAddr("tcp", listenTest(t, echoConn).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	received := make(chan []byte, 1)
+	shadow := listenTest(t, func(c net.Conn) {
+		c.Write([]byte("ignored"))
+
+		data, _ := io.ReadAll(c)
+		received <- data
+
+		c.Close()
+	})
+
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, echo, MirrorTo(shadow))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	const (
+		req  = "GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"
+		more = "more data"
+	)
+
+	c.Write([]byte(req))
+
+	buf := make([]byte, len(req))
+
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(buf) != req {
+		t.Errorf("test 1: expecting %q, got %q", req, buf)
+	}
+
+	c.Write([]byte(more))
+
+	buf = buf[:len(more)]
+
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if string(buf) != more {
+		t.Errorf("test 2: expecting %q, got %q", more, buf)
+	}
+
+	c.Close()
+
+	select {
+	case data := <-received:
+		if string(data) != req+more {
+			t.Errorf("test 3: expecting %q, got %q", req+more, data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("test 3: timed out waiting for shadow")
+	}
+
+	if d := p.Status().Dropped; d != 0 {
+		t.Errorf("test 4: expecting no dropped mirrors, got %d", d)
+	}
+}
+
+func TestMirrorFailure(t *testing.T) {
+	echo, err := net.ResolveTCPAddr("tcp", listenTest(t, echoConn).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	shadow := l.Addr()
+
+	l.Close()
+
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, echo, MirrorTo(shadow))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	const req = "GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"
+
+	c.Write([]byte(req))
+
+	buf := make([]byte, len(req))
+
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(buf) != req {
+		t.Errorf("test 1: expecting %q, got %q", req, buf)
+	}
+
+	for range 50 {
+		if p.Status().Dropped == 1 {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Errorf("test 2: expecting 1 dropped mirror, got %d", p.Status().Dropped)
+}
+
+func TestShadowBound(t *testing.T) {
+	m := &mirror{addr: HostAddr{Net: "tcp"}}
+	s := &shadow{mirror: m, queue: make(chan []byte, mirrorQueueLength)}
+
+	s.Write(make([]byte, mirrorBufferSize))
+
+	if s.failed.Load() {
+		t.Fatalf("test 1: expecting shadow not to have failed")
+	}
+
+	s.Write([]byte{0})
+
+	if !s.failed.Load() {
+		t.Errorf("test 2: expecting shadow to have failed")
+	} else if d := m.dropped.Load(); d != 1 {
+		t.Errorf("test 2: expecting 1 dropped mirror, got %d", d)
+	}
+
+	s.Write([]byte{0})
+
+	if d := m.dropped.Load(); d != 1 {
+		t.Errorf("test 3: expecting 1 dropped mirror, got %d", d)
+	}
+}
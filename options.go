@@ -0,0 +1,87 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+)
+
+// Option is used to set optional behaviour on a service.
+type Option func(*options)
+
+type options struct {
+	forward ForwardHeader
+	trust   TrustPolicy
+
+	host          string
+	stripPrefix   string
+	addPrefix     string
+	setHeaders    [][2]string
+	removeHeaders []string
+
+	tlsConfig   *tls.Config
+	upstreamTLS *tls.Config
+	tlsPolicy   *TLSPolicy
+	dialer      Dialer
+	mirror      net.Addr
+	echBackend  bool
+
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	claimPorts []uint16
+	claimAll   bool
+}
+
+func makeOptions(opts []Option) options {
+	var o options
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// rewrite applies the options to a plaintext HTTP/1.x request, where buf holds
+// the request head followed by any of the body that has already been read.
+func (o *options) rewrite(buf []byte, ip net.IP, proto string) []byte {
+	if !o.rewritesHTTP() || len(buf) == 0 || buf[0] == 22 || bytes.HasPrefix(buf, h2Preface) {
+		return buf
+	}
+
+	var h httpParser
+
+	if done, err := h.parse(buf); !done || err != nil {
+		return buf
+	}
+
+	// later requests on the connection would not be rewritten
+	return append(insertHeader(o.rewriteHead(buf[:h.pos], ip, proto), connectionClose), buf[h.pos:]...)
+}
+
+func (o *options) rewritesHTTP() bool {
+	return o.forward != 0 || o.rewritesRequest()
+}
+
+// rewriteHead applies the options to a complete HTTP/1.x request head, which
+// was received using the given protocol, either http or https.
+func (o *options) rewriteHead(head []byte, ip net.IP, proto string) []byte {
+	if !o.rewritesHTTP() {
+		return head
+	}
+
+	r := splitHead(head)
+
+	o.rewriteRequest(&r)
+	o.forwardHeaders(&r, ip, proto)
+
+	return r.bytes()
+}
+
+func remoteIP(c net.Conn) net.IP {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return nil
+}
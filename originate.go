@@ -0,0 +1,73 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// OriginateTLS sets a redirect or forward to connect to its target over TLS,
+// using the given config, which can hold a ServerName, RootCAs, client
+// Certificates for mutual TLS, a MinVersion, or InsecureSkipVerify.
+//
+// When the config has no ServerName, the host of the target address is used.
+//
+// As connections are encrypted as a whole, this is intended for plaintext
+// traffic, which includes that decrypted with TerminateTLS. Failed handshakes
+// are reported in the Err field of the Status of the Port.
+func OriginateTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.upstreamTLS = config
+	}
+}
+
+// errService is implemented by services that record the last error
+// encountered connecting to their target.
+type errService interface {
+	lastError() error
+}
+
+func upstreamConfig(config *tls.Config, to net.Addr) *tls.Config {
+	if config == nil || config.ServerName != "" {
+		return config
+	}
+
+	config = config.Clone()
+
+	if host, _, err := net.SplitHostPort(to.String()); err == nil {
+		config.ServerName = host
+	} else {
+		config.ServerName = to.String()
+	}
+
+	return config
+}
+
+// originate performs the TLS handshake with the target of the redirect,
+// recording the result.
+func (a *addrService) originate(c net.Conn) (net.Conn, error) {
+	tc := tls.Client(c, a.tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	err := tc.HandshakeContext(ctx)
+
+	cancel()
+
+	a.mu.Lock()
+	a.err = err
+	a.mu.Unlock()
+
+	if err != nil {
+		tc.Close()
+
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+func (a *addrService) lastError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.err
+}
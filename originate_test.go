@@ -0,0 +1,144 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestOriginateTLS(t *testing.T) {
+	cert := testCertificate(t, "upstream.test")
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	pool := x509.NewCertPool()
+
+	pool.AddCert(leaf)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer l.Close()
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s:%t", r.Host, r.TLS != nil)
+	}))
+
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, l.Addr(), OriginateTLS(&tls.Config{ServerName: "upstream.test", RootCAs: pool}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	q, err := AddRedirect(HostName(bDomain), pa, l.Addr(), OriginateTLS(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+aDomain+"/", nil)
+
+	req.Write(c)
+
+	if resp, err := http.ReadResponse(bufio.NewReader(c), req); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if body, _ := io.ReadAll(resp.Body); string(body) != aDomain+":true" {
+		t.Errorf("test 1: expecting body %q, got %q", aDomain+":true", body)
+	}
+
+	if err := p.Status().Err; err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	}
+
+	d, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 3: unexpected error: %s", err)
+	}
+
+	defer d.Close()
+
+	req, _ = http.NewRequest(http.MethodGet, "http://"+bDomain+"/", nil)
+
+	req.Write(d)
+
+	if resp, err := http.ReadResponse(bufio.NewReader(d), req); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("test 3: expecting status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	if err := q.Status().Err; err == nil {
+		t.Errorf("test 4: expecting handshake error, got none")
+	}
+}
+
+func TestOriginateTLSForward(t *testing.T) {
+	cert := testCertificate(t, "upstream.test")
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	pool := x509.NewCertPool()
+
+	pool.AddCert(leaf)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	pa := getUnusedPort()
+
+	p, err := AddForward(pa, l.Addr(), OriginateTLS(&tls.Config{ServerName: "upstream.test", RootCAs: pool}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	c.Write([]byte("PING"))
+
+	buf := make([]byte, 4)
+
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(buf) != "PING" {
+		t.Errorf("test 1: expecting %q, got %q", "PING", buf)
+	}
+
+	if err := p.Status().Err; err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,168 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"sync/atomic"
+)
+
+// TLSPolicy describes the ClientHellos accepted by a service, allowing
+// obviously bad handshakes to be refused before they reach it, even when the
+// proxy does not terminate TLS.
+type TLSPolicy struct {
+	// MinVersion is the lowest TLS version accepted, such as
+	// tls.VersionTLS13, taken from the supported_versions extension, when
+	// present, or the legacy version field. Zero accepts TLS 1.2 and above.
+	MinVersion uint16
+
+	// RequireSNI refuses ClientHellos without a server name. As services on
+	// shared ports are matched by server name, this only affects those that
+	// claim their ports.
+	RequireSNI bool
+
+	// ALPN, when not empty, refuses ClientHellos that do not offer at least
+	// one of the given protocols.
+	ALPN []string
+}
+
+// EnforceTLSPolicy sets a service to refuse the TLS connections that do not
+// meet the policy, answering with a TLS alert.
+//
+// On a claimed port, where the ClientHello is not otherwise read, the client
+// is required to send before the server, and connections that do not start
+// with a TLS handshake are closed, so the policy should only be set for
+// services that speak TLS.
+func EnforceTLSPolicy(policy TLSPolicy) Option {
+	return func(o *options) {
+		if policy.MinVersion == 0 {
+			policy.MinVersion = tls.VersionTLS12
+		}
+
+		policy.ALPN = slices.Clone(policy.ALPN)
+		o.tlsPolicy = &policy
+	}
+}
+
+// TLSRejections holds the number of connections refused by a TLSPolicy, by
+// reason.
+type TLSRejections struct {
+	Version uint64
+	SNI     uint64
+	ALPN    uint64
+}
+
+type tlsRejections struct {
+	version, sni, alpn atomic.Uint64
+}
+
+func (t *tlsRejections) counts() TLSRejections {
+	return TLSRejections{
+		Version: t.version.Load(),
+		SNI:     t.sni.Load(),
+		ALPN:    t.alpn.Load(),
+	}
+}
+
+// check returns a TLSError if the ClientHello does not meet the policy of the
+// Port, counting the rejection.
+func (p *Port) check(h *clientHello) error {
+	policy := p.opts.tlsPolicy
+	if policy == nil || h == nil {
+		return nil
+	}
+
+	if helloVersion(h) < policy.MinVersion {
+		p.rejections.version.Add(1)
+
+		return &TLSError{Alert: AlertProtocolVersion, Err: ErrTLSVersion}
+	}
+
+	if policy.RequireSNI && h.serverName == "" {
+		p.rejections.sni.Add(1)
+
+		return &TLSError{Alert: AlertUnrecognizedName, Err: errNoName}
+	}
+
+	if len(policy.ALPN) > 0 && !slices.ContainsFunc(h.alpn, func(proto string) bool { return slices.Contains(policy.ALPN, proto) }) {
+		p.rejections.alpn.Add(1)
+
+		return &TLSError{Alert: AlertNoApplicationProtocol, Err: ErrTLSALPN}
+	}
+
+	return nil
+}
+
+// helloVersion returns the highest version offered by the ClientHello.
+func helloVersion(h *clientHello) uint16 {
+	if versions := withoutGREASE(h.supportedVersions); len(versions) > 0 {
+		return slices.Max(versions)
+	}
+
+	return h.version
+}
+
+// transferChecked passes a connection to a claimed port once the ClientHello
+// that it starts with has been checked against the TLSPolicy of the Port,
+// closing any connection that does not start with a TLS handshake.
+func (l *listener) transferChecked(p *Port, c *net.TCPConn) {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(c)
+
+	b := tlsPool.Get().(*[]byte)
+
+	var data []byte
+
+	defer func() {
+		used := (*b)[:min(len(data), len(*b))]
+
+		for n := range used {
+			used[n] = 0
+		}
+
+		tlsPool.Put(b)
+		br.Reset(nil)
+		readerPool.Put(br)
+	}()
+
+	if first, err := br.Peek(1); err != nil || first[0] != 22 {
+		c.Close()
+
+		return
+	}
+
+	(*b)[0], _ = br.ReadByte()
+
+	data, err := readTLSRecord(br, *b)
+	if err != nil {
+		l.reject(c, TLSSniffer, data, "", err)
+
+		return
+	}
+
+	h := new(clientHello)
+
+	if err = h.parse(data[5:]); err == nil {
+		err = p.check(h)
+	}
+
+	if err != nil {
+		l.reject(c, TLSSniffer, data, "", err)
+
+		return
+	}
+
+	data = append(data, buffered(br)...)
+
+	if err := p.Transfer(data, c); err != nil {
+		c.Close()
+	}
+}
+
+// Errors.
+var (
+	ErrTLSVersion = errors.New("TLS version not accepted")
+	ErrTLSALPN    = errors.New("no accepted application protocol")
+)
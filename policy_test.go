@@ -0,0 +1,105 @@
+package reverseproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	echo, err := net.ResolveTCPAddr("tcp", listenTest(t, echoConn).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	send := func(port uint16, hello []byte) string {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		defer c.Close()
+
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write(hello)
+
+		buf := make([]byte, len(hello))
+		n, _ := io.ReadFull(c, buf)
+
+		return string(buf[:n])
+	}
+
+	alert := func(a TLSAlert) string {
+		return string([]byte{21, 3, 3, 0, 2, 2, byte(a)})
+	}
+
+	pa, pb, pc := getUnusedPort(), getUnusedPort(), getUnusedPort()
+	ports := make(map[uint16]*Port)
+
+	for _, p := range [...]struct {
+		Port   uint16
+		Policy TLSPolicy
+		Claim  bool
+	}{
+		{pa, TLSPolicy{MinVersion: tls.VersionTLS13, ALPN: []string{"h2"}}, false},
+		{pb, TLSPolicy{ALPN: []string{"acme-tls/1"}}, false},
+		{pc, TLSPolicy{RequireSNI: true}, true},
+	} {
+		var (
+			port *Port
+			err  error
+		)
+
+		if p.Claim {
+			port, err = AddForward(p.Port, echo, EnforceTLSPolicy(p.Policy))
+		} else {
+			port, err = AddRedirect(HostName(aDomain), p.Port, echo, EnforceTLSPolicy(p.Policy))
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		defer port.Close()
+
+		ports[p.Port] = port
+	}
+
+	modern := testClientHello(aDomain)
+	legacy := tlsServerName(aDomain)
+	noSNI := tlsServerName("")
+
+	for n, test := range [...]struct {
+		Port     uint16
+		Hello    []byte
+		Expected string
+	}{
+		{pa, modern, string(modern)},
+		{pa, legacy, alert(AlertProtocolVersion)},
+		{pb, modern, alert(AlertNoApplicationProtocol)},
+		{pb, legacy, alert(AlertNoApplicationProtocol)},
+		{pc, modern, string(modern)},
+		{pc, noSNI, alert(AlertUnrecognizedName)},
+		{pc, []byte("PLAIN"), ""},
+	} {
+		if got := send(test.Port, test.Hello); got != test.Expected {
+			t.Errorf("test %d: expecting %q, got %q", n+1, test.Expected, got)
+		}
+	}
+
+	for n, test := range [...]struct {
+		Port     uint16
+		Expected TLSRejections
+	}{
+		{pa, TLSRejections{Version: 1}},
+		{pb, TLSRejections{ALPN: 2}},
+		{pc, TLSRejections{SNI: 1}},
+	} {
+		if got := ports[test.Port].Status().Rejected; got != test.Expected {
+			t.Errorf("test %d: expecting rejections %v, got %v", n+8, test.Expected, got)
+		}
+	}
+}
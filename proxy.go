@@ -2,11 +2,14 @@
 package reverseproxy // import "vimagination.zapto.org/reverseproxy"
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
-	"io"
+	"fmt"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -16,9 +19,11 @@ var (
 
 type listener struct {
 	*net.TCPListener
+	port uint16
 
-	mu    sync.RWMutex
-	ports map[*Port]struct{}
+	mu      sync.RWMutex
+	ports   map[*Port]struct{}
+	claimed *Port
 }
 
 var (
@@ -66,67 +71,157 @@ func (l *listener) listen() {
 }
 
 func (l *listener) transfer(c *net.TCPConn) {
-	var tlsByte [1]byte
-
-	if n, err := io.ReadFull(c, tlsByte[:]); n == 1 && err == nil {
-		var (
-			name           string
-			pool           *sync.Pool
-			readServerName func(io.Reader, []byte) (string, []byte, error)
-		)
-
-		if tlsByte[0] == 22 {
-			pool = &tlsPool
-			readServerName = readTLSServerName
-		} else {
-			pool = &httpPool
-			readServerName = readHTTPServerName
+	if port := l.claimedPort(); port != nil {
+		if port.opts.tlsPolicy != nil {
+			l.transferChecked(port, c)
+		} else if err := port.Transfer(nil, c); err != nil {
+			c.Close()
+		}
+
+		return
+	}
+
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(c)
+
+	defer func() {
+		br.Reset(nil)
+		readerPool.Put(br)
+	}()
+
+	if _, err := br.Peek(1); err == nil {
+		for _, s := range l.sniffers() {
+			if l.sniff(c, br, s) {
+				return
+			}
 		}
+	}
 
+	c.Close()
+}
+
+// sniff tries to route the connection using the given Sniffer, returning false
+// if the Sniffer did not recognise the connection.
+func (l *listener) sniff(c *net.TCPConn, br *bufio.Reader, s Sniffer) bool {
+	var (
+		name, path string
+		hello      *clientHello
+		buf, data  []byte
+		err        error
+	)
+
+	if ps, ok := s.(pooledSniffer); ok {
+		pool := ps.pool()
 		b := pool.Get().(*[]byte)
-		buf := *b
-		buf[0] = tlsByte[0]
 
-		name, buf, err = readServerName(c, buf)
-		if err == nil {
-			if host, _, err := net.SplitHostPort(name); err == nil {
-				name = host
+		defer func() {
+			used := (*b)[:min(max(len(buf), len(data)), len(*b))]
+
+			for n := range used {
+				used[n] = 0
 			}
 
-			var port *Port
+			pool.Put(b)
+		}()
 
-			l.mu.RLock()
+		name, path, hello, buf, err = ps.sniff(br, *b)
+	} else {
+		name, buf, err = s.Sniff(br)
+	}
 
-			for p := range l.ports {
-				if p.MatchService(name) {
-					port = p
+	if errors.Is(err, ErrNotSniffed) {
+		return false
+	}
 
-					break
+	data = buf
+
+	var (
+		fp       *Fingerprint
+		echOuter bool
+	)
+
+	if err == nil {
+		data = append(buf, buffered(br)...)
+		name = stripPort(name)
+		_, isTLS := s.(tlsSniffer)
+		_, isHTTP := s.(httpSniffer)
+
+		if hello != nil {
+			fp = hello.fingerprint()
+
+			if hello.ech != nil {
+				if inner := l.openECH(hello); inner != "" {
+					name = inner
+				} else {
+					echOuter = true
 				}
 			}
+		}
 
-			l.mu.RUnlock()
+		if l.denied(fp) {
+			err = &TLSError{Alert: AlertAccessDenied, Err: ErrFingerprintDenied}
+		} else if isHTTP && l.tunnelling(data) {
+			err = l.tunnel(c, data, name)
+		} else if port := l.routeHello(name, path, fp, echOuter, remoteIP(c)); port == nil {
+			err = ErrNoService
+		} else if perr := port.check(hello); perr != nil {
+			err = perr
+		} else if isHTTP && !bytes.HasPrefix(data, h2Preface) && l.httpRouting() {
+			go l.routeHTTP(c, append(make([]byte, 0, len(data)), data...))
+		} else if isTLS && port.opts.tlsConfig != nil {
+			go port.terminate(c, append(make([]byte, 0, len(data)), data...))
+		} else {
+			if isHTTP {
+				data = port.opts.rewrite(data, remoteIP(c), protoHTTP)
+			}
 
-			if port != nil {
-				port.Transfer(buf, c)
+			if err = port.Transfer(data, c); err != nil && !errors.Is(err, ErrFaultRefused) {
+				err = fmt.Errorf("%w: %w", ErrServiceUnavailable, err)
 			}
-		} else {
-			c.Close()
 		}
+	}
 
-		for n := range buf {
-			buf[n] = 0
-		}
+	l.logAccess(c, name, path, fp, err)
 
-		pool.Put(b)
-	} else {
-		c.Close()
+	if err != nil {
+		l.reject(c, s, data, name, err)
+	}
+
+	return true
+}
+
+func stripPort(name string) string {
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		return host
+	}
+
+	return name
+}
+
+// match finds the service for the given name and, for plaintext HTTP, path,
+// preferring the service with the longest matching path prefix.
+func (l *listener) match(name, path string) *Port {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var (
+		match *Port
+		best  = -1
+	)
+
+	for p := range l.ports {
+		if n := matchServicePath(p.service, name, path); n > best {
+			match = p
+			best = n
+		}
 	}
+
+	return match
 }
 
 type service interface {
 	MatchServiceName
-	Transfer([]byte, *net.TCPConn)
+	Transfer([]byte, *net.TCPConn) error
 	Active() bool
 }
 
@@ -135,17 +230,37 @@ type Port struct {
 	service
 	port   uint16
 	closed bool
+	opts   options
+	faults atomic.Pointer[Faults]
+
+	rejections tlsRejections
 }
 
-func addPort(port uint16, service service) (*Port, error) {
+func addPort(port uint16, service service, opts ...Option) (*Port, error) {
 	if port == 0 {
 		return nil, ErrInvalidPort
 	}
 
+	p := &Port{
+		service: service,
+		port:    port,
+		opts:    makeOptions(opts),
+	}
+	claim := p.opts.claims(port)
+
 	lMu.Lock()
+	defer lMu.Unlock()
 
 	l, ok := listeners[port]
-	if !ok {
+	if ok {
+		l.mu.RLock()
+		claimed := l.claimed != nil || claim && len(l.ports) > 0
+		l.mu.RUnlock()
+
+		if claimed {
+			return nil, ErrPortClaimed
+		}
+	} else {
 		nl, err := net.ListenTCP("tcp", &net.TCPAddr{Port: int(port)})
 		if err != nil {
 			return nil, err
@@ -153,6 +268,7 @@ func addPort(port uint16, service service) (*Port, error) {
 
 		l = &listener{
 			TCPListener: nl,
+			port:        port,
 			ports:       make(map[*Port]struct{}),
 		}
 
@@ -161,15 +277,14 @@ func addPort(port uint16, service service) (*Port, error) {
 		listeners[port] = l
 	}
 
-	lMu.Unlock()
+	l.mu.Lock()
 
-	p := &Port{
-		service: service,
-		port:    port,
+	l.ports[p] = struct{}{}
+
+	if claim {
+		l.claimed = p
 	}
 
-	l.mu.Lock()
-	l.ports[p] = struct{}{}
 	l.mu.Unlock()
 
 	return p, nil
@@ -186,6 +301,10 @@ func (p *Port) Close() error {
 
 			delete(l.ports, p)
 
+			if l.claimed == p {
+				l.claimed = nil
+			}
+
 			if len(l.ports) == 0 {
 				delete(listeners, p.port)
 				l.Close()
@@ -211,6 +330,22 @@ func (p *Port) Closed() bool {
 type Status struct {
 	Ports           []uint16
 	Closing, Active bool
+
+	// Err holds the last error encountered connecting to the target of a
+	// redirect, such as a failed TLS handshake.
+	Err error
+
+	// Backends holds the current targets of a redirect added with
+	// AddDiscoveredRedirect.
+	Backends []string
+
+	// Dropped holds the number of connections whose mirroring, set with
+	// MirrorTo, was abandoned.
+	Dropped uint64
+
+	// Rejected holds the number of connections refused by the TLSPolicy of
+	// the Port, set with EnforceTLSPolicy.
+	Rejected TLSRejections
 }
 
 // Status retrieves the status of a Port.
@@ -219,14 +354,31 @@ func (p *Port) Status() Status {
 	closed := p.closed
 	lMu.RUnlock()
 
-	return Status{
+	s := Status{
 		Ports:   []uint16{p.port},
 		Closing: closed,
 		Active:  p.service.Active(),
 	}
+
+	if es, ok := p.service.(errService); ok {
+		s.Err = es.lastError()
+	}
+
+	if bs, ok := p.service.(backendService); ok {
+		s.Backends = bs.backends()
+	}
+
+	if ms, ok := p.service.(mirrorService); ok {
+		s.Dropped = ms.droppedMirrors()
+	}
+
+	s.Rejected = p.rejections.counts()
+
+	return s
 }
 
 // Errors.
 var (
 	ErrInvalidPort = errors.New("cannot register on port 0")
+	ErrPortClaimed = errors.New("port claimed by another service")
 )
@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"testing"
+	"time"
 )
 
 const (
@@ -20,8 +21,10 @@ type testData struct {
 
 type testService chan testData
 
-func (t testService) Transfer(buf []byte, conn *net.TCPConn) {
+func (t testService) Transfer(buf []byte, conn *net.TCPConn) error {
 	t <- testData{append(make([]byte, 0, len(buf)), buf...), conn}
+
+	return nil
 }
 
 func (t testService) Active() bool {
@@ -300,3 +303,98 @@ func TestListener(t *testing.T) {
 
 	l.Close()
 }
+
+func TestPathPrefix(t *testing.T) {
+	pa := getUnusedPort()
+	sa := make(testService)
+	sb := make(testService)
+	sc := make(testService)
+
+	for _, s := range [...]pathService{
+		{HostName(aDomain), sa},
+		{PathPrefix{Host: HostName(aDomain), Prefix: "/api/"}, sb},
+		{Hosts{HostName(bDomain), PathPrefix{Host: HostName(aDomain), Prefix: "/api/v2"}}, sc},
+	} {
+		p, err := addPort(pa, s)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		defer p.Close()
+	}
+
+	for n, test := range [...]struct {
+		Host, Target string
+		Service      testService
+	}{
+		{aDomain, "/", sa},
+		{aDomain, "/apis", sa},
+		{aDomain, "/api", sb},
+		{aDomain, "/api/v1/a?b", sb},
+		{aDomain, "http://" + aDomain + "/api/v2", sc},
+		{aDomain, "/api/v2/", sc},
+		{bDomain, "/api/", sc},
+	} {
+		go func() {
+			c, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(pa)})
+			if err == nil {
+				c.Write([]byte("GET " + test.Target + " HTTP/1.1\r\nHost: " + test.Host + "\r\n\r\n"))
+			}
+		}()
+
+		var (
+			got  testService
+			data testData
+		)
+
+		select {
+		case data = <-sa:
+			got = sa
+		case data = <-sb:
+			got = sb
+		case data = <-sc:
+			got = sc
+		}
+
+		data.conn.Close()
+
+		if got != test.Service {
+			t.Errorf("test %d: request routed to wrong service", n+1)
+		}
+	}
+}
+
+func TestListenErrorUnlocks(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer l.Close()
+
+	if _, err := addPort(uint16(l.Addr().(*net.TCPAddr).Port), testServiceA{make(testService)}); err == nil {
+		t.Fatal("test 1: expecting error listening on used port")
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		SetHTTPRouting(getUnusedPort(), false)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("test 2: listener lock not released after listen error")
+	}
+}
+
+type pathService struct {
+	MatchServiceName
+	testService
+}
+
+func (p pathService) MatchServicePath(serviceName, path string) int {
+	return matchServicePath(p.MatchServiceName, serviceName, path)
+}
@@ -0,0 +1,371 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+const (
+	quicVersion1     = 1
+	quicMaxHello     = 1<<16 - 1
+	quicMaxConnIDLen = 20
+
+	quicFramePadding   = 0x00
+	quicFramePing      = 0x01
+	quicFrameAck       = 0x02
+	quicFrameAckECN    = 0x03
+	quicFrameCrypto    = 0x06
+	quicFrameConnClose = 0x1c
+)
+
+var quicV1Salt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+
+type quicChunk struct {
+	offset uint64
+	data   []byte
+}
+
+// quicHello collects the CRYPTO frames from the Initial packets sent by a QUIC
+// client until the whole ClientHello has been received, which, for large
+// hellos, can span several datagrams, with frames in any order.
+type quicHello struct {
+	dcid   []byte
+	aead   cipher.AEAD
+	iv     []byte
+	hp     cipher.Block
+	chunks []quicChunk
+	size   int
+}
+
+// add processes a datagram from the client, returning the server name once the
+// ClientHello is complete.
+func (q *quicHello) add(datagram []byte) (string, bool, error) {
+	for len(datagram) > 0 && datagram[0]&0x80 != 0 {
+		if len(datagram) < 7 {
+			return "", false, errInvalidQUICPacket
+		}
+
+		if binary.BigEndian.Uint32(datagram[1:5]) != quicVersion1 {
+			return "", false, errUnsupportedQUICVersion
+		}
+
+		isInitial := datagram[0]&0x30 == 0
+		p := 5
+
+		dcidLen := int(datagram[p])
+		p++
+
+		if dcidLen > quicMaxConnIDLen || len(datagram) < p+dcidLen+1 {
+			return "", false, errInvalidQUICPacket
+		}
+
+		dcid := datagram[p : p+dcidLen]
+		p += dcidLen
+
+		scidLen := int(datagram[p])
+		p++
+
+		if scidLen > quicMaxConnIDLen || len(datagram) < p+scidLen {
+			return "", false, errInvalidQUICPacket
+		}
+
+		p += scidLen
+
+		if isInitial {
+			tokenLen, n := quicVarint(datagram[p:])
+			if n == 0 || uint64(len(datagram)-p-n) < tokenLen {
+				return "", false, errInvalidQUICPacket
+			}
+
+			p += n + int(tokenLen)
+		}
+
+		length, n := quicVarint(datagram[p:])
+		if n == 0 || uint64(len(datagram)-p-n) < length {
+			return "", false, errInvalidQUICPacket
+		}
+
+		p += n
+		packet := datagram[:p+int(length)]
+		datagram = datagram[p+int(length):]
+
+		if !isInitial {
+			continue
+		}
+
+		if q.dcid == nil {
+			if err := q.setKeys(dcid); err != nil {
+				return "", false, err
+			}
+		} else if !bytes.Equal(q.dcid, dcid) {
+			continue
+		}
+
+		payload, err := q.decrypt(append(make([]byte, 0, len(packet)), packet...), p)
+		if err != nil {
+			return "", false, err
+		}
+
+		if err := q.frames(payload); err != nil {
+			return "", false, err
+		}
+	}
+
+	hello := q.clientHello()
+	if hello == nil {
+		return "", false, nil
+	}
+
+	return quicServerName(hello)
+}
+
+func (q *quicHello) setKeys(dcid []byte) error {
+	initial, err := hkdf.Extract(sha256.New, dcid, quicV1Salt)
+	if err != nil {
+		return err
+	}
+
+	client, err := hkdfExpandLabel(initial, "client in", sha256.Size)
+	if err != nil {
+		return err
+	}
+
+	key, err := hkdfExpandLabel(client, "quic key", 16)
+	if err != nil {
+		return err
+	}
+
+	if q.iv, err = hkdfExpandLabel(client, "quic iv", 12); err != nil {
+		return err
+	}
+
+	hp, err := hkdfExpandLabel(client, "quic hp", 16)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	if q.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+
+	if q.hp, err = aes.NewCipher(hp); err != nil {
+		return err
+	}
+
+	q.dcid = append(make([]byte, 0, len(dcid)), dcid...)
+
+	return nil
+}
+
+func hkdfExpandLabel(secret []byte, label string, length int) ([]byte, error) {
+	const prefix = "tls13 "
+
+	info := make([]byte, 0, 4+len(prefix)+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(prefix)+len(label)))
+	info = append(append(append(info, prefix...), label...), 0)
+
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+// decrypt removes the header protection from the packet, which starts its
+// packet number at pnOffset, and decrypts the payload in place.
+func (q *quicHello) decrypt(packet []byte, pnOffset int) ([]byte, error) {
+	if len(packet) < pnOffset+4+aes.BlockSize {
+		return nil, errInvalidQUICPacket
+	}
+
+	var mask [aes.BlockSize]byte
+
+	q.hp.Encrypt(mask[:], packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	packet[0] ^= mask[0] & 0x0f
+	pnLen := int(packet[0]&3) + 1
+
+	var pn uint64
+
+	for n := range pnLen {
+		packet[pnOffset+n] ^= mask[1+n]
+		pn = pn<<8 | uint64(packet[pnOffset+n])
+	}
+
+	nonce := append(make([]byte, 0, len(q.iv)), q.iv...)
+
+	for n := range 8 {
+		nonce[len(nonce)-1-n] ^= byte(pn >> (8 * n))
+	}
+
+	header := pnOffset + pnLen
+
+	payload, err := q.aead.Open(packet[header:header], nonce, packet[header:], packet[:header])
+	if err != nil {
+		return nil, errInvalidQUICPacket
+	}
+
+	return payload, nil
+}
+
+// frames collects the CRYPTO frames from a decrypted Initial payload, which
+// may only otherwise contain the PADDING, PING, ACK and CONNECTION_CLOSE
+// frames.
+func (q *quicHello) frames(payload []byte) error {
+	for len(payload) > 0 {
+		switch payload[0] {
+		case quicFramePadding, quicFramePing:
+			payload = payload[1:]
+		case quicFrameAck, quicFrameAckECN:
+			fields := 4
+
+			if payload[0] == quicFrameAckECN {
+				fields += 3
+			}
+
+			payload = payload[1:]
+
+			for n := 0; n < fields; n++ {
+				v, l := quicVarint(payload)
+				if l == 0 {
+					return errInvalidQUICFrame
+				}
+
+				payload = payload[l:]
+
+				if n == 2 { // ACK Range Count
+					fields += 2 * int(min(v, uint64(len(payload))))
+				}
+			}
+		case quicFrameCrypto:
+			offset, n := quicVarint(payload[1:])
+			if n == 0 {
+				return errInvalidQUICFrame
+			}
+
+			payload = payload[1+n:]
+
+			length, n := quicVarint(payload)
+			if n == 0 || uint64(len(payload)-n) < length {
+				return errInvalidQUICFrame
+			}
+
+			data := payload[n : n+int(length)]
+			payload = payload[n+int(length):]
+
+			if offset+length > quicMaxHello || q.size+len(data) > quicMaxHello {
+				return errQUICHelloTooLarge
+			}
+
+			q.size += len(data)
+			q.chunks = append(q.chunks, quicChunk{offset: offset, data: append(make([]byte, 0, len(data)), data...)})
+		case quicFrameConnClose:
+			return errQUICClosed
+		default:
+			return errInvalidQUICFrame
+		}
+	}
+
+	return nil
+}
+
+// clientHello returns the ClientHello handshake message if all of it has been
+// received.
+func (q *quicHello) clientHello() []byte {
+	slices.SortFunc(q.chunks, func(a, b quicChunk) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+
+	var (
+		hello []byte
+		end   uint64
+	)
+
+	for _, c := range q.chunks {
+		if c.offset > end {
+			break
+		}
+
+		if last := c.offset + uint64(len(c.data)); last > end {
+			hello = append(hello, c.data[end-c.offset:]...)
+			end = last
+		}
+	}
+
+	if len(hello) < 4 {
+		return nil
+	}
+
+	length := 4 + (int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3]))
+	if len(hello) < length {
+		return nil
+	}
+
+	return hello[:length]
+}
+
+// quicServerName reads the server name from a ClientHello by presenting it as a
+// TLS record.
+func quicServerName(hello []byte) (string, bool, error) {
+	if len(hello) > quicMaxHello {
+		return "", false, errQUICHelloTooLarge
+	}
+
+	b := tlsPool.Get().(*[]byte)
+	buf := *b
+
+	defer func() {
+		for n := range buf {
+			buf[n] = 0
+		}
+
+		tlsPool.Put(b)
+	}()
+
+	buf[0] = 22
+	record := append([]byte{3, 1, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+
+	h, _, err := readClientHello(bytes.NewReader(record), buf)
+	if err != nil {
+		return "", false, err
+	}
+
+	return h.serverName, true, nil
+}
+
+// quicVarint decodes a QUIC variable-length integer, returning the value and
+// the number of bytes read, which is zero when there is insufficient data.
+func quicVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+
+	l := 1 << (b[0] >> 6)
+	if len(b) < l {
+		return 0, 0
+	}
+
+	v := uint64(b[0] & 0x3f)
+
+	for _, c := range b[1:l] {
+		v = v<<8 | uint64(c)
+	}
+
+	return v, l
+}
+
+var (
+	errInvalidQUICPacket      = errors.New("invalid QUIC packet")
+	errInvalidQUICFrame       = errors.New("invalid QUIC frame")
+	errUnsupportedQUICVersion = errors.New("unsupported QUIC version")
+	errQUICHelloTooLarge      = errors.New("QUIC ClientHello too large")
+	errQUICClosed             = errors.New("QUIC connection closed")
+)
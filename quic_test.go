@@ -0,0 +1,132 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func quicInitialPacket(t *testing.T, dcid []byte, pn byte, frames []byte) []byte {
+	t.Helper()
+
+	var q quicHello
+
+	if err := q.setKeys(dcid); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for len(frames) < 4 {
+		frames = append(frames, quicFramePadding)
+	}
+
+	length := 1 + len(frames) + q.aead.Overhead()
+	header := append(append([]byte{0xc0, 0, 0, 0, 1, byte(len(dcid))}, dcid...), 0, 0, 0x40|byte(length>>8), byte(length), pn)
+	pnOffset := len(header) - 1
+	nonce := append([]byte{}, q.iv...)
+	nonce[len(nonce)-1] ^= pn
+	packet := q.aead.Seal(header, nonce, frames, header)
+
+	var mask [16]byte
+
+	q.hp.Encrypt(mask[:], packet[pnOffset+4:pnOffset+20])
+
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+
+	return packet
+}
+
+func quicCryptoFrame(offset int, data []byte) []byte {
+	return append([]byte{quicFrameCrypto, 0x40 | byte(offset>>8), byte(offset), 0x40 | byte(len(data)>>8), byte(len(data))}, data...)
+}
+
+func TestQUICInitialKeys(t *testing.T) {
+	var q quicHello
+
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+
+	if err := q.setKeys(dcid); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if iv := hex.EncodeToString(q.iv); iv != "fa044b2f42a3fd3b46fb255c" {
+		t.Errorf("expecting iv %q, got %q", "fa044b2f42a3fd3b46fb255c", iv)
+	}
+
+	sample, _ := hex.DecodeString("d1b1c98dd7689fb8ec11d242b123dc9b")
+
+	var mask [16]byte
+
+	q.hp.Encrypt(mask[:], sample)
+
+	if m := hex.EncodeToString(mask[:5]); m != "437b9aec36" {
+		t.Errorf("expecting mask %q, got %q", "437b9aec36", m)
+	}
+}
+
+func TestQUICServerName(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	hello := tlsServerName(aDomain)[5:]
+
+	for n, test := range [...]struct {
+		Datagrams [][]byte
+		Name      string
+		Done      bool
+		Err       error
+	}{
+		{ // 1
+			Datagrams: [][]byte{quicInitialPacket(t, dcid, 0, append(quicCryptoFrame(0, hello), make([]byte, 100)...))},
+			Name:      aDomain,
+			Done:      true,
+		},
+		{ // 2
+			Datagrams: [][]byte{
+				quicInitialPacket(t, dcid, 0, append([]byte{quicFramePing}, quicCryptoFrame(20, hello[20:40])...)),
+				quicInitialPacket(t, dcid, 1, append(append(quicCryptoFrame(40, hello[40:]), []byte{quicFrameAck, 0, 0, 0, 0}...), quicCryptoFrame(0, hello[:20])...)),
+			},
+			Name: aDomain,
+			Done: true,
+		},
+		{ // 3
+			Datagrams: [][]byte{quicInitialPacket(t, dcid, 0, quicCryptoFrame(0, hello[:20]))},
+		},
+		{ // 4
+			Datagrams: [][]byte{append(quicInitialPacket(t, dcid, 0, quicCryptoFrame(0, hello[:20])), quicInitialPacket(t, dcid, 1, quicCryptoFrame(20, hello[20:]))...)},
+			Name:      aDomain,
+			Done:      true,
+		},
+		{ // 5
+			Datagrams: [][]byte{quicInitialPacket(t, dcid, 0, []byte{0x08, 0, 0, 0})},
+			Err:       errInvalidQUICFrame,
+		},
+		{ // 6
+			Datagrams: [][]byte{{0xc0, 0, 0, 0, 2, 0, 0, 0, 0}},
+			Err:       errUnsupportedQUICVersion,
+		},
+		{ // 7
+			Datagrams: [][]byte{bytes.Replace(quicInitialPacket(t, dcid, 0, quicCryptoFrame(0, hello)), dcid, []byte{8, 7, 6, 5, 4, 3, 2, 1}, 1)},
+			Err:       errInvalidQUICPacket,
+		},
+	} {
+		var (
+			q    quicHello
+			name string
+			done bool
+			err  error
+		)
+
+		for _, d := range test.Datagrams {
+			if name, done, err = q.add(d); err != nil || done {
+				break
+			}
+		}
+
+		if err != test.Err {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		} else if done != test.Done {
+			t.Errorf("test %d: expecting done %t, got %t", n+1, test.Done, done)
+		} else if name != test.Name {
+			t.Errorf("test %d: expecting name %q, got %q", n+1, test.Name, name)
+		}
+	}
+}
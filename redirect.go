@@ -1,8 +1,10 @@
 package reverseproxy
 
 import (
+	"crypto/tls"
 	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 )
 
@@ -10,18 +12,100 @@ type addrService struct {
 	copying uint64
 	MatchServiceName
 	net.Addr
+	tlsConfig *tls.Config
+	dialer    Dialer
+	discovery Discovery
+	mirror    *mirror
+	capture   atomic.Pointer[Capture]
+
+	mu  sync.Mutex
+	err error
+}
+
+func (a *addrService) connect() (net.Conn, error) {
+	var (
+		c   net.Conn
+		err error
+	)
+
+	if a.discovery != nil {
+		c, err = a.dialBackends()
+	} else {
+		c, err = a.dialAddr(a.Network(), a.String())
+	}
+
+	if err != nil || a.tlsConfig == nil {
+		a.mu.Lock()
+		a.err = err
+		a.mu.Unlock()
+
+		return c, err
+	}
+
+	return a.originate(c)
+}
+
+func (a *addrService) dialAddr(network, address string) (net.Conn, error) {
+	if a.dialer != nil {
+		return a.dialer.Dial(network, address)
+	}
+
+	return net.Dial(network, address)
+}
+
+func (a *addrService) Transfer(buf []byte, conn *net.TCPConn) error {
+	return a.transferConn(buf, conn, 0)
 }
 
-func (a *addrService) Transfer(buf []byte, conn *net.TCPConn) {
-	p, err := net.Dial(a.Network(), a.String())
-	if err == nil {
-		if _, err = p.Write(buf); err == nil {
-			atomic.AddUint64(&a.copying, 2)
+func (a *addrService) transferConn(buf []byte, conn net.Conn, _ uint16) error {
+	p, err := a.connect()
+	if err != nil {
+		return err
+	}
+
+	if len(buf) > 0 {
+		if _, err = p.Write(buf); err != nil {
+			p.Close()
 
-			go copyConn(p, conn, &a.copying)
-			go copyConn(conn, p, &a.copying)
+			return err
 		}
 	}
+
+	client, server := conn, p
+
+	if a.mirror != nil {
+		client = a.mirror.tee(buf, client)
+	}
+
+	if c := a.capture.Load(); c != nil {
+		client, server = c.wrap(buf, client, server)
+	}
+
+	atomic.AddUint64(&a.copying, 2)
+
+	go copyConn(p, client, &a.copying)
+	go copyConn(conn, server, &a.copying)
+
+	return nil
+}
+
+func (a *addrService) dial() (net.Conn, error) {
+	p, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddUint64(&a.copying, 1)
+
+	return &countedConn{Conn: p, count: &a.copying}, nil
+}
+
+func (a *addrService) MatchServicePath(serviceName, path string) int {
+	return matchServicePath(a.MatchServiceName, serviceName, path)
+}
+
+func (a *addrService) MatchServiceFingerprint(serviceName string, fp Fingerprint) bool {
+	return matchServiceFingerprint(a.MatchServiceName, serviceName, fp)
 }
 
 func (a *addrService) Active() bool {
@@ -35,10 +119,27 @@ func copyConn(a, b net.Conn, c *uint64) {
 	atomic.AddUint64(c, ^uint64(0))
 }
 
+type countedConn struct {
+	net.Conn
+	count *uint64
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { atomic.AddUint64(c.count, ^uint64(0)) })
+
+	return c.Conn.Close()
+}
+
 // AddRedirect sets a port to be redirected to an external service.
-func AddRedirect(serviceName MatchServiceName, port uint16, to net.Addr) (*Port, error) {
+func AddRedirect(serviceName MatchServiceName, port uint16, to net.Addr, opts ...Option) (*Port, error) {
+	o := makeOptions(opts)
+
 	return addPort(port, &addrService{
 		MatchServiceName: serviceName,
 		Addr:             to,
-	})
+		tlsConfig:        upstreamConfig(o.upstreamTLS, to),
+		dialer:           o.dialer,
+		mirror:           o.newMirror(),
+	}, opts...)
 }
@@ -0,0 +1,166 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPError is returned when a plaintext HTTP connection cannot be routed, and
+// holds the status code that should be sent to the client.
+type HTTPError struct {
+	Code int
+	Err  error
+}
+
+// Error implements the error interface.
+func (h *HTTPError) Error() string {
+	return fmt.Sprintf("%d %s: %s", h.Code, http.StatusText(h.Code), h.Err)
+}
+
+// Unwrap returns the underlying error.
+func (h *HTTPError) Unwrap() error {
+	return h.Err
+}
+
+// TLSAlert represents a TLS alert description.
+type TLSAlert uint8
+
+// TLS Alerts.
+const (
+	AlertHandshakeFailure      TLSAlert = 40
+	AlertAccessDenied          TLSAlert = 49
+	AlertProtocolVersion       TLSAlert = 70
+	AlertInternalError         TLSAlert = 80
+	AlertUnrecognizedName      TLSAlert = 112
+	AlertNoApplicationProtocol TLSAlert = 120
+)
+
+// TLSError is returned when a TLS connection cannot be routed, and holds the
+// alert that should be sent to the client.
+type TLSError struct {
+	Alert TLSAlert
+	Err   error
+}
+
+// Error implements the error interface.
+func (t *TLSError) Error() string {
+	return fmt.Sprintf("tls alert %d: %s", t.Alert, t.Err)
+}
+
+// Unwrap returns the underlying error.
+func (t *TLSError) Unwrap() error {
+	return t.Err
+}
+
+// ErrorPage generates the HTML body sent with a plaintext HTTP rejection.
+type ErrorPage func(code int, serviceName string) []byte
+
+var errorPages = make(map[uint16]ErrorPage)
+
+// SetErrorPage sets the function used to generate error pages for plaintext
+// HTTP rejections on the given port. A nil ErrorPage restores the default.
+func SetErrorPage(port uint16, ep ErrorPage) {
+	lMu.Lock()
+
+	if ep == nil {
+		delete(errorPages, port)
+	} else {
+		errorPages[port] = ep
+	}
+
+	lMu.Unlock()
+}
+
+// DefaultErrorPage is the ErrorPage used when none has been set for a port.
+func DefaultErrorPage(code int, _ string) []byte {
+	status := html.EscapeString(http.StatusText(code))
+
+	return fmt.Appendf(nil, "<html>\n\t<head>\n\t\t<title>%d %s</title>\n\t</head>\n\t<body>\n\t\t<h1>%s</h1>\n\t</body>\n</html>\n", code, status, status)
+}
+
+func httpRejection(err error) *HTTPError {
+	var he *HTTPError
+
+	if errors.As(err, &he) {
+		return he
+	} else if errors.Is(err, ErrNoService) {
+		return &HTTPError{Code: http.StatusMisdirectedRequest, Err: err}
+	} else if errors.Is(err, ErrServiceUnavailable) {
+		return &HTTPError{Code: http.StatusServiceUnavailable, Err: err}
+	}
+
+	return nil
+}
+
+func tlsRejection(err error) *TLSError {
+	var te *TLSError
+
+	if errors.As(err, &te) {
+		return te
+	} else if errors.Is(err, ErrNoService) {
+		return &TLSError{Alert: AlertUnrecognizedName, Err: err}
+	} else if errors.Is(err, ErrServiceUnavailable) {
+		return &TLSError{Alert: AlertInternalError, Err: err}
+	}
+
+	return nil
+}
+
+func (l *listener) reject(c *net.TCPConn, s Sniffer, buf []byte, serviceName string, err error) {
+	switch s.(type) {
+	case tlsSniffer:
+		if te := tlsRejection(err); te != nil {
+			c.Write([]byte{21, 3, 3, 0, 2, 2, byte(te.Alert)})
+			closeWait(c)
+		}
+	case httpSniffer:
+		if he := httpRejection(err); he != nil {
+			if bytes.HasPrefix(buf, h2Preface) {
+				c.Write(h2Rejection(he.Code))
+			} else {
+				c.Write(l.errorResponse(he.Code, serviceName))
+			}
+
+			closeWait(c)
+		}
+	}
+
+	c.Close()
+}
+
+func (l *listener) errorResponse(code int, serviceName string) []byte {
+	lMu.RLock()
+	ep, ok := errorPages[l.port]
+	lMu.RUnlock()
+
+	if !ok {
+		ep = DefaultErrorPage
+	}
+
+	body := ep(code, serviceName)
+	resp := strconv.AppendInt(append(make([]byte, 0, 128+len(body)), "HTTP/1.1 "...), int64(code), 10)
+	resp = append(append(append(resp, ' '), http.StatusText(code)...), "\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: "...)
+
+	return append(append(strconv.AppendInt(resp, int64(len(body)), 10), "\r\nConnection: close\r\n\r\n"...), body...)
+}
+
+const rejectDrainTime = time.Second
+
+func closeWait(c *net.TCPConn) {
+	c.CloseWrite()
+	c.SetReadDeadline(time.Now().Add(rejectDrainTime))
+	io.Copy(io.Discard, io.LimitReader(c, maxTLSRead))
+}
+
+// Errors.
+var (
+	ErrNoService          = errors.New("no matching service")
+	ErrServiceUnavailable = errors.New("service unavailable")
+)
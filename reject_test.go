@@ -0,0 +1,117 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func rejectRequest(port uint16, data []byte) ([]byte, error) {
+	c, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(port)})
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.Close()
+
+	if _, err = c.Write(data); err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(c)
+}
+
+func TestReject(t *testing.T) {
+	pa := getUnusedPort()
+
+	p, err := addPort(pa, testServiceA{make(testService)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	closedAddr := l.Addr()
+
+	l.Close()
+
+	q, err := AddRedirect(HostName(bDomain), pa, closedAddr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	for n, test := range [...]struct {
+		Request  string
+		Response string
+	}{
+		{
+			Request:  "GET / HTTP/1.1\r\nHost: ccc.com\r\n\r\n",
+			Response: "HTTP/1.1 421 Misdirected Request\r\n",
+		},
+		{
+			Request:  "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n",
+			Response: "HTTP/1.1 400 Bad Request\r\n",
+		},
+		{
+			Request:  "GET / HTTP/1.1\r\nHost: " + bDomain + "\r\n\r\n",
+			Response: "HTTP/1.1 503 Service Unavailable\r\n",
+		},
+	} {
+		resp, err := rejectRequest(pa, []byte(test.Request))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !strings.HasPrefix(string(resp), test.Response) {
+			t.Errorf("test %d: expecting response to start with %q, got %q", n+1, test.Response, resp)
+		} else if !strings.HasSuffix(string(resp), "</body>\n</html>\n") {
+			t.Errorf("test %d: expecting default error page, got %q", n+1, resp)
+		}
+	}
+
+	SetErrorPage(pa, func(code int, serviceName string) []byte {
+		return []byte(serviceName)
+	})
+
+	if resp, err := rejectRequest(pa, []byte("GET / HTTP/1.1\r\nHost: ccc.com:8080\r\n\r\n")); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if !strings.HasSuffix(string(resp), "\r\nContent-Length: 7\r\nConnection: close\r\n\r\nccc.com") {
+		t.Errorf("test 4: expecting custom error page, got %q", resp)
+	}
+
+	SetErrorPage(pa, nil)
+
+	for n, test := range [...]struct {
+		Request []byte
+		Alert   TLSAlert
+	}{
+		{
+			Request: tlsServerName("ccc.com"),
+			Alert:   AlertUnrecognizedName,
+		},
+		{
+			Request: tlsServerName(bDomain),
+			Alert:   AlertInternalError,
+		},
+		{
+			Request: append(append([]byte{}, tlsServerName(aDomain)[:5]...), 2, 0, 0, 0),
+			Alert:   AlertHandshakeFailure,
+		},
+	} {
+		test.Request[3] = byte((len(test.Request) - 5) >> 8)
+		test.Request[4] = byte(len(test.Request) - 5)
+
+		if resp, err := rejectRequest(pa, test.Request); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+5, err)
+		} else if expected := []byte{21, 3, 3, 0, 2, 2, byte(test.Alert)}; !bytes.Equal(resp, expected) {
+			t.Errorf("test %d: expecting alert %v, got %v", n+5, expected, resp)
+		}
+	}
+}
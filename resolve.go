@@ -0,0 +1,24 @@
+package reverseproxy
+
+// HostAddr is a net.Addr for a target given as a host name and port, such as
+// 'example.com:8080', which is resolved each time a connection is made, rather
+// than once, so that changes to its DNS records are followed without
+// restarting the redirect.
+//
+// All of the A and AAAA records of the name are tried, racing IPv6 and IPv4 as
+// described in RFC 6555. Resolution failures, as with other failures to
+// connect, are reported in the Err field of the Status of the Port.
+type HostAddr struct {
+	Net     string
+	Address string
+}
+
+// Network returns the network of the address, such as 'tcp' or 'udp'.
+func (h HostAddr) Network() string {
+	return h.Net
+}
+
+// String returns the host name and port of the address.
+func (h HostAddr) String() string {
+	return h.Address
+}
@@ -0,0 +1,207 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHostAddr(t *testing.T) {
+	echo := listenTest(t, echoConn).(*net.TCPAddr)
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, HostAddr{Net: "tcp", Address: fmt.Sprintf("localhost:%d", echo.Port)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	const req = "GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	c.Write([]byte(req))
+
+	buf := make([]byte, len(req))
+
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(buf) != req {
+		t.Errorf("test 1: expecting %q, got %q", req, buf)
+	} else if err := p.Status().Err; err != nil {
+		t.Errorf("test 1: unexpected status error: %s", err)
+	}
+
+	c.Close()
+	p.Close()
+
+	q, err := AddRedirect(HostName(aDomain), pa, HostAddr{Net: "tcp", Address: fmt.Sprintf("localhost:%d", getUnusedPort())})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	c, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 2: unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	c.Write([]byte(req))
+
+	if resp, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("test 2: expecting status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	} else if q.Status().Err == nil {
+		t.Error("test 2: expecting status error")
+	}
+}
+
+// testResolver answers A queries for any name with the address it holds, or
+// with a name error when it holds none, over a stream connection.
+type testResolver struct {
+	addr atomic.Pointer[net.IP]
+}
+
+func (r *testResolver) Dial(_ context.Context, _, _ string) (net.Conn, error) {
+	a, b := net.Pipe()
+
+	go r.serve(b)
+
+	return a, nil
+}
+
+func (r *testResolver) serve(c net.Conn) {
+	defer c.Close()
+
+	for {
+		var length [2]byte
+
+		if _, err := io.ReadFull(c, length[:]); err != nil {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+
+		if _, err := io.ReadFull(c, query); err != nil || len(query) < 12 {
+			return
+		}
+
+		end := 12
+
+		for end < len(query) && query[end] != 0 {
+			end += int(query[end]) + 1
+		}
+
+		if end += 5; end > len(query) {
+			return
+		}
+
+		question := query[12:end]
+		resp := append([]byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, question...)
+
+		if ip := r.addr.Load(); ip == nil {
+			resp[3] |= 3 // NXDOMAIN
+		} else if binary.BigEndian.Uint16(question[len(question)-4:]) == 1 {
+			resp[7] = 1
+			resp = append(append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4), (*ip).To4()...)
+		}
+
+		if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestHostAddrResolve(t *testing.T) {
+	l1, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer l1.Close()
+
+	port := l1.Addr().(*net.TCPAddr).Port
+
+	l2, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port})
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.2: %s", err)
+	}
+
+	defer l2.Close()
+
+	for _, l := range [...]*net.TCPListener{l1, l2} {
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				c.Write([]byte(l.Addr().(*net.TCPAddr).IP.String()))
+				c.Close()
+			}
+		}()
+	}
+
+	var r testResolver
+
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, HostAddr{Net: "tcp", Address: fmt.Sprintf("target.test:%d", port)}, DialVia(&net.Dialer{Resolver: &net.Resolver{PreferGo: true, Dial: r.Dial}}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	for n, test := range [...]struct {
+		IP       net.IP
+		Response string
+	}{
+		{net.IPv4(127, 0, 0, 1), "127.0.0.1"},
+		{net.IPv4(127, 0, 0, 2), "127.0.0.2"},
+		{nil, "HTTP/1.1 503"},
+		{net.IPv4(127, 0, 0, 1), "127.0.0.1"},
+	} {
+		if test.IP == nil {
+			r.addr.Store(nil)
+		} else {
+			r.addr.Store(&test.IP)
+		}
+
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		c.Write([]byte("GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"))
+
+		buf := make([]byte, len(test.Response))
+
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(buf) != test.Response {
+			t.Errorf("test %d: expecting response %q, got %q", n+1, test.Response, buf)
+		}
+
+		c.Close()
+
+		if err := p.Status().Err; test.IP == nil && err == nil {
+			t.Errorf("test %d: expecting status error", n+1)
+		} else if test.IP != nil && err != nil {
+			t.Errorf("test %d: unexpected status error: %s", n+1, err)
+		}
+	}
+}
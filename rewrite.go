@@ -0,0 +1,159 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"strings"
+)
+
+// RewriteHost sets the Host header, and the authority of an absolute-form
+// request target, of plaintext HTTP requests passed to the service.
+func RewriteHost(host string) Option {
+	return func(o *options) {
+		o.host = host
+	}
+}
+
+// StripPathPrefix removes the given prefix from the path of plaintext HTTP
+// requests passed to the service.
+//
+// The prefix is only removed when it ends on a path segment boundary, so a
+// prefix of '/app' will match '/app' and '/app/index.html', but not
+// '/application'.
+func StripPathPrefix(prefix string) Option {
+	return func(o *options) {
+		o.stripPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// AddPathPrefix adds the given prefix to the path of plaintext HTTP requests
+// passed to the service. It is applied after any StripPathPrefix option.
+func AddPathPrefix(prefix string) Option {
+	return func(o *options) {
+		o.addPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// SetHeader sets a header on plaintext HTTP requests passed to the service,
+// replacing any sent by the client.
+func SetHeader(name, value string) Option {
+	return func(o *options) {
+		o.setHeaders = append(o.setHeaders, [2]string{name, value})
+	}
+}
+
+// RemoveHeader removes a header from plaintext HTTP requests passed to the
+// service.
+func RemoveHeader(name string) Option {
+	return func(o *options) {
+		o.removeHeaders = append(o.removeHeaders, name)
+	}
+}
+
+func (o *options) rewritesRequest() bool {
+	return o.host != "" || o.stripPrefix != "" || o.addPrefix != "" || len(o.setHeaders) > 0 || len(o.removeHeaders) > 0
+}
+
+func (o *options) rewriteRequest(r *requestHead) {
+	if o.stripPrefix != "" || o.addPrefix != "" || o.host != "" {
+		r.rewriteTarget(o.host, o.stripPrefix, o.addPrefix)
+	}
+
+	if o.host != "" {
+		r.set(headerHost, []byte(o.host))
+	}
+
+	for _, name := range o.removeHeaders {
+		r.remove(name)
+	}
+
+	for _, header := range o.setHeaders {
+		r.set(header[0], []byte(header[1]))
+	}
+}
+
+// rewriteTarget modifies the path, and for the absolute-form the authority, of
+// the request target.
+func (r *requestHead) rewriteTarget(host, strip, add string) {
+	s := bytes.IndexByte(r.line, ' ')
+	e := bytes.LastIndexByte(r.line, ' ')
+
+	if s < 0 || e <= s {
+		return
+	}
+
+	target := r.line[s+1 : e]
+
+	var authority []byte
+
+	if target[0] != '/' {
+		p := bytes.Index(target, schemeSep)
+		if p <= 0 || !isScheme(target[:p]) {
+			return // asterisk-form or authority-form
+		}
+
+		p += len(schemeSep)
+
+		if l := bytes.IndexAny(target[p:], "/?#"); l >= 0 {
+			authority, target = target[:p+l], target[p+l:]
+		} else {
+			authority, target = target, nil
+		}
+
+		if host != "" {
+			authority = append(authority[:p:p], host...)
+		}
+	}
+
+	path := target
+
+	if q := bytes.IndexByte(target, '?'); q >= 0 {
+		path = target[:q]
+	}
+
+	query := target[len(path):]
+
+	if strip != "" && bytes.HasPrefix(path, []byte(strip)) && (len(path) == len(strip) || path[len(strip)] == '/') {
+		path = path[len(strip):]
+	}
+
+	if add != "" {
+		path = append([]byte(add), path...)
+	}
+
+	if len(path) == 0 && authority == nil {
+		path = slash
+	}
+
+	line := make([]byte, 0, len(r.line)+len(host)+len(add)+1)
+	line = append(append(append(append(line, r.line[:s+1]...), authority...), path...), query...)
+	r.line = append(line, r.line[e:]...)
+}
+
+// set replaces the first field with the given name, removing any others, or
+// adds the field if none exist.
+func (r *requestHead) set(name string, value []byte) {
+	var (
+		field  = append(append([]byte(name), ':', ' '), value...)
+		fields = r.fields[:0]
+		found  bool
+	)
+
+	for _, f := range r.fields {
+		if !isField(f, name) {
+			fields = append(fields, f)
+		} else if !found {
+			fields = append(fields, field)
+			found = true
+		}
+	}
+
+	r.fields = fields
+
+	if !found {
+		r.fields = append(r.fields, field)
+	}
+}
+
+const headerHost = "Host"
+
+var slash = []byte{'/'}
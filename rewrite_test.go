@@ -0,0 +1,163 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRewrite(t *testing.T) {
+	for n, test := range [...]struct {
+		Options       []Option
+		Input, Output string
+	}{
+		{ // 1
+			Options: []Option{RewriteHost("app.internal:8080")},
+			Input:   "GET /a HTTP/1.1\r\nHost: a.com\r\nAccept: */*\r\n\r\n",
+			Output:  "GET /a HTTP/1.1\r\nHost: app.internal:8080\r\nAccept: */*\r\nConnection: close\r\n\r\n",
+		},
+		{ // 2
+			Options: []Option{RewriteHost("app.internal")},
+			Input:   "GET http://user@a.com:80/a?b HTTP/1.1\r\nhost: a.com\r\n\r\n",
+			Output:  "GET http://app.internal/a?b HTTP/1.1\r\nHost: app.internal\r\nConnection: close\r\n\r\n",
+		},
+		{ // 3
+			Options: []Option{StripPathPrefix("/app/")},
+			Input:   "GET /app/index.html?q=/app HTTP/1.1\r\nHost: a.com\r\n\r\n",
+			Output:  "GET /index.html?q=/app HTTP/1.1\r\nHost: a.com\r\nConnection: close\r\n\r\n",
+		},
+		{ // 4
+			Options: []Option{StripPathPrefix("/app")},
+			Input:   "GET /app?q HTTP/1.1\r\nHost: a.com\r\n\r\n",
+			Output:  "GET /?q HTTP/1.1\r\nHost: a.com\r\nConnection: close\r\n\r\n",
+		},
+		{ // 5
+			Options: []Option{StripPathPrefix("/app")},
+			Input:   "GET /application HTTP/1.1\r\nHost: a.com\r\n\r\n",
+			Output:  "GET /application HTTP/1.1\r\nHost: a.com\r\nConnection: close\r\n\r\n",
+		},
+		{ // 6
+			Options: []Option{AddPathPrefix("/backend/")},
+			Input:   "GET /index.html HTTP/1.1\r\nHost: a.com\r\n\r\n",
+			Output:  "GET /backend/index.html HTTP/1.1\r\nHost: a.com\r\nConnection: close\r\n\r\n",
+		},
+		{ // 7
+			Options: []Option{StripPathPrefix("/app"), AddPathPrefix("/backend")},
+			Input:   "POST /app HTTP/1.1\r\nHost: a.com\r\nContent-Length: 3\r\n\r\nabc",
+			Output:  "POST /backend HTTP/1.1\r\nHost: a.com\r\nContent-Length: 3\r\nConnection: close\r\n\r\nabc",
+		},
+		{ // 8
+			Options: []Option{AddPathPrefix("/backend")},
+			Input:   "OPTIONS * HTTP/1.1\r\nHost: a.com\r\n\r\n",
+			Output:  "OPTIONS * HTTP/1.1\r\nHost: a.com\r\nConnection: close\r\n\r\n",
+		},
+		{ // 9
+			Options: []Option{RemoveHeader("Cookie"), SetHeader("X-Internal", "1"), SetHeader("Accept", "text/html")},
+			Input:   "GET / HTTP/1.1\r\nAccept: */*\r\nHost: a.com\r\nCookie: a=1\r\nACCEPT: */*\r\nCookie: b=2\r\n\r\n",
+			Output:  "GET / HTTP/1.1\r\nAccept: text/html\r\nHost: a.com\r\nX-Internal: 1\r\nConnection: close\r\n\r\n",
+		},
+		{ // 10
+			Options: []Option{RewriteHost("b.com")},
+			Input:   "\x16\x03\x01\x00",
+			Output:  "\x16\x03\x01\x00",
+		},
+	} {
+		o := makeOptions(test.Options)
+
+		if out := o.rewrite([]byte(test.Input), net.IPv4(127, 0, 0, 1), protoHTTP); string(out) != test.Output {
+			t.Errorf("test %d: expecting output %q, got %q", n+1, test.Output, out)
+		}
+	}
+}
+
+func TestRewriteRedirect(t *testing.T) {
+	pa := getUnusedPort()
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer l.Close()
+
+	p, err := AddRedirect(HostName(aDomain), pa, l.Addr(), RewriteHost("app.internal"), AddPathPrefix("/app"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	go func() {
+		c, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(pa)})
+		if err == nil {
+			c.Write([]byte("GET /a HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"))
+		}
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	const expected = "GET /app/a HTTP/1.1\r\nHost: app.internal\r\nConnection: close\r\n\r\n"
+
+	buf := make([]byte, len(expected))
+
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if string(buf) != expected {
+		t.Errorf("expecting %q, got %q", expected, buf)
+	}
+}
+
+func TestRewriteKeepAlive(t *testing.T) {
+	pa := getUnusedPort()
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer l.Close()
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s%s", r.Host, r.URL.Path)
+	}))
+
+	p, err := AddRedirect(HostName(aDomain), pa, l.Addr(), RewriteHost("app.internal"), AddPathPrefix("/app"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	c, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: int(pa)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	c.Write([]byte("GET /a HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\nGET /b HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"))
+	c.SetReadDeadline(time.Now().Add(time.Second))
+
+	br := bufio.NewReader(c)
+
+	if resp, err := http.ReadResponse(br, nil); err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	} else if body, _ := io.ReadAll(resp.Body); string(body) != "app.internal/app/a" {
+		t.Errorf("test 1: expecting response %q, got %q", "app.internal/app/a", body)
+	}
+
+	if rest, err := io.ReadAll(br); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if len(rest) != 0 {
+		t.Errorf("test 2: expecting connection to be closed, got %q", rest)
+	}
+}
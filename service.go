@@ -23,6 +23,56 @@ func (h HostNameSuffix) MatchService(serviceName string) bool {
 	return strings.HasSuffix(serviceName, string(h))
 }
 
+// MatchServicePath allows a service to be matched on the path of a plaintext
+// HTTP request as well as the service name.
+type MatchServicePath interface {
+	MatchServiceName
+
+	// MatchServicePath returns the length of the path prefix matched, or -1
+	// if the service does not match.
+	MatchServicePath(serviceName, path string) int
+}
+
+// PathPrefix restricts the services matched by Host to those plaintext HTTP
+// requests whose path is within the sub-tree given by Prefix.
+//
+// As the path of a TLS connection cannot be seen, PathPrefix never matches
+// them.
+type PathPrefix struct {
+	Host   MatchServiceName
+	Prefix string
+}
+
+// MatchService implements the MatchServiceName interface.
+func (PathPrefix) MatchService(_ string) bool {
+	return false
+}
+
+// MatchServicePath implements the MatchServicePath interface.
+func (p PathPrefix) MatchServicePath(serviceName, path string) int {
+	prefix := strings.TrimSuffix(p.Prefix, "/")
+
+	if !p.Host.MatchService(serviceName) || !strings.HasPrefix(path, prefix) || len(path) > len(prefix) && path[len(prefix)] != '/' {
+		return -1
+	}
+
+	return len(prefix) + 1
+}
+
+func matchServicePath(m MatchServiceName, serviceName, path string) int {
+	if path != "" {
+		if mp, ok := m.(MatchServicePath); ok {
+			return mp.MatchServicePath(serviceName, path)
+		}
+	}
+
+	if m.MatchService(serviceName) {
+		return 0
+	}
+
+	return -1
+}
+
 // Hosts represents a list of service names to match against.
 type Hosts []MatchServiceName
 
@@ -36,3 +86,16 @@ func (h Hosts) MatchService(serviceName string) bool {
 
 	return false
 }
+
+// MatchServicePath implements the MatchServicePath interface.
+func (h Hosts) MatchServicePath(serviceName, path string) int {
+	best := -1
+
+	for _, s := range h {
+		if n := matchServicePath(s, serviceName, path); n > best {
+			best = n
+		}
+	}
+
+	return best
+}
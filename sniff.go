@@ -0,0 +1,155 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"errors"
+	"sync"
+)
+
+const maxSniffPeek = 4096
+
+// Sniffer determines the routing key of a connection from the bytes it starts
+// with.
+type Sniffer interface {
+	// Sniff is passed a reader for a new connection, from which up to 4096
+	// bytes can be peeked.
+	//
+	// If the connection is not of the protocol the Sniffer understands, it
+	// must return ErrNotSniffed, having only peeked, and not read, from the
+	// reader, so that the next Sniffer can be tried.
+	//
+	// Otherwise, it returns the routing key, which is matched against the
+	// service names of the ports, and the bytes it read, which are replayed
+	// to the matched service ahead of the rest of the connection.
+	Sniff(r *bufio.Reader) (string, []byte, error)
+}
+
+// The built-in Sniffers.
+var (
+	// TLSSniffer routes TLS connections by the server name in their
+	// ClientHello.
+	TLSSniffer Sniffer = tlsSniffer{}
+
+	// HTTPSniffer routes plaintext HTTP connections by the Host of their
+	// first request, and, for services with paths, by its path. It accepts
+	// any connection, so should be the last Sniffer tried.
+	HTTPSniffer Sniffer = httpSniffer{}
+)
+
+var (
+	sniffers       = make(map[uint16][]Sniffer)
+	defaultSniffer = []Sniffer{TLSSniffer, HTTPSniffer}
+	readerPool     = sync.Pool{
+		New: func() any {
+			return bufio.NewReaderSize(nil, maxSniffPeek)
+		},
+	}
+)
+
+// SetSniffers sets the Sniffers, in the order they are to be tried, used to
+// route the connections on the given port. Setting no Sniffers restores the
+// default, which tries TLSSniffer and then HTTPSniffer.
+//
+// Connections routed by a Sniffer other than the built-in ones are passed to
+// the matched service unchanged, and are closed without a response when they
+// cannot be routed.
+func SetSniffers(port uint16, s ...Sniffer) {
+	lMu.Lock()
+
+	if len(s) == 0 {
+		delete(sniffers, port)
+	} else {
+		sniffers[port] = append(make([]Sniffer, 0, len(s)), s...)
+	}
+
+	lMu.Unlock()
+}
+
+func (l *listener) sniffers() []Sniffer {
+	lMu.RLock()
+	defer lMu.RUnlock()
+
+	if s, ok := sniffers[l.port]; ok {
+		return s
+	}
+
+	return defaultSniffer
+}
+
+// pooledSniffer is implemented by the built-in Sniffers, which read into
+// buffers from a pool and, for HTTP, also return the request path, and, for
+// TLS, the parsed ClientHello.
+type pooledSniffer interface {
+	Sniffer
+	pool() *sync.Pool
+	sniff(r *bufio.Reader, buf []byte) (string, string, *clientHello, []byte, error)
+}
+
+func sniffPooled(s pooledSniffer, r *bufio.Reader) (string, []byte, error) {
+	b := s.pool().Get().(*[]byte)
+
+	name, _, _, buf, err := s.sniff(r, *b)
+	out := append(make([]byte, 0, len(buf)), buf...)
+
+	for n := range buf {
+		buf[n] = 0
+	}
+
+	s.pool().Put(b)
+
+	return name, out, err
+}
+
+type tlsSniffer struct{}
+
+func (t tlsSniffer) Sniff(r *bufio.Reader) (string, []byte, error) {
+	return sniffPooled(t, r)
+}
+
+func (tlsSniffer) pool() *sync.Pool {
+	return &tlsPool
+}
+
+func (tlsSniffer) sniff(r *bufio.Reader, buf []byte) (string, string, *clientHello, []byte, error) {
+	if b, err := r.Peek(1); err != nil {
+		return "", "", nil, buf[:0], err
+	} else if b[0] != 22 {
+		return "", "", nil, buf[:0], ErrNotSniffed
+	}
+
+	buf[0], _ = r.ReadByte()
+
+	h, buf, err := readClientHello(r, buf)
+	if err != nil {
+		return "", "", nil, buf, err
+	}
+
+	return h.serverName, "", h, buf, nil
+}
+
+type httpSniffer struct{}
+
+func (h httpSniffer) Sniff(r *bufio.Reader) (string, []byte, error) {
+	return sniffPooled(h, r)
+}
+
+func (httpSniffer) pool() *sync.Pool {
+	return &httpPool
+}
+
+func (httpSniffer) sniff(r *bufio.Reader, buf []byte) (string, string, *clientHello, []byte, error) {
+	var err error
+
+	if buf[0], err = r.ReadByte(); err != nil {
+		return "", "", nil, buf[:0], err
+	}
+
+	name, path, buf, err := readHTTPServerName(r, buf)
+
+	return name, path, nil, buf, err
+}
+
+// Errors.
+var (
+	ErrNotSniffed = errors.New("connection not recognised by sniffer")
+)
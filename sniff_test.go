@@ -0,0 +1,127 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+type heloSniffer struct{}
+
+func (heloSniffer) Sniff(r *bufio.Reader) (string, []byte, error) {
+	if b, err := r.Peek(5); err != nil {
+		return "", nil, err
+	} else if string(b) != "HELO " {
+		return "", nil, ErrNotSniffed
+	}
+
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return "", nil, err
+	}
+
+	return strings.TrimSpace(string(line[5:])), append([]byte(nil), line...), nil
+}
+
+func TestSniffers(t *testing.T) {
+	pa := getUnusedPort()
+	sa := make(testService)
+	sb := make(testService)
+
+	p, err := addPort(pa, testServiceA{sa})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	q, err := addPort(pa, testServiceB{sb})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	SetSniffers(pa, heloSniffer{}, TLSSniffer, HTTPSniffer)
+
+	const (
+		heloSend = "HELO " + aDomain + "\r\nDATA"
+		httpSend = "GET / HTTP/1.1\r\nHost: " + bDomain + "\r\n\r\n"
+	)
+
+	for n, test := range [...]struct {
+		Send    []byte
+		Service testService
+	}{
+		{[]byte(heloSend), sa},
+		{[]byte(httpSend), sb},
+		{tlsServerName(aDomain), sa},
+	} {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		c.Write(test.Send)
+
+		if data := <-test.Service; !bytes.Equal(data.buf, test.Send) {
+			t.Errorf("test %d: expecting buf to equal %q, got %q", n+1, test.Send, data.buf)
+		} else {
+			data.conn.Close()
+		}
+
+		c.Close()
+	}
+
+	SetSniffers(pa)
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+	if err != nil {
+		t.Fatalf("test 4: unexpected error: %s", err)
+	}
+
+	c.Write([]byte(heloSend))
+
+	if resp, err := io.ReadAll(c); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if !bytes.HasPrefix(resp, []byte("HTTP/1.1 400 ")) {
+		t.Errorf("test 4: expecting Bad Request response, got %q", resp)
+	}
+
+	c.Close()
+}
+
+func TestBuiltinSniffers(t *testing.T) {
+	hello := tlsServerName(aDomain)
+	httpReq := "GET / HTTP/1.1\r\nHost: " + bDomain + ":8080\r\n\r\n"
+
+	for n, test := range [...]struct {
+		Sniffer Sniffer
+		Input   []byte
+		Name    string
+		Err     error
+	}{
+		{TLSSniffer, hello, aDomain, nil},
+		{TLSSniffer, []byte(httpReq), "", ErrNotSniffed},
+		{HTTPSniffer, []byte(httpReq), bDomain + ":8080", nil},
+	} {
+		r := bufio.NewReader(bytes.NewReader(test.Input))
+
+		name, buf, err := test.Sniffer.Sniff(r)
+		if err != test.Err {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		} else if err != nil {
+			if r.Buffered() != len(test.Input) {
+				t.Errorf("test %d: expecting %d bytes to remain buffered, got %d", n+1, len(test.Input), r.Buffered())
+			}
+		} else if name != test.Name {
+			t.Errorf("test %d: expecting name %q, got %q", n+1, test.Name, name)
+		} else if !bytes.Equal(buf, test.Input) {
+			t.Errorf("test %d: expecting buf %q, got %q", n+1, test.Input, buf)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package reverseproxy
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+)
+
+// SplitMember is a service that can take a share of the connections in a Split,
+// such as a Port or a UnixCmd.
+type SplitMember interface {
+	// PortFor returns the Port of the member on the given port number, or nil
+	// if it has none.
+	PortFor(port uint16) *Port
+}
+
+// PortFor implements the SplitMember interface.
+func (p *Port) PortFor(port uint16) *Port {
+	if p.port == port {
+		return p
+	}
+
+	return nil
+}
+
+// PortFor implements the SplitMember interface.
+func (u *UnixCmd) PortFor(port uint16) *Port {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.open[port]
+}
+
+var splits = make(map[*Split]struct{})
+
+// Split divides new connections between services that match the same names,
+// such as two versions of an application, by weight.
+//
+// When a connection matches a member of the Split, it is instead given to a
+// member chosen by weight, allowing traffic to be moved gradually between an
+// old and a new version, or switched over at once.
+type Split struct {
+	pin     bool
+	members []SplitMember
+
+	mu      sync.RWMutex
+	weights []uint
+}
+
+// NewSplit creates and enables a Split between the given members, with equal
+// weights.
+//
+// When pin is true, clients are assigned to a member by a hash of their IP
+// address, so that each continues to reach the same member while the weights
+// are unchanged.
+func NewSplit(pin bool, members ...SplitMember) *Split {
+	s := &Split{
+		pin:     pin,
+		members: slices.Clone(members),
+		weights: make([]uint, len(members)),
+	}
+
+	for n := range s.weights {
+		s.weights[n] = 1
+	}
+
+	lMu.Lock()
+	splits[s] = struct{}{}
+	lMu.Unlock()
+
+	return s
+}
+
+// SetWeights sets the weights of the members, in the order given to NewSplit.
+// A member with a weight of zero receives no new connections.
+func (s *Split) SetWeights(weights ...uint) error {
+	if len(weights) != len(s.members) {
+		return ErrInvalidWeights
+	}
+
+	var total uint
+
+	for _, w := range weights {
+		total += w
+	}
+
+	if total == 0 {
+		return ErrInvalidWeights
+	}
+
+	s.mu.Lock()
+	s.weights = slices.Clone(weights)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Weights returns the current weights of the members.
+func (s *Split) Weights() []uint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.weights)
+}
+
+// Close disables the Split, after which connections go to whichever member
+// they match.
+func (s *Split) Close() {
+	lMu.Lock()
+	delete(splits, s)
+	lMu.Unlock()
+}
+
+// choose returns the port of a member selected by weight, if the given port
+// belongs to a member of the Split.
+//
+// The members, which do not change, are asked for their ports before the lock
+// is taken, so that a member may take its own locks without risking a
+// deadlock with SetWeights.
+func (s *Split) choose(port uint16, p *Port, ip net.IP) *Port {
+	var (
+		ports   = make([]*Port, len(s.members))
+		total   uint
+		isSplit bool
+	)
+
+	for n, m := range s.members {
+		if ports[n] = m.PortFor(port); ports[n] == p {
+			isSplit = true
+		}
+	}
+
+	if !isSplit {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for n, sp := range ports {
+		if sp != nil {
+			total += s.weights[n]
+		}
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	var r uint
+
+	if s.pin && ip != nil {
+		h := fnv.New64a()
+
+		h.Write(ip.To16())
+
+		r = uint(h.Sum64() % uint64(total))
+	} else {
+		r = uint(rand.Uint64N(uint64(total)))
+	}
+
+	for n, p := range ports {
+		if p == nil {
+			continue
+		} else if r < s.weights[n] {
+			return p
+		}
+
+		r -= s.weights[n]
+	}
+
+	return nil
+}
+
+// route finds the Port for the given name and path, or Fingerprint, applying
+// any Split that the matched Port is a member of.
+func (l *listener) route(name, path string, fp *Fingerprint, ip net.IP) *Port {
+	p := l.matchFingerprint(name, fp)
+	if p == nil {
+		p = l.match(name, path)
+	}
+
+	if p != nil {
+		return l.split(p, ip)
+	}
+
+	return nil
+}
+
+// split chooses a Port from the Split, if any, that the given Port is a member
+// of.
+func (l *listener) split(p *Port, ip net.IP) *Port {
+	for _, s := range activeSplits() {
+		if sp := s.choose(l.port, p, ip); sp != nil {
+			return sp
+		}
+	}
+
+	return p
+}
+
+// together returns whether both Ports are members of the same Split.
+func (l *listener) together(a, b *Port) bool {
+	if a == nil || b == nil {
+		return false
+	}
+
+	for _, s := range activeSplits() {
+		if s.has(l.port, a) && s.has(l.port, b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Split) has(port uint16, p *Port) bool {
+	for _, m := range s.members {
+		if m.PortFor(port) == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+func activeSplits() []*Split {
+	lMu.RLock()
+	defer lMu.RUnlock()
+
+	ss := make([]*Split, 0, len(splits))
+
+	for s := range splits {
+		ss = append(ss, s)
+	}
+
+	return ss
+}
+
+// Errors.
+var (
+	ErrInvalidWeights = errors.New("invalid weights")
+)
@@ -0,0 +1,158 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplit(t *testing.T) {
+	a := listenTest(t, func(c net.Conn) {
+		c.Write([]byte("A"))
+		c.Close()
+	})
+	b := listenTest(t, func(c net.Conn) {
+		c.Write([]byte("B"))
+		c.Close()
+	})
+	pa := getUnusedPort()
+
+	p, err := AddRedirect(HostName(aDomain), pa, a)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	q, err := AddRedirect(HostName(aDomain), pa, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	read := func() string {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa))
+		if err != nil {
+			return err.Error()
+		}
+
+		defer c.Close()
+
+		c.Write([]byte("GET / HTTP/1.1\r\nHost: " + aDomain + "\r\n\r\n"))
+
+		buf, _ := io.ReadAll(c)
+
+		return string(buf)
+	}
+
+	s := NewSplit(false, p, q)
+
+	defer s.Close()
+
+	if err := s.SetWeights(1); err != ErrInvalidWeights {
+		t.Errorf("test 1: expecting error %v, got %v", ErrInvalidWeights, err)
+	}
+
+	if err := s.SetWeights(0, 0); err != ErrInvalidWeights {
+		t.Errorf("test 2: expecting error %v, got %v", ErrInvalidWeights, err)
+	}
+
+	for n, test := range [...]struct {
+		Weights []uint
+		Expect  string
+	}{
+		{[]uint{1, 0}, "A"},
+		{[]uint{0, 1}, "B"},
+		{[]uint{100, 0}, "A"},
+	} {
+		if err := s.SetWeights(test.Weights...); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+3, err)
+
+			continue
+		}
+
+		for range 5 {
+			if got := read(); got != test.Expect {
+				t.Errorf("test %d: expecting response %q, got %q", n+3, test.Expect, got)
+			}
+		}
+	}
+
+	s.SetWeights(1, 1)
+
+	seen := map[string]bool{}
+
+	for range 50 {
+		seen[read()] = true
+	}
+
+	if !seen["A"] || !seen["B"] {
+		t.Errorf("test 6: expecting responses from both members, got %v", seen)
+	}
+
+	s.Close()
+
+	r := NewSplit(true, p, q)
+
+	defer r.Close()
+
+	first := read()
+
+	for range 10 {
+		if got := read(); got != first {
+			t.Errorf("test 7: expecting pinned response %q, got %q", first, got)
+		}
+	}
+}
+
+type lockedMember struct {
+	mu   *sync.Mutex
+	port *Port
+}
+
+func (l lockedMember) PortFor(port uint16) *Port {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.port.PortFor(port)
+}
+
+func TestSplitMemberLock(t *testing.T) {
+	var mu sync.Mutex
+
+	p := &Port{port: 1}
+	s := NewSplit(false, lockedMember{mu: &mu, port: p}, p)
+
+	defer s.Close()
+
+	mu.Lock()
+
+	chosen := make(chan *Port)
+
+	go func() { chosen <- s.choose(1, p, nil) }()
+
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan error)
+
+	go func() { done <- s.SetWeights(0, 1) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("test 1: unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("test 1: SetWeights blocked by a member")
+	}
+
+	mu.Unlock()
+
+	if sp := <-chosen; sp != p {
+		t.Errorf("test 2: expecting port %p, got %p", p, sp)
+	}
+}
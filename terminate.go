@@ -0,0 +1,123 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TerminateTLS sets the service to have TLS connections decrypted by the proxy,
+// using the given config, with the plaintext stream being passed to the
+// service.
+//
+// The config should have either its Certificates or GetCertificate field set.
+//
+// TLS connections for services without this option are still passed through
+// untouched, so both kinds of service can share a port, selected by SNI. Any
+// plaintext HTTP options are applied to the first request of a decrypted
+// HTTP/1.x stream, which is given a 'Connection: close' header.
+func TerminateTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// connService is implemented by services that can be passed a connection that
+// is not a plain TCP connection, such as one decrypted by the proxy.
+type connService interface {
+	transferConn(buf []byte, conn net.Conn, port uint16) error
+}
+
+// terminate performs a TLS handshake with the client, replaying the already
+// read ClientHello, before passing the decrypted connection to the service.
+func (p *Port) terminate(c *net.TCPConn, hello []byte) {
+	cs, ok := p.service.(connService)
+	if !ok {
+		c.Close()
+
+		return
+	}
+
+	tc := tls.Server(&replayConn{TCPConn: c, buf: hello}, p.opts.tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	err := tc.HandshakeContext(ctx)
+
+	cancel()
+
+	if err != nil {
+		tc.Close()
+
+		return
+	}
+
+	var buf []byte
+
+	if tc.ConnectionState().NegotiatedProtocol != "h2" && p.opts.rewritesHTTP() {
+		if buf, err = readRequestHead(tc); err != nil {
+			tc.Close()
+
+			return
+		}
+
+		buf = p.opts.rewrite(buf, remoteIP(c), protoHTTPS)
+	}
+
+	var conn net.Conn = tc
+
+	if f := p.activeFaults(); f != nil {
+		if buf, conn, err = f.apply(buf, tc); err != nil {
+			return
+		}
+	}
+
+	if err := cs.transferConn(buf, conn, p.port); err != nil {
+		conn.Close()
+	}
+}
+
+// readRequestHead reads the head of the first request of a decrypted HTTP/1.x
+// stream, along with any other data received.
+func readRequestHead(r io.Reader) ([]byte, error) {
+	b := httpPool.Get().(*[]byte)
+	buf := *b
+
+	defer func() {
+		for n := range buf {
+			buf[n] = 0
+		}
+
+		httpPool.Put(b)
+	}()
+
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return nil, err
+	}
+
+	_, _, head, err := readHTTPServerName(r, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(make([]byte, 0, len(head)), head...), nil
+}
+
+// replayConn replays data that has already been read from the connection.
+type replayConn struct {
+	*net.TCPConn
+	buf []byte
+}
+
+func (r *replayConn) Read(p []byte) (int, error) {
+	if len(r.buf) > 0 {
+		n := copy(p, r.buf)
+		r.buf = r.buf[n:]
+
+		return n, nil
+	}
+
+	return r.TCPConn.Read(p)
+}
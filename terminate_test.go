@@ -0,0 +1,179 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, names ...string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: names[0]}}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{cert}, PrivateKey: key}
+}
+
+func TestTerminateTLS(t *testing.T) {
+	pa := getUnusedPort()
+	sb := make(testService)
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer l.Close()
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s:%s", r.Host, r.Header.Get("X-Forwarded-Proto"))
+	}))
+
+	p, err := AddRedirect(HostName(aDomain), pa, l.Addr(), TerminateTLS(&tls.Config{Certificates: []tls.Certificate{testCertificate(t, aDomain)}}), InjectHeaders(HeaderXForwardedProto, nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	q, err := addPort(pa, testServiceB{sb})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer q.Close()
+
+	c, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa), &tls.Config{ServerName: aDomain, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "https://"+aDomain+"/", nil)
+
+	req.Write(c)
+
+	if resp, err := http.ReadResponse(bufio.NewReader(c), req); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if body, _ := io.ReadAll(resp.Body); string(body) != aDomain+":https" {
+		t.Errorf("test 1: expecting body %q, got %q", aDomain+":https", body)
+	}
+
+	go tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pa), &tls.Config{ServerName: bDomain, InsecureSkipVerify: true})
+
+	data := <-sb
+
+	data.conn.Close()
+
+	if len(data.buf) == 0 || data.buf[0] != 22 {
+		t.Errorf("test 2: expecting passthrough of ClientHello, got %v", data.buf)
+	}
+}
+
+func TestUnixTransferConn(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var conns [2]*net.UnixConn
+
+	for n, fd := range fds {
+		f := os.NewFile(uintptr(fd), "")
+		c, err := net.FileConn(f)
+
+		f.Close()
+
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		conns[n] = c.(*net.UnixConn)
+
+		defer c.Close()
+	}
+
+	u := &unixService{conn: conns[0]}
+	a, b := net.Pipe()
+
+	if err := u.transferConn([]byte("BUF"), a, 0x1234); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	buf := make([]byte, 32)
+	oob := make([]byte, syscall.CmsgLen(4))
+
+	n, oobn, _, _, err := conns[1].ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := "\x34\x12\x04pipeBUF"; string(buf[:n]) != expected {
+		t.Errorf("test 1: expecting message %q, got %q", expected, buf[:n])
+	}
+
+	msg, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msg) != 1 {
+		t.Fatalf("test 2: expecting control message, got %v", err)
+	}
+
+	fd, err := syscall.ParseUnixRights(&msg[0])
+	if err != nil || len(fd) != 1 {
+		t.Fatalf("test 2: expecting file descriptor, got %v", err)
+	}
+
+	f := os.NewFile(uintptr(fd[0]), "")
+	c, err := net.FileConn(f)
+
+	f.Close()
+
+	if err != nil {
+		t.Fatalf("test 2: unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	go b.Write([]byte("hello"))
+
+	if _, err := io.ReadFull(c, buf[:5]); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if string(buf[:5]) != "hello" {
+		t.Errorf("test 3: expecting %q, got %q", "hello", buf[:5])
+	}
+
+	go c.Write([]byte("world"))
+
+	if _, err := io.ReadFull(b, buf[:5]); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if string(buf[:5]) != "world" {
+		t.Errorf("test 4: expecting %q, got %q", "world", buf[:5])
+	}
+}
@@ -11,12 +11,64 @@ import (
 
 const maxTLSRead = 5 + 65536
 
-func readTLSServerName(c io.Reader, buf []byte) (string, []byte, error) {
+// TLS extension types.
+const (
+	extServerName          = 0
+	extSupportedGroups     = 10
+	extECPointFormats      = 11
+	extSignatureAlgorithms = 13
+	extALPN                = 16
+	extSupportedVersions   = 43
+	extECH                 = 0xfe0d
+)
+
+// clientHello holds the fields of a TLS ClientHello that are used for routing
+// and fingerprinting.
+type clientHello struct {
+	serverName        string
+	version           uint16
+	ciphers           []uint16
+	extensions        []uint16
+	curves            []uint16
+	pointFormats      []uint8
+	signatureAlgs     []uint16
+	supportedVersions []uint16
+	alpn              []string
+
+	// body holds the ClientHello, without the handshake header, and ech the
+	// contents of an outer encrypted_client_hello extension, if present.
+	body []byte
+	ech  *echExtension
+}
+
+// readClientHello reads and parses the ClientHello record of a TLS connection,
+// the first byte of which is already in buf, returning it along with the bytes
+// of the record.
+func readClientHello(c io.Reader, buf []byte) (*clientHello, []byte, error) {
+	record, err := readTLSRecord(c, buf)
+	if err != nil {
+		return nil, buf, err
+	}
+
+	h := new(clientHello)
+
+	if err := h.parse(record[5:]); err != nil {
+		return nil, buf, err
+	} else if h.serverName == "" {
+		return nil, buf, &TLSError{Alert: AlertUnrecognizedName, Err: errNoName}
+	}
+
+	return h, record, nil
+}
+
+// readTLSRecord reads the rest of a TLS record, the first byte of which is
+// already in buf.
+func readTLSRecord(c io.Reader, buf []byte) ([]byte, error) {
 	mbuf := memio.Buffer(buf[1:5])
 
 	n, err := io.ReadFull(c, mbuf)
 	if err != nil {
-		return "", buf, err
+		return buf, err
 	}
 
 	r := byteio.StickyBigEndianReader{Reader: &mbuf}
@@ -26,29 +78,49 @@ func readTLSServerName(c io.Reader, buf []byte) (string, []byte, error) {
 
 	length := r.ReadUint16()
 	if cap(mbuf) < int(length) {
-		return "", buf, io.ErrShortBuffer
+		return buf, &TLSError{Alert: AlertHandshakeFailure, Err: io.ErrShortBuffer}
 	}
 
 	mbuf = mbuf[:length]
 
 	m, err := io.ReadFull(c, mbuf)
 	if err != nil {
-		return "", buf, err
+		return buf, err
 	}
 
-	n += m
+	return buf[:n+m+1], nil
+}
+
+// parse parses the ClientHello from the body of a TLS record.
+func (h *clientHello) parse(body []byte) error {
+	mbuf := memio.Buffer(body)
+	r := byteio.StickyBigEndianReader{Reader: &mbuf}
 
 	if r.ReadUint8() != 1 {
-		return "", buf, errNoClientHello
+		return &TLSError{Alert: AlertHandshakeFailure, Err: errNoClientHello}
 	}
 
 	l := r.ReadUint24()
-	if l != uint32(length)-4 {
-		return "", buf, fmt.Errorf("error reading body: %w", errInvalidLength)
+	if l != uint32(len(body))-4 {
+		return &TLSError{Alert: AlertHandshakeFailure, Err: fmt.Errorf("error reading body: %w", errInvalidLength)}
 	}
 
-	mbuf = mbuf[1:] // skip major version
-	mbuf = mbuf[1:] // skip minor version
+	return h.parseBody(body[4:])
+}
+
+// parseBody parses a ClientHello without its handshake header, ignoring any
+// data following the extensions, such as the padding of an ECH inner
+// ClientHello.
+func (h *clientHello) parseBody(body []byte) error {
+	h.body = body
+	mbuf := memio.Buffer(body)
+	r := byteio.StickyBigEndianReader{Reader: &mbuf}
+
+	h.version = r.ReadUint16()
+
+	if len(mbuf) < 32 {
+		return &TLSError{Alert: AlertHandshakeFailure, Err: fmt.Errorf("error reading random: %w", errInvalidLength)}
+	}
 
 	mbuf = mbuf[4:]  // skip gmt_unix_time
 	mbuf = mbuf[28:] // skip random_bytes
@@ -56,7 +128,7 @@ func readTLSServerName(c io.Reader, buf []byte) (string, []byte, error) {
 	sessionLength := r.ReadUint8()
 	if sessionLength > 32 || len(mbuf) < int(sessionLength) {
 		// invalid length
-		return "", buf, fmt.Errorf("error reading sesion id: %w", errInvalidLength)
+		return &TLSError{Alert: AlertHandshakeFailure, Err: fmt.Errorf("error reading sesion id: %w", errInvalidLength)}
 	}
 
 	mbuf = mbuf[sessionLength:] // skip session id
@@ -64,21 +136,22 @@ func readTLSServerName(c io.Reader, buf []byte) (string, []byte, error) {
 	cipherSuiteLength := r.ReadUint16()
 	if cipherSuiteLength == 0 || len(mbuf) < int(cipherSuiteLength) {
 		// invalid length
-		return "", buf, fmt.Errorf("error reading cipher suites: %w", errInvalidLength)
+		return &TLSError{Alert: AlertHandshakeFailure, Err: fmt.Errorf("error reading cipher suites: %w", errInvalidLength)}
 	}
 
-	mbuf = mbuf[cipherSuiteLength:] // skip cipher suites
+	h.ciphers = readUint16s(mbuf[:cipherSuiteLength])
+	mbuf = mbuf[cipherSuiteLength:]
 
 	compressionMethodLength := r.ReadUint8()
 	if compressionMethodLength < 1 || len(mbuf) < int(compressionMethodLength) {
-		return "", buf, fmt.Errorf("error reading compressions: %w", errInvalidLength)
+		return &TLSError{Alert: AlertHandshakeFailure, Err: fmt.Errorf("error reading compressions: %w", errInvalidLength)}
 	}
 
 	mbuf = mbuf[compressionMethodLength:] // skip compression methods
 
 	extsLength := r.ReadUint16()
 	if len(mbuf) < int(extsLength) {
-		return "", buf, fmt.Errorf("error reading extensions: %w", errInvalidLength)
+		return &TLSError{Alert: AlertHandshakeFailure, Err: fmt.Errorf("error reading extensions: %w", errInvalidLength)}
 	}
 
 	mbuf = mbuf[:extsLength]
@@ -88,29 +161,95 @@ func readTLSServerName(c io.Reader, buf []byte) (string, []byte, error) {
 		extLength := r.ReadUint16()
 
 		if len(mbuf) < int(extLength) {
-			return "", buf, fmt.Errorf("error reading extension: %w", errInvalidLength)
+			return &TLSError{Alert: AlertHandshakeFailure, Err: fmt.Errorf("error reading extension: %w", errInvalidLength)}
 		}
 
-		if extType == 0 { // server_name
-			l := r.ReadUint16()
-			if l != extLength-2 {
-				return "", buf, fmt.Errorf("error reading server name extension: %w", errInvalidLength)
-			}
+		if err := h.parseExtension(extType, mbuf[:extLength]); err != nil {
+			return err
+		}
+
+		h.extensions = append(h.extensions, extType)
+		mbuf = mbuf[extLength:]
+	}
+
+	return nil
+}
 
-			mbuf = mbuf[1:] // skip name_type
+// parseExtension records the contents of the extensions used for routing and
+// fingerprinting. Only a malformed server name is an error, the others being
+// ignored if they cannot be read.
+func (h *clientHello) parseExtension(extType uint16, ext []byte) error {
+	switch extType {
+	case extServerName:
+		mbuf := memio.Buffer(ext)
+		r := byteio.StickyBigEndianReader{Reader: &mbuf}
+
+		l := r.ReadUint16()
+		if int(l) != len(ext)-2 || len(mbuf) < 3 {
+			return &TLSError{Alert: AlertHandshakeFailure, Err: fmt.Errorf("error reading server name extension: %w", errInvalidLength)}
+		}
+
+		mbuf = mbuf[1:] // skip name_type
+
+		nameLength := r.ReadUint16()
+		if len(mbuf) < int(nameLength) {
+			return &TLSError{Alert: AlertHandshakeFailure, Err: fmt.Errorf("error reading server name: %w", errInvalidLength)}
+		}
 
-			nameLength := r.ReadUint16()
-			if len(mbuf) < int(nameLength) {
-				return "", buf, fmt.Errorf("error reading server name: %w", errInvalidLength)
+		h.serverName = string(mbuf[:nameLength])
+	case extSupportedGroups:
+		h.curves = readUint16s(lengthPrefixed(ext, 2))
+	case extECPointFormats:
+		h.pointFormats = append([]uint8{}, lengthPrefixed(ext, 1)...)
+	case extSignatureAlgorithms:
+		h.signatureAlgs = readUint16s(lengthPrefixed(ext, 2))
+	case extSupportedVersions:
+		h.supportedVersions = readUint16s(lengthPrefixed(ext, 1))
+	case extECH:
+		h.ech = parseECHExtension(ext)
+	case extALPN:
+		for protos := lengthPrefixed(ext, 2); len(protos) > 0; {
+			l := int(protos[0])
+			if len(protos) < 1+l {
+				break
 			}
 
-			return string(mbuf[:nameLength]), buf[:n+1], nil
+			h.alpn = append(h.alpn, string(protos[1:1+l]))
+			protos = protos[1+l:]
 		}
+	}
 
-		mbuf = mbuf[extLength:]
+	return nil
+}
+
+// lengthPrefixed returns the data following a big endian length prefix of the
+// given size, or nil if the length is invalid.
+func lengthPrefixed(data []byte, size int) []byte {
+	if len(data) < size {
+		return nil
+	}
+
+	l := 0
+
+	for _, b := range data[:size] {
+		l = l<<8 | int(b)
+	}
+
+	if len(data)-size < l {
+		return nil
+	}
+
+	return data[size : size+l]
+}
+
+func readUint16s(data []byte) []uint16 {
+	values := make([]uint16, len(data)/2)
+
+	for n := range values {
+		values[n] = uint16(data[2*n])<<8 | uint16(data[2*n+1])
 	}
 
-	return "", buf, errNoName
+	return values
 }
 
 var (
@@ -43,13 +43,13 @@ func TestTLS(t *testing.T) {
 	rBuf[0] = buf[0]
 	aBuf := memio.Buffer(buf[1:])
 
-	name, b, err := readTLSServerName(&aBuf, rBuf)
+	h, b, err := readClientHello(&aBuf, rBuf)
 	if err != nil {
 		t.Errorf("test 1: unexpected error, %s", err)
 
 		return
-	} else if name != "aaa.com" {
-		t.Errorf("test 1: expecting name \"aaa.com\", got %q", name)
+	} else if h.serverName != "aaa.com" {
+		t.Errorf("test 1: expecting name \"aaa.com\", got %q", h.serverName)
 
 		return
 	} else if !bytes.Equal(buf, b) {
@@ -61,13 +61,13 @@ func TestTLS(t *testing.T) {
 	buf = tlsServerName("example.com")
 	aBuf = memio.Buffer(buf[1:])
 
-	name, b, err = readTLSServerName(&aBuf, rBuf)
+	h, b, err = readClientHello(&aBuf, rBuf)
 	if err != nil {
 		t.Errorf("test 2: unexpected error, %s", err)
 
 		return
-	} else if name != "example.com" {
-		t.Errorf("test 2: expecting name \"example.com\", got %q", name)
+	} else if h.serverName != "example.com" {
+		t.Errorf("test 2: expecting name \"example.com\", got %q", h.serverName)
 
 		return
 	} else if !bytes.Equal(buf, b) {
@@ -80,7 +80,7 @@ func TestTLS(t *testing.T) {
 	buf[52] = 1
 	aBuf = memio.Buffer(buf[1:])
 
-	_, _, err = readTLSServerName(&aBuf, rBuf)
+	_, _, err = readClientHello(&aBuf, rBuf)
 	if !errors.Is(err, errNoName) {
 		t.Errorf("test 3: expecting error errNoName, got, %s", err)
 	}
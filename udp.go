@@ -0,0 +1,472 @@
+package reverseproxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	quicIdleTimeout   = 3 * time.Minute
+	quicMaxPending    = 32
+	maxDatagramLength = 1<<16 - 1
+
+	quicMaxPendingSessions = 128
+)
+
+var udpListeners = make(map[uint16]*udpListener)
+
+// packetService is implemented by services that receive the datagrams of QUIC
+// connections.
+type packetService interface {
+	MatchServiceName
+	openSession(client netip.AddrPort, l *udpListener) (packetSession, error)
+	Active() bool
+}
+
+type packetSession interface {
+	write([]byte) error
+	close()
+}
+
+type udpSession struct {
+	port    *PacketPort
+	hello   *quicHello
+	pending [][]byte
+	packetSession
+	last atomic.Int64
+}
+
+type udpListener struct {
+	*net.UDPConn
+	port uint16
+
+	mu       sync.RWMutex
+	ports    map[*PacketPort]struct{}
+	sessions map[netip.AddrPort]*udpSession
+	pending  int
+}
+
+// PacketPort represents a service waiting on a UDP port for QUIC connections.
+type PacketPort struct {
+	service packetService
+	port    uint16
+	closed  bool
+}
+
+func addPacketPort(port uint16, service packetService) (*PacketPort, error) {
+	if port == 0 {
+		return nil, ErrInvalidPort
+	}
+
+	lMu.Lock()
+
+	l, ok := udpListeners[port]
+	if !ok {
+		nl, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+		if err != nil {
+			lMu.Unlock()
+
+			return nil, err
+		}
+
+		l = &udpListener{
+			UDPConn:  nl,
+			port:     port,
+			ports:    make(map[*PacketPort]struct{}),
+			sessions: make(map[netip.AddrPort]*udpSession),
+		}
+
+		go l.listen()
+		go l.expire()
+
+		udpListeners[port] = l
+	}
+
+	lMu.Unlock()
+
+	p := &PacketPort{
+		service: service,
+		port:    port,
+	}
+
+	l.mu.Lock()
+	l.ports[p] = struct{}{}
+	l.mu.Unlock()
+
+	return p, nil
+}
+
+func (l *udpListener) listen() {
+	buf := make([]byte, maxDatagramLength)
+
+	for {
+		n, client, err := l.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			l.Close()
+
+			l.mu.Lock()
+
+			for p := range l.ports {
+				p.closed = true
+
+				delete(l.ports, p)
+			}
+
+			l.mu.Unlock()
+
+			return
+		}
+
+		l.receive(netip.AddrPortFrom(client.Addr().Unmap(), client.Port()), buf[:n])
+	}
+}
+
+// receive handles a datagram from a client, holding the datagrams of a new
+// connection until its ClientHello has been read and it can be pinned to a
+// service.
+//
+// Datagrams are only written to a session after l.mu has been released, so
+// that a slow service cannot hold up the other sessions on the port.
+func (l *udpListener) receive(client netip.AddrPort, datagram []byte) {
+	s, ps := l.hold(client, datagram)
+	if ps != nil && ps.write(datagram) != nil {
+		l.mu.Lock()
+		l.closeSession(client, s)
+		l.mu.Unlock()
+	}
+}
+
+// hold returns the established session of the client, or, for a client that
+// is yet to be pinned to a service, stores the datagram until it is.
+//
+// At most quicMaxPendingSessions clients can be waiting to be pinned at once,
+// with the datagrams of any others dropped, so that spoofed client addresses
+// cannot be used to buffer an unbounded number of datagrams.
+func (l *udpListener) hold(client netip.AddrPort, datagram []byte) (*udpSession, packetSession) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.sessions[client]
+	if !ok {
+		if len(datagram) == 0 || datagram[0]&0x80 == 0 || l.pending == quicMaxPendingSessions {
+			return nil, nil
+		}
+
+		s = &udpSession{hello: new(quicHello)}
+		l.sessions[client] = s
+		l.pending++
+	}
+
+	s.last.Store(time.Now().UnixNano())
+
+	if s.packetSession != nil {
+		return s, s.packetSession
+	} else if len(s.pending) == quicMaxPending {
+		l.closeSession(client, s)
+
+		return nil, nil
+	}
+
+	s.pending = append(s.pending, append(make([]byte, 0, len(datagram)), datagram...))
+
+	if s.hello == nil {
+		return nil, nil
+	}
+
+	name, done, err := s.hello.add(datagram)
+	if err != nil {
+		l.closeSession(client, s)
+
+		return nil, nil
+	} else if !done {
+		return nil, nil
+	}
+
+	s.hello = nil
+
+	if s.port = l.match(name); s.port == nil {
+		l.closeSession(client, s)
+
+		return nil, nil
+	}
+
+	go l.open(client, s)
+
+	return nil, nil
+}
+
+// open opens the session to the service that the client has been pinned to,
+// passing on the held datagrams, including any that arrive while it is being
+// opened.
+func (l *udpListener) open(client netip.AddrPort, s *udpSession) {
+	ps, err := s.port.service.openSession(client, l)
+
+	for {
+		l.mu.Lock()
+
+		if l.sessions[client] != s || err != nil {
+			l.closeSession(client, s)
+			l.mu.Unlock()
+
+			if ps != nil {
+				ps.close()
+			}
+
+			return
+		}
+
+		pending := s.pending
+		s.pending = nil
+
+		if len(pending) == 0 {
+			s.packetSession = ps
+			l.pending--
+
+			l.mu.Unlock()
+
+			return
+		}
+
+		l.mu.Unlock()
+
+		for _, d := range pending {
+			if err = ps.write(d); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func (l *udpListener) match(name string) *PacketPort {
+	for p := range l.ports {
+		if p.service.MatchService(name) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// closeSession removes the session of a client, if it is still current; l.mu
+// must be held.
+func (l *udpListener) closeSession(client netip.AddrPort, s *udpSession) {
+	if l.sessions[client] != s {
+		return
+	}
+
+	delete(l.sessions, client)
+
+	if s.packetSession != nil {
+		s.close()
+	} else {
+		l.pending--
+	}
+}
+
+// expire closes sessions that have been idle for longer than the QUIC idle
+// timeout, as UDP has no indication of a connection ending.
+func (l *udpListener) expire() {
+	t := time.NewTicker(quicIdleTimeout / 2)
+
+	defer t.Stop()
+
+	for range t.C {
+		l.mu.Lock()
+
+		if len(l.ports) == 0 {
+			for client, s := range l.sessions {
+				l.closeSession(client, s)
+			}
+
+			l.mu.Unlock()
+
+			return
+		}
+
+		expired := time.Now().Add(-quicIdleTimeout).UnixNano()
+
+		for client, s := range l.sessions {
+			if s.last.Load() < expired {
+				l.closeSession(client, s)
+			}
+		}
+
+		l.mu.Unlock()
+	}
+}
+
+// writeUDP sends a datagram to a client from the given port.
+func writeUDP(port uint16, client netip.AddrPort, datagram []byte) error {
+	lMu.RLock()
+	l, ok := udpListeners[port]
+	lMu.RUnlock()
+
+	if !ok {
+		return net.ErrClosed
+	}
+
+	_, err := l.WriteToUDPAddrPort(datagram, client)
+
+	return err
+}
+
+// Close closes this port.
+func (p *PacketPort) Close() error {
+	lMu.Lock()
+
+	if !p.closed {
+		l, ok := udpListeners[p.port]
+		if ok {
+			l.mu.Lock()
+
+			delete(l.ports, p)
+
+			for client, s := range l.sessions {
+				if s.port == p {
+					l.closeSession(client, s)
+				}
+			}
+
+			if len(l.ports) == 0 {
+				delete(udpListeners, p.port)
+				l.Close()
+			}
+
+			l.mu.Unlock()
+		}
+
+		p.closed = true
+	}
+
+	lMu.Unlock()
+
+	return nil
+}
+
+// Closed returns whether the port has been closed or not.
+func (p *PacketPort) Closed() bool {
+	return p.closed
+}
+
+// Status retrieves the status of a PacketPort.
+func (p *PacketPort) Status() Status {
+	lMu.RLock()
+	closed := p.closed
+	lMu.RUnlock()
+
+	s := Status{
+		Ports:   []uint16{p.port},
+		Closing: closed,
+		Active:  p.service.Active(),
+	}
+
+	if es, ok := p.service.(errService); ok {
+		s.Err = es.lastError()
+	}
+
+	return s
+}
+
+type udpAddrService struct {
+	sessions int64
+	MatchServiceName
+	addr net.Addr
+
+	mu  sync.Mutex
+	err error
+}
+
+type udpAddrSession struct {
+	net.Conn
+	sessions *int64
+	once     sync.Once
+}
+
+// openSession dials the target, which, for a HostAddr, resolves it. It is
+// called without the lock of the listener being held, so that slow resolution
+// does not hold up the rest of the port.
+func (u *udpAddrService) openSession(client netip.AddrPort, l *udpListener) (packetSession, error) {
+	c, err := net.Dial(u.addr.Network(), u.addr.String())
+
+	u.mu.Lock()
+	u.err = err
+	u.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&u.sessions, 1)
+
+	s := &udpAddrSession{Conn: c, sessions: &u.sessions}
+
+	go s.reply(client, l)
+
+	return s, nil
+}
+
+func (u *udpAddrService) Active() bool {
+	return atomic.LoadInt64(&u.sessions) > 0
+}
+
+func (u *udpAddrService) lastError() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.err
+}
+
+// reply passes datagrams from the target back to the client.
+func (u *udpAddrSession) reply(client netip.AddrPort, l *udpListener) {
+	buf := make([]byte, maxDatagramLength)
+
+	for {
+		n, err := u.Read(buf)
+		if err != nil {
+			u.close()
+
+			return
+		}
+
+		l.WriteToUDPAddrPort(buf[:n], client)
+	}
+}
+
+func (u *udpAddrSession) write(datagram []byte) error {
+	_, err := u.Write(datagram)
+
+	return err
+}
+
+func (u *udpAddrSession) close() {
+	u.once.Do(func() {
+		u.Close()
+		atomic.AddInt64(u.sessions, -1)
+	})
+}
+
+// AddQUICRedirect sets a UDP port to have QUIC connections redirected to an
+// external service.
+//
+// The server name of each connection is read from the ClientHello in its
+// Initial packets, after which all datagrams from the client address are sent
+// to the matching service. As connections are identified by the client
+// address, connection migration is not supported.
+//
+// The target can be a HostAddr, which is resolved for each new connection.
+// Failures to resolve or dial the target are reported in the Err field of the
+// Status of the PacketPort.
+func AddQUICRedirect(serviceName MatchServiceName, port uint16, to net.Addr) (*PacketPort, error) {
+	return addPacketPort(port, &udpAddrService{
+		MatchServiceName: serviceName,
+		addr:             to,
+	})
+}
@@ -0,0 +1,249 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestQUICRedirect(t *testing.T) {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer backend.Close()
+
+	pa := getUnusedPort()
+
+	p, err := AddQUICRedirect(HostName(aDomain), pa, backend.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	s, rf, err := newUnixPacketService(HostName(bDomain))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s.packetPort, err = addPacketPort(pa, s); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer s.close()
+
+	cf, err := net.FileConn(rf)
+
+	rf.Close()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	child := cf.(*net.UnixConn)
+
+	defer child.Close()
+
+	go s.run(&UnixCmd{openUDP: make(map[uint16]*unixPacketService)}, pa)
+
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	proxy := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(pa)}
+	buf := make([]byte, 2048)
+
+	c, err := net.DialUDP("udp", nil, proxy)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	initial := quicInitialPacket(t, dcid, 0, append(quicCryptoFrame(0, tlsServerName(aDomain)[5:]), make([]byte, 100)...))
+
+	c.Write(initial)
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n, client, err := backend.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	} else if !bytes.Equal(buf[:n], initial) {
+		t.Errorf("test 1: expecting Initial packet to be forwarded")
+	}
+
+	backend.WriteToUDP([]byte("REPLY"), client)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if n, err := c.Read(buf); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if string(buf[:n]) != "REPLY" {
+		t.Errorf("test 2: expecting %q, got %q", "REPLY", buf[:n])
+	}
+
+	c.Write([]byte{0x40, 'S', 'H', 'O', 'R', 'T'})
+
+	if n, _, err := backend.ReadFromUDP(buf); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if string(buf[:n]) != "\x40SHORT" {
+		t.Errorf("test 3: expecting %q, got %q", "\x40SHORT", buf[:n])
+	}
+
+	if !p.Status().Active {
+		t.Errorf("test 4: expecting port to be active")
+	}
+
+	d, err := net.DialUDP("udp", nil, proxy)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer d.Close()
+
+	initial = quicInitialPacket(t, dcid, 0, append(quicCryptoFrame(0, tlsServerName(bDomain)[5:]), make([]byte, 100)...))
+
+	d.Write(initial)
+	child.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	addr := d.LocalAddr().String()
+	header := append([]byte{byte(len(addr))}, addr...)
+
+	if n, err := child.Read(buf); err != nil {
+		t.Fatalf("test 5: unexpected error: %s", err)
+	} else if !bytes.Equal(buf[:n], append(header, initial...)) {
+		t.Errorf("test 5: expecting Initial packet prefixed with %q", header)
+	}
+
+	child.Write(append(header, "CHILD"...))
+	d.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if n, err := d.Read(buf); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if string(buf[:n]) != "CHILD" {
+		t.Errorf("test 6: expecting %q, got %q", "CHILD", buf[:n])
+	}
+
+	p.Close()
+
+	if s.packetPort.Closed() {
+		t.Errorf("test 7: expecting command port to remain open")
+	}
+}
+
+type testPacketService struct {
+	MatchServiceName
+	open      chan struct{}
+	datagrams chan []byte
+}
+
+func (t *testPacketService) openSession(netip.AddrPort, *udpListener) (packetSession, error) {
+	<-t.open
+
+	return t, nil
+}
+
+func (t *testPacketService) Active() bool {
+	return true
+}
+
+func (t *testPacketService) write(datagram []byte) error {
+	t.datagrams <- append([]byte{}, datagram...)
+
+	return nil
+}
+
+func (t *testPacketService) close() {}
+
+func TestQUICPendingSessions(t *testing.T) {
+	s := &testPacketService{
+		MatchServiceName: HostName(aDomain),
+		open:             make(chan struct{}),
+		datagrams:        make(chan []byte, 3),
+	}
+	l := &udpListener{
+		ports:    map[*PacketPort]struct{}{{service: s}: {}},
+		sessions: make(map[netip.AddrPort]*udpSession),
+	}
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	hello := tlsServerName(aDomain)[5:]
+	initial := quicInitialPacket(t, dcid, 0, append(quicCryptoFrame(0, hello), make([]byte, 100)...))
+	partial := quicInitialPacket(t, dcid, 0, quicCryptoFrame(0, hello[:20]))
+	client := netip.MustParseAddrPort("10.0.0.1:1234")
+
+	l.receive(client, initial)
+	l.receive(client, []byte{0x40, 'S', 'H', 'O', 'R', 'T'})
+
+	for n := range quicMaxPendingSessions {
+		l.receive(netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 1, byte(n >> 8), byte(n)}), 1234), partial)
+	}
+
+	if len(l.sessions) != quicMaxPendingSessions {
+		t.Errorf("test 1: expecting %d sessions, got %d", quicMaxPendingSessions, len(l.sessions))
+	}
+
+	close(s.open)
+
+	for n, expected := range [...][]byte{initial, []byte("\x40SHORT")} {
+		select {
+		case d := <-s.datagrams:
+			if !bytes.Equal(d, expected) {
+				t.Errorf("test %d: expecting datagram %q, got %q", n+2, expected, d)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("test %d: timed out waiting for datagram", n+2)
+		}
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		l.mu.Lock()
+		pending := l.pending
+		l.mu.Unlock()
+
+		if pending == quicMaxPendingSessions-1 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("test 4: expecting %d pending sessions, got %d", quicMaxPendingSessions-1, pending)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	l.receive(client, []byte("\x40MORE"))
+
+	if d := <-s.datagrams; string(d) != "\x40MORE" {
+		t.Errorf("test 5: expecting datagram %q, got %q", "\x40MORE", d)
+	}
+
+	l.receive(netip.MustParseAddrPort("10.2.0.1:1234"), partial)
+
+	if len(l.sessions) != quicMaxPendingSessions+1 {
+		t.Errorf("test 6: expecting %d sessions, got %d", quicMaxPendingSessions+1, len(l.sessions))
+	}
+}
+
+func TestQUICRedirectError(t *testing.T) {
+	pa := getUnusedPort()
+
+	p, err := AddQUICRedirect(HostName(aDomain), pa, HostAddr{Net: "udp", Address: "localhost"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer p.Close()
+
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(pa)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer c.Close()
+
+	c.Write(quicInitialPacket(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, 0, append(quicCryptoFrame(0, tlsServerName(aDomain)[5:]), make([]byte, 100)...)))
+
+	for deadline := time.Now().Add(5 * time.Second); p.Status().Err == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("test 1: expecting dial error to be reported")
+		}
+	}
+}
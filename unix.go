@@ -3,6 +3,7 @@ package reverseproxy
 import (
 	"errors"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"sync"
@@ -10,27 +11,139 @@ import (
 	"syscall"
 )
 
+// The control socket between a UnixCmd and its command is a SOCK_SEQPACKET
+// socket, so that each message is read whole and never merged with another.
+//
+// Control messages, other than those listening on and closing TCP ports,
+// start with a zero port, which can never be a listening port, followed by one
+// of these operations.
+//
+// A command requests a certificate by sending controlCertificate followed by
+// the server name; the reply, or a push, consists of the operation, the length
+// prefixed server name and then either the PEM encoded certificate chain and
+// private key, or, for controlCertificateError, an error string.
+//
+// A command requests a UDP port by sending controlListenUDP followed by the
+// little-endian port; the reply repeats the message, with either a packet
+// socket attached, or an error string appended.
+const (
+	controlCertificate      = 1
+	controlCertificateError = 2
+	controlListenUDP        = 3
+)
+
+// maxTransferData is the most data sent in the same message as a transferred
+// connection, keeping the message within the default socket send buffer and
+// the receive buffer of the command.
+const maxTransferData = 64 << 10
+
 type unixService struct {
-	transferring uint64
+	transferring, copying uint64
 	MatchServiceName
 	conn *net.UnixConn
 }
 
-func (u *unixService) Transfer(buf []byte, conn *net.TCPConn) {
+// Transfer passes the connection, and any data already read from it, to the
+// command; connections to a claimed port, which have no data, arrive with a
+// single zero byte, as at least one byte must be sent with the descriptor.
+//
+// Connections with more than maxTransferData already read are instead passed
+// as with transferConn.
+func (u *unixService) Transfer(buf []byte, conn *net.TCPConn) error {
+	if len(buf) > maxTransferData {
+		return u.transferConn(buf, conn, uint16(conn.LocalAddr().(*net.TCPAddr).Port))
+	}
+
 	f, err := conn.File()
+	if err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&u.transferring, 1)
+	_, _, err = u.conn.WriteMsgUnix(buf, syscall.UnixRights(int(f.Fd())), nil)
+	atomic.AddUint64(&u.transferring, ^uint64(0))
+	f.Close()
+
+	if err != nil {
+		return err
+	}
 
 	conn.Close()
 
-	if err == nil {
-		atomic.AddUint64(&u.transferring, 1)
-		u.conn.WriteMsgUnix(buf, syscall.UnixRights(int(f.Fd())), nil)
-		atomic.AddUint64(&u.transferring, ^uint64(0))
-		f.Close()
+	return nil
+}
+
+// transferConn passes a connection that has no file descriptor of its own,
+// such as one decrypted by the proxy, to the command by way of a socket pair.
+//
+// As the command cannot determine the port or client address from the socket,
+// they are sent before the buffer, as a two byte little-endian port followed
+// by the length prefixed remote address.
+//
+// Only the first maxTransferData bytes are sent with the socket, the rest
+// being written to the socket before the connection.
+func (u *unixService) transferConn(buf []byte, conn net.Conn, port uint16) error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	lf := os.NewFile(uintptr(fds[0]), "")
+	rf := os.NewFile(uintptr(fds[1]), "")
+	p, err := net.FileConn(lf)
+
+	lf.Close()
+
+	if err != nil {
+		rf.Close()
+
+		return err
+	}
+
+	remote := conn.RemoteAddr().String()
+
+	if len(remote) > 255 {
+		remote = ""
 	}
+
+	data := append(append(append(make([]byte, 0, 3+len(remote)+len(buf)), byte(port), byte(port>>8), byte(len(remote))), remote...), buf...)
+	rest := data[min(len(data), maxTransferData):]
+
+	atomic.AddUint64(&u.transferring, 1)
+	_, _, err = u.conn.WriteMsgUnix(data[:len(data)-len(rest)], syscall.UnixRights(int(rf.Fd())), nil)
+	atomic.AddUint64(&u.transferring, ^uint64(0))
+	rf.Close()
+
+	if err != nil {
+		p.Close()
+
+		return err
+	}
+
+	atomic.AddUint64(&u.copying, 2)
+
+	go func() {
+		if _, err := p.Write(rest); err != nil {
+			p.Close()
+		}
+
+		copyConn(p, conn, &u.copying)
+	}()
+	go copyConn(conn, p, &u.copying)
+
+	return nil
+}
+
+func (u *unixService) MatchServicePath(serviceName, path string) int {
+	return matchServicePath(u.MatchServiceName, serviceName, path)
+}
+
+func (u *unixService) MatchServiceFingerprint(serviceName string, fp Fingerprint) bool {
+	return matchServiceFingerprint(u.MatchServiceName, serviceName, fp)
 }
 
 func (u *unixService) Active() bool {
-	return atomic.LoadUint64(&u.transferring) > 0
+	return atomic.LoadUint64(&u.transferring) > 0 || atomic.LoadUint64(&u.copying) > 0
 }
 
 // UnixCmd holds the information required to control (close) a server and its
@@ -39,10 +152,14 @@ type UnixCmd struct {
 	cmd  *exec.Cmd
 	conn *net.UnixConn
 
-	mu     sync.Mutex
-	open   map[uint16]*Port
-	closed bool
-	exited bool
+	opts []Option
+
+	mu      sync.Mutex
+	open    map[uint16]*Port
+	openUDP map[uint16]*unixPacketService
+	faults  *Faults
+	closed  bool
+	exited  bool
 }
 
 // Close closes all ports for the server and sends a signal to the server to
@@ -55,10 +172,7 @@ func (u *UnixCmd) Close() error {
 		return ErrClosed
 	}
 
-	for port, p := range u.open {
-		delete(u.open, port)
-		p.Close()
-	}
+	u.closePorts()
 
 	errr := u.cmd.Process.Signal(os.Interrupt)
 	u.closed = true
@@ -79,20 +193,32 @@ func (u *UnixCmd) Status() Status {
 	closed := u.closed
 	ports := make([]uint16, 0, len(u.open))
 
-	for p := range u.open {
-		ports = append(ports, p)
+	var rejected TLSRejections
+
+	for n, p := range u.open {
+		ports = append(ports, n)
+		r := p.rejections.counts()
+		rejected.Version += r.Version
+		rejected.SNI += r.SNI
+		rejected.ALPN += r.ALPN
 	}
 
 	return Status{
-		Ports:   ports,
-		Closing: closed,
-		Active:  !u.exited,
+		Ports:    ports,
+		Closing:  closed,
+		Active:   !u.exited,
+		Rejected: rejected,
 	}
 }
 
 // RegisterCmd runs the given command and waits for incoming listeners from it.
-func RegisterCmd(msn MatchServiceName, cmd *exec.Cmd) (*UnixCmd, error) {
-	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+//
+// The given options are applied to every port the command listens on, and
+// ProvideCertificates can be used to answer the certificate requests of the
+// command. Ports passed to ClaimPorts are claimed whole by the command when it
+// listens on them.
+func RegisterCmd(msn MatchServiceName, cmd *exec.Cmd, opts ...Option) (*UnixCmd, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -120,9 +246,11 @@ func RegisterCmd(msn MatchServiceName, cmd *exec.Cmd) (*UnixCmd, error) {
 	}
 
 	u := &UnixCmd{
-		cmd:  cmd,
-		conn: fconn.(*net.UnixConn),
-		open: make(map[uint16]*Port),
+		cmd:     cmd,
+		conn:    fconn.(*net.UnixConn),
+		opts:    opts,
+		open:    make(map[uint16]*Port),
+		openUDP: make(map[uint16]*unixPacketService),
 	}
 
 	go u.runCmdLoop(msn)
@@ -132,11 +260,12 @@ func RegisterCmd(msn MatchServiceName, cmd *exec.Cmd) (*UnixCmd, error) {
 
 func (u *UnixCmd) runCmdLoop(msn MatchServiceName) {
 	var (
-		buf [2]byte
+		buf [259]byte
 		srv = &unixService{
 			MatchServiceName: msn,
 			conn:             u.conn,
 		}
+		o = makeOptions(u.opts)
 	)
 
 	for {
@@ -145,11 +274,7 @@ func (u *UnixCmd) runCmdLoop(msn MatchServiceName) {
 			u.mu.Lock()
 
 			if !u.closed {
-				for port, p := range u.open {
-					delete(u.open, port)
-					p.Close()
-				}
-
+				u.closePorts()
 				u.conn.Close()
 				u.closed = true
 			}
@@ -166,6 +291,17 @@ func (u *UnixCmd) runCmdLoop(msn MatchServiceName) {
 		}
 
 		if n < 2 {
+			continue
+		} else if n > 2 && buf[0] == 0 && buf[1] == 0 {
+			switch buf[2] {
+			case controlCertificate:
+				go u.certificateRequest(msn, &o, string(buf[3:n]))
+			case controlListenUDP:
+				if n == 5 {
+					u.listenUDP(msn, uint16(buf[4])<<8|uint16(buf[3]))
+				}
+			}
+
 			continue
 		}
 
@@ -178,7 +314,7 @@ func (u *UnixCmd) runCmdLoop(msn MatchServiceName) {
 				delete(u.open, port)
 				p.Close()
 			} else {
-				p, err = addPort(port, srv)
+				p, err = addPort(port, srv, u.opts...)
 				if err != nil {
 					errStr := err.Error()
 					b := make([]byte, 2, 2+len(errStr))
@@ -188,9 +324,11 @@ func (u *UnixCmd) runCmdLoop(msn MatchServiceName) {
 
 					u.conn.WriteMsgUnix(b, nil, nil)
 				} else {
+					p.SetFaults(u.faults)
+
 					u.open[port] = p
 
-					u.conn.WriteMsgUnix(buf[:], nil, nil)
+					u.conn.WriteMsgUnix(buf[:2], nil, nil)
 				}
 			}
 		}
@@ -199,7 +337,181 @@ func (u *UnixCmd) runCmdLoop(msn MatchServiceName) {
 	}
 }
 
+// closePorts closes all TCP and UDP ports; u.mu must be held.
+func (u *UnixCmd) closePorts() {
+	for port, p := range u.open {
+		delete(u.open, port)
+		p.Close()
+	}
+
+	for port, s := range u.openUDP {
+		delete(u.openUDP, port)
+		s.close()
+	}
+}
+
+// listenUDP opens a UDP port for QUIC connections on behalf of the command,
+// which receives the datagrams over a packet socket.
+func (u *UnixCmd) listenUDP(msn MatchServiceName, port uint16) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return
+	}
+
+	msg := []byte{0, 0, controlListenUDP, byte(port), byte(port >> 8)}
+
+	if _, ok := u.openUDP[port]; ok {
+		u.conn.WriteMsgUnix(append(msg, ErrAlreadyListening.Error()...), nil, nil)
+
+		return
+	}
+
+	s, rf, err := newUnixPacketService(msn)
+	if err == nil {
+		if s.packetPort, err = addPacketPort(port, s); err != nil {
+			s.conn.Close()
+			rf.Close()
+		}
+	}
+
+	if err != nil {
+		u.conn.WriteMsgUnix(append(msg, err.Error()...), nil, nil)
+
+		return
+	}
+
+	u.openUDP[port] = s
+
+	u.conn.WriteMsgUnix(msg, syscall.UnixRights(int(rf.Fd())), nil)
+	rf.Close()
+
+	go s.run(u, port)
+}
+
+// unixPacketService passes the datagrams of QUIC connections to a command,
+// each prefixed with the length prefixed address of the client; datagrams
+// from the command are prefixed in the same way, and are only sent to clients
+// with a current session.
+type unixPacketService struct {
+	MatchServiceName
+	conn       *net.UnixConn
+	packetPort *PacketPort
+
+	mu      sync.Mutex
+	clients map[netip.AddrPort]struct{}
+}
+
+func newUnixPacketService(msn MatchServiceName) (*unixPacketService, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lf := os.NewFile(uintptr(fds[0]), "")
+	rf := os.NewFile(uintptr(fds[1]), "")
+	c, err := net.FileConn(lf)
+
+	lf.Close()
+
+	if err != nil {
+		rf.Close()
+
+		return nil, nil, err
+	}
+
+	return &unixPacketService{
+		MatchServiceName: msn,
+		conn:             c.(*net.UnixConn),
+		clients:          make(map[netip.AddrPort]struct{}),
+	}, rf, nil
+}
+
+func (u *unixPacketService) openSession(client netip.AddrPort, _ *udpListener) (packetSession, error) {
+	u.mu.Lock()
+	u.clients[client] = struct{}{}
+	u.mu.Unlock()
+
+	addr := client.String()
+
+	return &unixPacketSession{
+		service: u,
+		client:  client,
+		header:  append([]byte{byte(len(addr))}, addr...),
+	}, nil
+}
+
+func (u *unixPacketService) Active() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return len(u.clients) > 0
+}
+
+// run passes datagrams from the command to the clients, closing the port when
+// the command closes its socket.
+func (u *unixPacketService) run(cmd *UnixCmd, port uint16) {
+	buf := make([]byte, maxDatagramLength+256)
+
+	for {
+		n, err := u.conn.Read(buf)
+		if err != nil || n == 0 {
+			break
+		}
+
+		if l := int(buf[0]); n > 1+l {
+			client, err := netip.ParseAddrPort(string(buf[1 : 1+l]))
+			if err != nil {
+				continue
+			}
+
+			u.mu.Lock()
+			_, ok := u.clients[client]
+			u.mu.Unlock()
+
+			if ok {
+				writeUDP(port, client, buf[1+l:n])
+			}
+		}
+	}
+
+	cmd.mu.Lock()
+
+	if cmd.openUDP[port] == u {
+		delete(cmd.openUDP, port)
+	}
+
+	cmd.mu.Unlock()
+
+	u.close()
+}
+
+func (u *unixPacketService) close() {
+	u.packetPort.Close()
+	u.conn.Close()
+}
+
+type unixPacketSession struct {
+	service *unixPacketService
+	client  netip.AddrPort
+	header  []byte
+}
+
+func (u *unixPacketSession) write(datagram []byte) error {
+	_, err := u.service.conn.Write(append(u.header[:len(u.header):len(u.header)], datagram...))
+
+	return err
+}
+
+func (u *unixPacketSession) close() {
+	u.service.mu.Lock()
+	delete(u.service.clients, u.client)
+	u.service.mu.Unlock()
+}
+
 // Error.
 var (
-	ErrClosed = errors.New("closed")
+	ErrClosed           = errors.New("closed")
+	ErrAlreadyListening = errors.New("port already being listened on")
 )
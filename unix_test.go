@@ -2,15 +2,17 @@ package reverseproxy
 
 import (
 	"bytes"
+	"io"
 	"net"
 	"os"
+	"os/exec"
 	"syscall"
 	"testing"
 	"time"
 )
 
 func TestUnix(t *testing.T) {
-	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -25,6 +27,7 @@ func TestUnix(t *testing.T) {
 	}
 
 	u := &UnixCmd{
+		cmd:  new(exec.Cmd),
 		conn: fconn.(*net.UnixConn),
 		open: make(map[uint16]*Port),
 	}
@@ -175,3 +178,97 @@ func TestUnix(t *testing.T) {
 
 	l.Close()
 }
+
+func TestUnixTransferLarge(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var conns [2]*net.UnixConn
+
+	for n, fd := range fds {
+		nf := os.NewFile(uintptr(fd), "")
+		fconn, err := net.FileConn(nf)
+
+		nf.Close()
+
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		conns[n] = fconn.(*net.UnixConn)
+
+		defer fconn.Close()
+	}
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer l.Close()
+
+	client, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer client.Close()
+
+	server, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 50000)
+	u := &unixService{conn: conns[0]}
+
+	if err := u.Transfer(data, server); err != nil {
+		t.Fatalf("test 1: unexpected error: %s", err)
+	}
+
+	buf := make([]byte, len(data))
+	oob := make([]byte, syscall.CmsgLen(4))
+
+	n, oobn, _, _, err := conns[1].ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatalf("test 2: unexpected error: %s", err)
+	} else if n > maxTransferData {
+		t.Errorf("test 2: expecting no more than %d bytes, got %d", maxTransferData, n)
+	}
+
+	msg, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+	fd, _ := syscall.ParseUnixRights(&msg[0])
+	nf := os.NewFile(uintptr(fd[0]), "")
+
+	cn, err := net.FileConn(nf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	nf.Close()
+
+	defer cn.Close()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	header := 3 + int(buf[2])
+
+	if p := int(buf[0]) | int(buf[1])<<8; p != port {
+		t.Errorf("test 3: expecting port %d, got %d", port, p)
+	}
+
+	received := append([]byte{}, buf[header:n]...)
+
+	client.Write([]byte("MORE"))
+
+	cn.SetReadDeadline(time.Now().Add(time.Second))
+
+	rest := make([]byte, len(data)+4-len(received))
+
+	if _, err := io.ReadFull(cn, rest); err != nil {
+		t.Fatalf("test 4: unexpected error: %s", err)
+	} else if !bytes.Equal(append(received, rest...), append(data, "MORE"...)) {
+		t.Errorf("test 4: expecting all data to be received in order")
+	}
+}
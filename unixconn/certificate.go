@@ -0,0 +1,124 @@
+package unixconn
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const certificateTimeout = 30 * time.Second
+
+type certificate struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+func (c *certificate) ready() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *certificate) valid() bool {
+	return c.err == nil && (c.cert.Leaf == nil || time.Now().Before(c.cert.Leaf.NotAfter))
+}
+
+var (
+	certMu       sync.Mutex
+	certificates = make(map[string]*certificate)
+)
+
+// GetCertificate retrieves a certificate for the requested server name from
+// the reverse proxy, and can be used as the GetCertificate field of a
+// tls.Config.
+//
+// Certificates are cached, and replaced whenever the reverse proxy pushes a
+// renewed certificate.
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if atomic.LoadUint32(&fallback) == 1 {
+		return nil, ErrNoProxy
+	}
+
+	if hello.ServerName == "" {
+		return nil, ErrNoServerName
+	}
+
+	certMu.Lock()
+
+	c, ok := certificates[hello.ServerName]
+	if !ok || c.ready() && !c.valid() {
+		c = &certificate{done: make(chan struct{})}
+		certificates[hello.ServerName] = c
+
+		certMu.Unlock()
+
+		msg := append([]byte{0, 0, controlCertificate}, hello.ServerName...)
+
+		ucMu.Lock()
+		_, _, err := uc.WriteMsgUnix(msg, nil, nil)
+		ucMu.Unlock()
+
+		if err != nil {
+			setCertificate(hello.ServerName, nil, err)
+		}
+	} else {
+		certMu.Unlock()
+	}
+
+	t := time.NewTimer(certificateTimeout)
+	defer t.Stop()
+
+	select {
+	case <-c.done:
+		return c.cert, c.err
+	case <-t.C:
+		return nil, ErrCertificateTimeout
+	}
+}
+
+// handleCertificate processes a certificate reply or push from the reverse
+// proxy, which starts after the zero port.
+func handleCertificate(msg []byte) {
+	if len(msg) < 2 || len(msg) < 2+int(msg[1]) {
+		return
+	}
+
+	name := string(msg[2 : 2+msg[1]])
+	data := msg[2+msg[1]:]
+
+	switch msg[0] {
+	case controlCertificate:
+		cert, err := tls.X509KeyPair(data, data)
+		if err != nil {
+			setCertificate(name, nil, err)
+		} else {
+			setCertificate(name, &cert, nil)
+		}
+	case controlCertificateError:
+		setCertificate(name, nil, errors.New(string(data)))
+	}
+}
+
+func setCertificate(name string, cert *tls.Certificate, err error) {
+	certMu.Lock()
+	defer certMu.Unlock()
+
+	c, ok := certificates[name]
+	if ok && !c.ready() {
+		c.cert = cert
+		c.err = err
+
+		close(c.done)
+	} else if err == nil {
+		c = &certificate{done: make(chan struct{}), cert: cert}
+		certificates[name] = c
+
+		close(c.done)
+	}
+}
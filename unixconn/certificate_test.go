@@ -0,0 +1,73 @@
+package unixconn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandleCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "a.com"},
+		DNSNames:     []string{"a.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	msg := append([]byte{controlCertificate, 5}, "a.com"...)
+	msg = append(msg, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	msg = append(msg, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})...)
+
+	fb := atomic.LoadUint32(&fallback)
+
+	atomic.StoreUint32(&fallback, 0)
+
+	defer atomic.StoreUint32(&fallback, fb)
+
+	handleCertificate(msg)
+
+	if cert, err := GetCertificate(&tls.ClientHelloInfo{ServerName: "a.com"}); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(cert.Certificate[0]) != string(der) {
+		t.Errorf("test 1: received certificate does not match")
+	}
+
+	handleCertificate(append([]byte{controlCertificateError, 5}, "b.com error"...))
+
+	if _, ok := certificates["b.com"]; ok {
+		t.Errorf("test 2: unrequested error should not be cached")
+	}
+
+	c := &certificate{done: make(chan struct{})}
+	certificates["b.com"] = c
+
+	handleCertificate(append([]byte{controlCertificateError, 5}, "b.com error"...))
+
+	if !c.ready() || c.err == nil || c.err.Error() != " error" {
+		t.Errorf("test 3: expecting error %q, got %v", " error", c.err)
+	}
+}
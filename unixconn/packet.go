@@ -0,0 +1,137 @@
+package unixconn
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+const maxDatagramLength = 1<<16 - 1
+
+type nps struct {
+	conn *net.UnixConn
+	err  error
+}
+
+var (
+	listeningPackets map[uint16]struct{}
+	newPacketSocket  chan nps
+)
+
+// packetConn receives the datagrams of QUIC connections from the reverse
+// proxy, each prefixed with the length prefixed address of the client.
+type packetConn struct {
+	*net.UnixConn
+	port  uint16
+	local net.Addr
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// ReadFrom reads a datagram, returning the address of the client that sent it.
+func (p *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		n, err := p.UnixConn.Read(p.buf)
+		if err != nil {
+			return 0, nil, err
+		} else if n == 0 {
+			return 0, nil, net.ErrClosed
+		}
+
+		l := int(p.buf[0])
+		if n <= l {
+			continue
+		}
+
+		addr, err := netip.ParseAddrPort(string(p.buf[1 : 1+l]))
+		if err != nil {
+			continue
+		}
+
+		return copy(b, p.buf[1+l:n]), net.UDPAddrFromAddrPort(addr), nil
+	}
+}
+
+// WriteTo sends a datagram to a client.
+func (p *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a := addr.String()
+	if len(a) > 255 {
+		return 0, ErrInvalidAddress
+	}
+
+	msg := append(append(make([]byte, 0, 1+len(a)+len(b)), byte(len(a))), a...)
+
+	if _, err := p.UnixConn.Write(append(msg, b...)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// LocalAddr returns the address of the proxy port.
+func (p *packetConn) LocalAddr() net.Addr {
+	return p.local
+}
+
+func (p *packetConn) Close() error {
+	ucMu.Lock()
+	delete(listeningPackets, p.port)
+	ucMu.Unlock()
+
+	return p.UnixConn.Close()
+}
+
+// ListenPacket creates a reverse proxy packet connection, which receives the
+// datagrams of QUIC connections routed by server name, falling back to the net
+// package if the reverse proxy is not available.
+func ListenPacket(network, address string) (net.PacketConn, error) {
+	if atomic.LoadUint32(&fallback) == 1 {
+		return net.ListenPacket(network, address)
+	}
+
+	port := getPort(address)
+	if port == 0 {
+		return nil, ErrInvalidAddress
+	}
+
+	buf := [5]byte{0, 0, controlListenUDP, byte(port), byte(port >> 8)}
+
+	ucMu.Lock()
+
+	if _, ok := listeningPackets[port]; ok {
+		ucMu.Unlock()
+
+		return nil, ErrAlreadyListening
+	}
+
+	_, _, err := uc.WriteMsgUnix(buf[:], nil, nil)
+	if err != nil {
+		ucMu.Unlock()
+
+		return nil, err
+	}
+
+	nps := <-newPacketSocket
+
+	if nps.err == nil {
+		listeningPackets[port] = struct{}{}
+	}
+
+	ucMu.Unlock()
+
+	if nps.err != nil {
+		return nil, nps.err
+	}
+
+	return &packetConn{
+		UnixConn: nps.conn,
+		port:     port,
+		local:    &net.UDPAddr{Port: int(port)},
+		buf:      make([]byte, maxDatagramLength+256),
+	}, nil
+}
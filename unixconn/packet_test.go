@@ -0,0 +1,55 @@
+package unixconn
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestPacketConn(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var conns [2]*net.UnixConn
+
+	for n, fd := range fds {
+		f := os.NewFile(uintptr(fd), "")
+		c, err := net.FileConn(f)
+
+		f.Close()
+
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		conns[n] = c.(*net.UnixConn)
+
+		defer c.Close()
+	}
+
+	p := &packetConn{UnixConn: conns[0], port: 443, local: &net.UDPAddr{Port: 443}, buf: make([]byte, maxDatagramLength+256)}
+	buf := make([]byte, 32)
+
+	conns[1].Write([]byte("\x0e127.0.0.1:1234DATA"))
+
+	if n, addr, err := p.ReadFrom(buf); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(buf[:n]) != "DATA" {
+		t.Errorf("test 1: expecting data %q, got %q", "DATA", buf[:n])
+	} else if addr.String() != "127.0.0.1:1234" {
+		t.Errorf("test 1: expecting address %q, got %q", "127.0.0.1:1234", addr)
+	}
+
+	if _, err := p.WriteTo([]byte("REPLY"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5678}); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	}
+
+	if n, err := conns[1].Read(buf); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if expected := "\x0d10.0.0.1:5678REPLY"; string(buf[:n]) != expected {
+		t.Errorf("test 2: expecting %q, got %q", expected, buf[:n])
+	}
+}
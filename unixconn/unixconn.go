@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"runtime"
 	"strconv"
@@ -14,6 +15,14 @@ import (
 	"time"
 )
 
+// These operations mirror those of the reverse proxy, and follow a zero port
+// in a control message.
+const (
+	controlCertificate      = 1
+	controlCertificateError = 2
+	controlListenUDP        = 3
+)
+
 type buffer [http.DefaultMaxHeaderBytes]byte
 
 type ns struct {
@@ -43,7 +52,9 @@ func init() {
 		if ok {
 			fallback = 0
 			newSocket = make(chan ns)
+			newPacketSocket = make(chan nps)
 			listeningSockets = make(map[uint16]struct{})
+			listeningPackets = make(map[uint16]struct{})
 
 			go runListenLoop()
 		}
@@ -56,7 +67,7 @@ func runListenLoop() {
 	sockets := make(map[uint16]chan net.Conn)
 
 	for {
-		n, oobn, _, _, err := uc.ReadMsgUnix(buf[:], oob)
+		n, oobn, flags, _, err := uc.ReadMsgUnix(buf[:], oob)
 		if err != nil {
 			for _, c := range sockets {
 				close(c)
@@ -68,7 +79,15 @@ func runListenLoop() {
 		}
 
 		if oobn == 0 {
-			if n == 2 {
+			if n > 2 && buf[0] == 0 && buf[1] == 0 {
+				if buf[2] == controlListenUDP {
+					if n > 5 {
+						newPacketSocket <- nps{err: errors.New(string(buf[5:n]))}
+					}
+				} else {
+					handleCertificate(buf[2:n])
+				}
+			} else if n == 2 {
 				port := uint16(buf[1])<<8 | uint16(buf[0])
 				if s, ok := sockets[port]; ok {
 					close(s)
@@ -86,46 +105,45 @@ func runListenLoop() {
 		} else if msg, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil && len(msg) == 1 {
 			if fd, err := syscall.ParseUnixRights(&msg[0]); err == nil && len(fd) == 1 {
 				nf := os.NewFile(uintptr(fd[0]), "")
-				if cn, err := net.FileConn(nf); err == nil {
-					if ra := cn.RemoteAddr(); ra != nil {
-						var port uint16
-
-						if tcpaddr, ok := cn.LocalAddr().(*net.TCPAddr); ok {
-							port = uint16(tcpaddr.Port)
-						} else {
-							port = getPort(cn.LocalAddr().String())
-						}
+				cn, err := net.FileConn(nf)
 
-						c, ok := sockets[port]
-						if ok {
-							if ka, ok := cn.(keepAlive); ok {
-								if err := ka.SetKeepAlive(true); err == nil {
-									ka.SetKeepAlivePeriod(3 * time.Minute)
-								}
-							}
+				nf.Close()
+
+				if n == 5 && buf[0] == 0 && buf[1] == 0 && buf[2] == controlListenUDP {
+					if err != nil {
+						newPacketSocket <- nps{err: err}
+					} else if pc, ok := cn.(*net.UnixConn); ok {
+						newPacketSocket <- nps{conn: pc}
+					} else {
+						cn.Close()
 
-							cc := &conn{
-								Conn:   cn,
-								buf:    buf,
-								length: n,
+						newPacketSocket <- nps{err: ErrInvalidPacketSocket}
+					}
+				} else if err == nil {
+					cc := &conn{
+						Conn:   cn,
+						buf:    buf,
+						length: n,
+					}
+
+					if c, ok := sockets[cc.port()]; ok && flags&syscall.MSG_TRUNC == 0 { // a truncated buffer would corrupt the stream
+						if ka, ok := cn.(keepAlive); ok {
+							if err := ka.SetKeepAlive(true); err == nil {
+								ka.SetKeepAlivePeriod(3 * time.Minute)
 							}
+						}
 
-							buf = bufPool.Get().(*buffer)
+						buf = bufPool.Get().(*buffer)
 
-							runtime.SetFinalizer(cc, (*conn).Close)
+						runtime.SetFinalizer(cc, (*conn).Close)
 
-							go sendConn(c, cc)
+						go sendConn(c, cc)
 
-							continue
-						} else {
-							cn.Close()
-						}
-					} else {
-						cn.Close()
+						continue
 					}
-				}
 
-				nf.Close()
+					cn.Close()
+				}
 			}
 		}
 
@@ -154,26 +172,86 @@ type keepAlive interface {
 
 type conn struct {
 	net.Conn
-	buf    *buffer
-	pos    int
-	length int
+	buf           *buffer
+	pos           int
+	length        int
+	local, remote net.Addr
+}
+
+// port determines the port that the connection was made to.
+//
+// Connections that have been decrypted by the proxy are passed as unix
+// sockets, and the buffer starts with a header containing the port and the
+// remote address of the client.
+func (c *conn) port() uint16 {
+	if _, ok := c.Conn.(*net.UnixConn); ok {
+		if c.length < 3 || c.length < 3+int(c.buf[2]) {
+			return 0
+		}
+
+		port := uint16(c.buf[1])<<8 | uint16(c.buf[0])
+		c.pos = 3 + int(c.buf[2])
+		c.local = &net.TCPAddr{Port: int(port)}
+
+		if ap, err := netip.ParseAddrPort(string(c.buf[3:c.pos])); err == nil {
+			c.remote = net.TCPAddrFromAddrPort(ap)
+		}
+
+		return port
+	}
+
+	if c.length == 1 && c.buf[0] == 0 {
+		// connections to a claimed port have no data, so are sent with a
+		// single zero byte
+		c.pos = 1
+	}
+
+	if c.Conn.RemoteAddr() == nil {
+		return 0
+	} else if tcpaddr, ok := c.Conn.LocalAddr().(*net.TCPAddr); ok {
+		return uint16(tcpaddr.Port)
+	}
+
+	return getPort(c.Conn.LocalAddr().String())
 }
 
 func (c *conn) Read(b []byte) (int, error) {
 	if c.buf != nil {
-		n := copy(b, c.buf[c.pos:c.length])
-		c.pos += n
+		if c.pos < c.length {
+			n := copy(b, c.buf[c.pos:c.length])
+			c.pos += n
 
-		if c.pos == c.length {
-			c.clearBuffer()
+			if c.pos == c.length {
+				c.clearBuffer()
+			}
+
+			return n, nil
 		}
 
-		return n, nil
+		c.clearBuffer()
 	}
 
 	return c.Conn.Read(b)
 }
 
+// LocalAddr returns the address of the proxy port the connection was made to.
+func (c *conn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the client.
+func (c *conn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
 func (c *conn) clearBuffer() {
 	for n := range c.buf[:c.length] {
 		c.buf[n] = 0
@@ -303,6 +381,10 @@ func getPort(address string) uint16 {
 
 // Errors.
 var (
-	ErrInvalidAddress   = errors.New("port must be 0 < port < 2^16")
-	ErrAlreadyListening = errors.New("port already being listened on")
+	ErrInvalidAddress      = errors.New("port must be 0 < port < 2^16")
+	ErrAlreadyListening    = errors.New("port already being listened on")
+	ErrNoProxy             = errors.New("not running under reverse proxy")
+	ErrNoServerName        = errors.New("no server name")
+	ErrCertificateTimeout  = errors.New("timeout waiting for certificate")
+	ErrInvalidPacketSocket = errors.New("invalid packet socket")
 )
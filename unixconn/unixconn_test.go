@@ -34,7 +34,7 @@ func TestMain(m *testing.T) {
 }
 
 func TestUnixConn(t *testing.T) {
-	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
 	if err != nil {
 		t.Errorf("unexpected error creating socket pair: %s", err)
 		return
@@ -302,3 +302,42 @@ func transfer(conn *net.UnixConn, c *net.TCPConn, data []byte) {
 	f, _ := c.File()
 	conn.WriteMsgUnix(data, syscall.UnixRights(int(f.Fd())), nil)
 }
+
+func TestConnHeader(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "")
+	cn, err := net.FileConn(f)
+
+	f.Close()
+	syscall.Close(fds[1])
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	b := new(buffer)
+	header := "\x34\x12\x0e127.0.0.1:1234BUF"
+	c := &conn{Conn: cn, buf: b, length: copy(b[:], header)}
+
+	defer c.Close()
+
+	if port := c.port(); port != 0x1234 {
+		t.Errorf("test 1: expecting port %d, got %d", 0x1234, port)
+	}
+
+	if addr := c.RemoteAddr().String(); addr != "127.0.0.1:1234" {
+		t.Errorf("test 2: expecting remote address %q, got %q", "127.0.0.1:1234", addr)
+	}
+
+	if addr, ok := c.LocalAddr().(*net.TCPAddr); !ok || addr.Port != 0x1234 {
+		t.Errorf("test 3: expecting local port %d, got %v", 0x1234, c.LocalAddr())
+	}
+
+	if data, _ := io.ReadAll(c); string(data) != "BUF" {
+		t.Errorf("test 4: expecting data %q, got %q", "BUF", data)
+	}
+}